@@ -5,17 +5,17 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jhead/phantom/internal/proto"
 	"github.com/jhead/phantom/internal/proxy"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-var bindAddressString string
-var serverAddressString string
-var bindPortInt uint16
-
 func main() {
 	// Required
 	serverArg := flag.String("server", "", "Required: Bedrock/MCPE server IP address and port (ex: 1.2.3.4:19132)")
@@ -26,13 +26,187 @@ func main() {
 	timeoutArg := flag.Int("timeout", 60, "Optional: Seconds to wait before cleaning up a disconnected client")
 	debugArg := flag.Bool("debug", false, "Optional: Enables debug logging")
 	ipv6Arg := flag.Bool("6", false, "Optional: Enables IPv6 support on port 19133 (experimental)")
+	keepMappedArg := flag.Bool("keep_mapped_addrs", false, "Optional: Keeps IPv4-mapped IPv6 client addresses as reported instead of converting them to IPv4")
+	ipv6OnlyArg := flag.Bool("ipv6_only", false, "Optional: Only binds IPv6 sockets, for hosts without IPv4. Implies -6 and -prefer_ipv6.")
+	preservePortsArg := flag.Bool("preserve_ports", false, "Optional: Keeps the server's own ports in pong packets instead of phantom's, for servers that clients can reach directly")
 	removePortsArg := flag.Bool("remove_ports", false, "Optional: Forces ports to be excluded from pong packets (experimental)")
 	workersArg := flag.Uint("workers", 1, "Optional: Number of workers, useful for tweaking performance (experimental)")
+	readWorkersArg := flag.Int("read_workers", 1, "Optional: Number of sockets on the bind port to read client packets from, each with -workers workers, which Linux spreads clients over. Helps proxies with very many players on hosts with several cores (experimental)")
+	rotateIDArg := flag.Int("rotate_id", 0, "Optional: Seconds between generating a new advertised server ID. Defaults to 0, which never rotates it.")
+	pongCacheArg := flag.Int("pong_cache", 0, "Optional: Seconds to keep answering pings with the last server reply while the server is unresponsive. Defaults to 0, which disables it.")
+	motdArg := flag.String("motd", "", "Optional: Overrides the server name shown in the LAN server list")
+	obfuscateMOTDArg := flag.Bool("obfuscate_motd", false, "Optional: Adds an invisible per-client token to the server name to hinder scrapers (experimental)")
+	batchWritesArg := flag.Bool("batch_writes", false, "Optional: Sends bursts of server packets to clients in a single syscall where supported (experimental)")
+	dscpArg := flag.Int("dscp", 0, "Optional: DSCP value (0-63) to mark packets sent to clients with, for networks that prioritize traffic by it, such as 46. Defaults to 0, which leaves packets unmarked.")
+	readBufferArg := flag.Int("read_buffer", 0, "Optional: Size in bytes of the OS receive buffer for each listener. Defaults to 0, which uses the OS default.")
+	connectTimeoutArg := flag.Int("connect_timeout", 0, "Optional: Seconds to wait for the server to answer a new client before showing the client an error. Defaults to 0, which waits silently.")
+	adminArg := flag.String("admin", "", "Optional: Address (host:port) for an admin HTTP server exposing connection details (/connections), stats (/stats, POST /stats/reset), per-IP usage (/usage), runtime blocks (/blocklist), servers (/backends) and Prometheus metrics (/metrics). Defaults to disabled.")
+	adminTokenArg := flag.String("admin_token", "", "Optional: Bearer token required to make changes through the -admin and -grpc servers, such as blocking IPs. Defaults to none, which only allows changes from localhost. Set admin_token in the -config file instead to keep it out of the process list.")
+	grpcArg := flag.String("grpc", "", "Optional: Address (host:port) for a gRPC admin server exposing stats, connections, disconnects, maintenance mode and reloads, as defined in internal/adminpb/admin.proto. Defaults to disabled.")
+	preferIPv6Arg := flag.Bool("prefer_ipv6", false, "Optional: Connects to the server over IPv6 when its hostname has both IPv4 and IPv6 addresses")
+	syslogArg := flag.String("syslog", "", "Optional: Address (host:port) of a syslog server to send logs to instead of the console")
+	bindRetriesArg := flag.Int("bind_retries", 0, "Optional: How many other random ports to try if the random bind port is taken. Defaults to 0, which uses 3. Negative disables retries.")
+	maxEgressArg := flag.Int("max_egress", 0, "Optional: Limit on the bytes per second sent to all clients together. Defaults to 0, which means no limit.")
+	egressRampUpArg := flag.Int("egress_ramp_up", 0, "Optional: Seconds over which -max_egress ramps up from a tenth to the full rate after startup, to smooth the burst of reconnects that follows a restart. Defaults to 0, which allows the full rate right away.")
+	mirrorArg := flag.String("mirror", "", "Optional: Address (host:port) to send a copy of every packet from clients to over UDP, such as an IDS. Copies are best-effort and never slow down the packets themselves. Defaults to disabled.")
+	maxPlayersArg := flag.Int("max_players", 0, "Optional: Max players to advertise in place of the server's. Defaults to 0, which shows the server's.")
+	maxPingSourcesArg := flag.Int("max_ping_sources", 0, "Optional: Maximum number of clients with pings awaiting a reply from the server, forgetting the least recent ones past it. Defaults to 0, which means no limit.")
+	maxConnectionsArg := flag.Int("max_connections", 0, "Optional: Maximum number of client connections. Defaults to 0, which means no limit.")
+	maxHandshakesArg := flag.Int("max_handshakes", 0, "Optional: Maximum number of new connections waiting on the server's first reply at once, dropping packets from further new clients until one answers. Smooths reconnect storms after a server restart. Defaults to 0, which means no limit.")
+	sendFullArg := flag.Bool("send_full", false, "Optional: Tells clients refused because of -max_connections that the server is full, instead of letting them time out")
+	clientKeyArg := flag.String("client_key", "addr", "Optional: How to tell clients apart: addr (IP and port), or ip for running behind a load balancer that changes source ports. Keying by ip lets only one player behind the same NAT connect at a time.")
+	overflowPolicyArg := flag.String("overflow_policy", "reject", "Optional: What to do with new clients beyond -max_connections: reject, or evict_lru to close the least recently active connection instead")
+	allowArg := flag.String("allow", "", "Optional: Comma-separated IPv4/IPv6 addresses or CIDR ranges of the only clients allowed to connect. Defaults to allowing everyone.")
+	blockArg := flag.String("block", "", "Optional: Comma-separated IPv4/IPv6 addresses or CIDR ranges of clients to ignore")
+	blocklistStateArg := flag.String("blocklist_state", "", "Optional: Path of a JSON file that IPs blocked at runtime are saved to and restored from, so that blocks survive restarts. Defaults to disabled.")
+	pingAmplificationArg := flag.Float64("ping_amplification", 0, "Optional: Largest reply sent to a ping from a client without a connection, as a multiple of the ping's size, to avoid amplifying reflection attacks. Defaults to 0, which uses 20. Negative disables the limit.")
+	pingPortsArg := flag.String("ping_ports", "", "Optional: Comma-separated ports to listen for LAN discovery pings on instead of 19132 (and 19133 with -6), for networks whose clients broadcast to other ports")
+	healthCheckIntervalArg := flag.Int("health_check_interval", 0, "Optional: Seconds between pings checking that -server and each of -fallback_servers answer. New clients skip servers that fail -health_check_failures checks in a row. Defaults to 0, which means never.")
+	healthCheckFailuresArg := flag.Int("health_check_failures", 0, "Optional: Number of failed health checks in a row after which new clients skip a server. Defaults to 0, which uses 3.")
+	allUnhealthyPolicyArg := flag.String("all_unhealthy_policy", "least_recently_failed", "Optional: What to do with new clients while every server fails its health checks: least_recently_failed to keep trying the server that failed longest ago, or reject to refuse them and show the server as offline")
+	drainGraceArg := flag.Int("drain_grace", 0, "Optional: Seconds after a server is drained through the admin server before the connections still on it are closed, so that players reconnect to another. Defaults to 0, which leaves them until they disconnect.")
+	fallbackArg := flag.String("fallback_servers", "", "Optional: Comma-separated server addresses (ex: 5.6.7.8:19132) to move new clients to, in order, when connections to -server time out or are refused")
+	pingServerArg := flag.String("ping_server", "", "Optional: Server IP address and port to forward pings to instead of -server, such as a separate status responder")
+	pingBindArg := flag.String("ping_bind", "", "Optional: Comma-separated local IP addresses to listen for pings on instead of all addresses, to only show up in server lists on those networks")
+	routesArg := flag.String("routes", "", "Optional: Comma-separated routes pinning clients to servers, each an IP address or CIDR range, =, and a server address (ex: 10.0.0.0/8=1.2.3.4:19132). Other clients use -server.")
+	resolveClientsArg := flag.Bool("resolve_clients", false, "Optional: Looks up the reverse DNS names of clients to show in logs and connection details")
+	breakerThresholdArg := flag.Int("breaker_threshold", 0, "Optional: Number of consecutive failed connections to the server after which new connections are refused for -breaker_cooldown. Defaults to 0, which means never.")
+	breakerCooldownArg := flag.Int("breaker_cooldown", 30, "Optional: Seconds to refuse new connections for once -breaker_threshold is reached")
+	checkServerArg := flag.Bool("check_server", false, "Optional: Pings the server at startup and exits if it doesn't answer")
+	connLogArg := flag.String("conn_log", "", "Optional: Path of a file to append a line of JSON to for every completed connection, as an audit trail. Defaults to disabled.")
+	connLogMaxArg := flag.Int64("conn_log_max_bytes", 0, "Optional: Size in bytes past which -conn_log is rotated, keeping 5 old files. Defaults to 0, which leaves rotation to tools like logrotate (send SIGHUP to reopen the file).")
+	eventsArg := flag.String("events", "", "Optional: Path of a Unix socket streaming connect and disconnect events as lines of JSON, for local programs. Defaults to disabled.")
+	forwardEmptyArg := flag.Bool("forward_empty", false, "Optional: Forwards empty packets from clients to the server instead of dropping them, for tools that send them as keep-alives")
+	requireHandshakeArg := flag.Bool("require_handshake", false, "Optional: Drops packets from clients without a connection unless they start a handshake or are pings, so that spoofed floods of game traffic can't open connections to the server")
+	dropUnknownArg := flag.Bool("drop_unknown", false, "Optional: Drops packets that don't look like Minecraft traffic, such as from port scanners, instead of passing them to the server")
+	keepAliveArg := flag.Bool("keep_alive", false, "Optional: Pings the server on quiet sessions to keep NAT bindings from expiring")
+	statsdArg := flag.String("statsd", "", "Optional: Address (host:port) of a StatsD server to send stats to. Defaults to disabled.")
+	statsdIntervalArg := flag.Int("statsd_interval", 10, "Optional: Seconds between sending stats to -statsd")
+	alertWebhookArg := flag.String("alert_webhook", "", "Optional: URL to POST a JSON alert to when the number of connections reaches -alert_high or drops below -alert_low, and when it returns between them. Defaults to disabled.")
+	alertHighArg := flag.Int("alert_high", 0, "Optional: Number of connections at which to alert -alert_webhook that the proxy is busy. Defaults to 0, which means never.")
+	alertLowArg := flag.Int("alert_low", 0, "Optional: Number of connections below which to alert -alert_webhook that the proxy is idle. Defaults to 0, which means never.")
+	labelArg := flag.String("label", "", "Optional: Name for this instance in metrics. Defaults to the port it listens on.")
+	autoMTUArg := flag.Bool("auto_mtu", false, "Optional: Probes the largest packet size the server accepts at startup instead of assuming 1472 bytes (experimental)")
+	serverTimeoutArg := flag.Int("server_timeout", 0, "Optional: Seconds to wait for the server to answer a client before closing the connection. Defaults to 0, which uses -timeout.")
+	advertiseHostArg := flag.String("advertise_host", "", "Optional: Host players should connect to, shown at startup. Defaults to this device's IP address.")
+	advertisePortArg := flag.Int("advertise_port", 0, "Optional: Port players should connect to, shown at startup. Defaults to the bind port.")
+	publicIPArg := flag.Bool("public_ip", false, "Optional: Looks up this device's public IP address online to show at startup")
+	configArg := flag.String("config", "", "Optional: Path to a JSON file to load options from. Flags given as well override it.")
+	usageWindowArg := flag.Int("usage_window", 0, "Optional: Seconds over which to total the traffic of each client IP across reconnects, shown at /usage. Defaults to 0, which disables it.")
+	usageQuotaArg := flag.Uint64("usage_quota", 0, "Optional: Bytes a client IP may send and receive within -usage_window before its packets are dropped. Defaults to 0, which means no limit.")
+	allowAnyPongSourceArg := flag.Bool("allow_any_pong_source", false, "Optional: With -unconnected_backend, accepts pongs from any port of the server's IP instead of only the server's address")
+	unconnectedBackendArg := flag.Bool("unconnected_backend", false, "Optional: Follows the server if it changes its reply port mid-session (experimental)")
+
+	// Builds the prefs given by the flags
+	flagPrefs := func() (proxy.ProxyPrefs, error) {
+		bindAddress := *bindArg
+		idleTimeout := time.Duration(*timeoutArg) * time.Second
+
+		// Options left at their defaults can come from the environment instead
+		setFlags := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		if !setFlags["bind"] {
+			bindAddress = ""
+		}
+		if !setFlags["timeout"] {
+			idleTimeout = 0
+		}
+
+		pingPorts, err := parsePorts(*pingPortsArg)
+		if err != nil {
+			return proxy.ProxyPrefs{}, fmt.Errorf("Invalid -ping_ports: %s", err)
+		}
+
+		pongOverrides := proto.PongOverrides{}
+		if *motdArg != "" {
+			pongOverrides = pongOverrides.MOTD(*motdArg)
+		}
+
+		return proxy.ProxyPrefs{
+			BindAddress:             bindAddress,
+			BindPort:                uint16(*bindPortArg),
+			RemoteServer:            *serverArg,
+			IdleTimeout:             idleTimeout,
+			EnableIPv6:              *ipv6Arg,
+			IPv6Only:                *ipv6OnlyArg,
+			KeepMappedAddrs:         *keepMappedArg,
+			RemovePorts:             *removePortsArg,
+			PreservePorts:           *preservePortsArg,
+			NumWorkers:              *workersArg,
+			ReadWorkers:             *readWorkersArg,
+			UnconnectedBackend:      *unconnectedBackendArg,
+			AllowAnyPongSource:      *allowAnyPongSourceArg,
+			ServerIDRotateInterval:  time.Duration(*rotateIDArg) * time.Second,
+			PongCacheTTL:            time.Duration(*pongCacheArg) * time.Second,
+			BatchWrites:             *batchWritesArg,
+			PongOverrides:           pongOverrides,
+			ObfuscateMOTD:           *obfuscateMOTDArg,
+			ListenerReadBufferBytes: *readBufferArg,
+			ClientDSCP:              *dscpArg,
+			ConnectTimeout:          time.Duration(*connectTimeoutArg) * time.Second,
+			AdminAddr:               *adminArg,
+			AdminToken:              *adminTokenArg,
+			GRPCAddr:                *grpcArg,
+			PreferIPv6Backend:       *preferIPv6Arg,
+			AutoMTU:                 *autoMTUArg,
+			MaxConnections:          *maxConnectionsArg,
+			MaxPingSources:          *maxPingSourcesArg,
+			MaxConcurrentHandshakes: *maxHandshakesArg,
+			MaxPlayersOverride:      *maxPlayersArg,
+			TotalEgressBytesPerSec:  *maxEgressArg,
+			EgressRampUp:            time.Duration(*egressRampUpArg) * time.Second,
+			OverflowPolicy:          *overflowPolicyArg,
+			ClientKey:               *clientKeyArg,
+			SendFullResponse:        *sendFullArg,
+			AllowedClients:          strings.Split(*allowArg, ","),
+			BlockedClients:          strings.Split(*blockArg, ","),
+			BlocklistStatePath:      *blocklistStateArg,
+			PingBindAddrs:           strings.Split(*pingBindArg, ","),
+			PingPorts:               pingPorts,
+			PingBackend:             *pingServerArg,
+			FallbackServers:         strings.Split(*fallbackArg, ","),
+			HealthCheckInterval:     time.Duration(*healthCheckIntervalArg) * time.Second,
+			HealthCheckFailures:     *healthCheckFailuresArg,
+			AllUnhealthyPolicy:      *allUnhealthyPolicyArg,
+			DrainGracePeriod:        time.Duration(*drainGraceArg) * time.Second,
+			BindRetries:             *bindRetriesArg,
+			PingAmplificationFactor: *pingAmplificationArg,
+			StaticRoutes:            parseRoutes(*routesArg),
+			ResolveClientPTR:        *resolveClientsArg,
+			CheckBackendAtStart:     *checkServerArg,
+			BreakerThreshold:        *breakerThresholdArg,
+			BreakerCooldown:         time.Duration(*breakerCooldownArg) * time.Second,
+			Label:                   *labelArg,
+			StatsdAddr:              *statsdArg,
+			MirrorAddr:              *mirrorArg,
+			StatsdInterval:          time.Duration(*statsdIntervalArg) * time.Second,
+			AlertWebhook:            *alertWebhookArg,
+			AlertHighConnections:    *alertHighArg,
+			AlertLowConnections:     *alertLowArg,
+			KeepAlive:               *keepAliveArg,
+			DropUnknownPackets:      *dropUnknownArg,
+			RequireHandshake:        *requireHandshakeArg,
+			ForwardEmptyPackets:     *forwardEmptyArg,
+			EventSocketPath:         *eventsArg,
+			ConnLogPath:             *connLogArg,
+			ConnLogMaxBytes:         *connLogMaxArg,
+			BackendIdleTimeout:      time.Duration(*serverTimeoutArg) * time.Second,
+			UsageWindow:             time.Duration(*usageWindowArg) * time.Second,
+			UsageQuotaBytes:         *usageQuotaArg,
+			AdvertiseHost:           *advertiseHostArg,
+			AdvertisePort:           uint16(*advertisePortArg),
+			DetectPublicIP:          *publicIPArg,
+		}, nil
+	}
+
+	// Options given on the command line override the config file. They are
+	// told apart by differing from the prefs of the flags' defaults.
+	defaultPrefs, _ := flagPrefs()
 
 	flag.Usage = usage
 	flag.Parse()
 
-	if *serverArg == "" {
+	if *serverArg == "" && *configArg == "" && os.Getenv("PHANTOM_SERVER") == "" {
 		// Maybe it only has the server IP?
 		if len(os.Args) == 2 {
 			*serverArg = os.Args[1]
@@ -43,33 +217,63 @@ func main() {
 		}
 	}
 
-	bindAddressString = *bindArg
-	serverAddressString = *serverArg
-	idleTimeout := time.Duration(*timeoutArg) * time.Second
-	bindPortInt = uint16(*bindPortArg)
-
 	logLevel := zerolog.InfoLevel
 	if *debugArg {
 		logLevel = zerolog.DebugLevel
 	}
 
-	fmt.Printf("Starting up with remote server IP: %s\n", serverAddressString)
-
 	// Configure logging output
 	log.Logger = log.
 		Output(zerolog.ConsoleWriter{Out: os.Stdout}).
 		Level(logLevel)
 
-	proxyServer, err := proxy.New(proxy.ProxyPrefs{
-		bindAddressString,
-		bindPortInt,
-		serverAddressString,
-		idleTimeout,
-		*ipv6Arg,
-		*removePortsArg,
-		*workersArg,
-	})
+	if *syslogArg != "" {
+		writer, err := proxy.NewSyslogWriter(*syslogArg)
+		if err != nil {
+			fmt.Printf("Invalid -syslog: %s\n", err)
+			return
+		}
+		defer writer.Close()
+
+		log.Logger = log.Output(writer).Level(logLevel)
+	}
+
+	prefs, err := flagPrefs()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *configArg != "" {
+		filePrefs, err := proxy.LoadPrefs(*configArg)
+		if err != nil {
+			fmt.Printf("Failed to load config: %s\n", err)
+			return
+		}
+
+		prefs = overrideChanged(filePrefs, prefs, defaultPrefs)
+	}
+
+	prefs = prefs.WithEnv()
+	if prefs.BindAddress == "" {
+		prefs.BindAddress = *bindArg
+	}
+	if prefs.IdleTimeout == 0 {
+		prefs.IdleTimeout = time.Duration(*timeoutArg) * time.Second
+	}
+
+	fmt.Printf("Starting up with remote server IP: %s\n", prefs.RemoteServer)
 
+	listenConn, pingListenConn, err := systemdListeners()
+	if err != nil {
+		fmt.Printf("Failed to use systemd sockets: %s\n", err)
+		return
+	}
+
+	prefs.ListenConn = listenConn
+	prefs.PingListenConn = pingListenConn
+
+	proxyServer, err := proxy.New(prefs)
 	if err != nil {
 		fmt.Printf("Failed to init server: %s\n", err)
 		return
@@ -78,16 +282,79 @@ func main() {
 	// Watch for CTRL + C
 	watchForInterrupt(proxyServer)
 
+	// Watch for SIGUSR1 to close idle connections
+	watchForSweep(proxyServer)
+
+	// Watch for SIGHUP to reopen the connection log
+	watchForReopen(proxyServer)
+
 	if err := proxyServer.Start(); err != nil {
 		fmt.Printf("Failed to start server: %s\n", err)
 	}
 }
 
+// Returns the prefs with the options that differ between changed and
+// defaults replaced by those of changed
+func overrideChanged(prefs, changed, defaults proxy.ProxyPrefs) proxy.ProxyPrefs {
+	target := reflect.ValueOf(&prefs).Elem()
+	changedValue := reflect.ValueOf(changed)
+	defaultsValue := reflect.ValueOf(defaults)
+
+	for i := 0; i < target.NumField(); i++ {
+		if !reflect.DeepEqual(changedValue.Field(i).Interface(), defaultsValue.Field(i).Interface()) {
+			target.Field(i).Set(changedValue.Field(i))
+		}
+	}
+
+	return prefs
+}
+
 func usage() {
 	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] -server <server-ip>\n\nOptions:\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
+// Parses comma-separated clients=server routes. Malformed routes are kept
+// with no server so that they are reported when the proxy is created.
+func parseRoutes(arg string) map[string]string {
+	routes := make(map[string]string)
+
+	for _, route := range strings.Split(arg, ",") {
+		if route = strings.TrimSpace(route); route == "" {
+			continue
+		}
+
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) == 2 {
+			routes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		} else {
+			routes[route] = ""
+		}
+	}
+
+	return routes
+}
+
+// Parses comma-separated port numbers
+func parsePorts(arg string) ([]uint16, error) {
+	var ports []uint16
+
+	for _, port := range strings.Split(arg, ",") {
+		if port = strings.TrimSpace(port); port == "" {
+			continue
+		}
+
+		parsed, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		ports = append(ports, uint16(parsed))
+	}
+
+	return ports, nil
+}
+
 // Watches for CTRL + C signals and shuts down the server
 // A second CTRL + C will force it to exit immediately
 func watchForInterrupt(proxyServer *proxy.ProxyServer) {
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jhead/phantom/internal/proxy"
+)
+
+// Watches for SIGUSR1 signals and closes idle connections right away
+func watchForSweep(proxyServer *proxy.ProxyServer) {
+	signalChan := make(chan os.Signal, 1)
+
+	signal.Notify(signalChan, syscall.SIGUSR1)
+
+	go func() {
+		for range signalChan {
+			proxyServer.SweepIdle()
+		}
+	}()
+}
+
+// Watches for SIGHUP signals and reopens the connection log, for use after
+// logrotate has moved it away
+func watchForReopen(proxyServer *proxy.ProxyServer) {
+	signalChan := make(chan os.Signal, 1)
+
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	go func() {
+		for range signalChan {
+			if err := proxyServer.ReopenConnLog(); err != nil {
+				fmt.Printf("Failed to reopen connection log: %s\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"github.com/jhead/phantom/internal/proxy"
+)
+
+// SIGUSR1 doesn't exist on Windows
+func watchForSweep(proxyServer *proxy.ProxyServer) {}
+
+// SIGHUP doesn't exist on Windows
+func watchForReopen(proxyServer *proxy.ProxyServer) {}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// Returns the UDP sockets passed in by systemd socket activation, if any. The
+// first one is used as the proxy listener and the optional second one as the
+// ping listener.
+func systemdListeners() (*net.UDPConn, net.PacketConn, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil, nil
+	}
+
+	var conns []net.PacketConn
+	for fd := listenFDsStart; fd < listenFDsStart+count && fd < listenFDsStart+2; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		conn, err := net.FilePacketConn(file)
+		file.Close()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid socket passed by systemd: %s", err)
+		}
+
+		conns = append(conns, conn)
+	}
+
+	server, ok := conns[0].(*net.UDPConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("Socket passed by systemd is not a UDP socket")
+	}
+
+	var pingServer net.PacketConn
+	if len(conns) > 1 {
+		pingServer = conns[1]
+	}
+
+	return server, pingServer, nil
+}
@@ -1,6 +1,8 @@
 package clientmap
 
 import (
+	"container/list"
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -15,23 +17,98 @@ import (
 type ClientMap struct {
 	IdleTimeout       time.Duration
 	IdleCheckInterval time.Duration
-	clients           map[string]*clientEntry
-	dead              *abool.AtomicBool
-	mutex             *sync.RWMutex
+	// When set, backend connections use unconnected UDP sockets that follow
+	// the backend if it starts replying from a different port mid-session.
+	UnconnectedBackend bool
+	// With UnconnectedBackend, drop unconnected pongs that don't come from
+	// the exact address the connection was opened to, rather than following
+	// them to a new port
+	VerifyPongSource bool
+	// Called with the source of each packet an unconnected backend socket
+	// drops because it didn't come from the backend. Nil ignores them.
+	OnUnexpectedReply func(from net.Addr)
+	// Maximum number of clients, or 0 for no limit
+	MaxClients int
+	// When the map is full, evict the least recently active client to make
+	// room for a new one instead of refusing the new one
+	EvictLRU bool
+	// Opens backend connections in place of the OS network stack, such as
+	// through a userspace tunnel. Nil uses DialUDP.
+	Dial DialFunc
+	// Number of times to retry a failed dial, such as when ephemeral ports
+	// run out for a moment, waiting a little longer before each. Packets from
+	// the client wait meanwhile, so it should stay small.
+	DialRetries int
+	// Called with the error of each failed dial that is retried. Nil ignores
+	// them.
+	OnDialRetry func(remote *net.UDPAddr, err error)
+	// Decides whether the sweep evicts each connection, in place of the
+	// IdleTimeout check, such as to keep some clients longer or evict heavy
+	// users sooner. It is called with the map locked, so it must be cheap and
+	// must not call back into the ClientMap. Nil evicts idle connections.
+	ShouldEvict func(info ConnInfo) bool
+	// Key clients by IP address alone, so that packets from any port of the
+	// same IP share one connection
+	KeyByIP bool
+	clients map[string]*ServerConn
+	// Clients whose connection is being opened, closed once it is
+	pending map[string]chan struct{}
+	// Clients ordered from most to least recently active
+	lru   *list.List
+	dead  *abool.AtomicBool
+	mutex *sync.RWMutex
 }
 
-type clientEntry struct {
-	conn       *net.UDPConn
-	lastActive time.Time
+type ServerConnHandler func(*ServerConn)
+
+// DialFunc opens a UDP connection to the remote address
+type DialFunc func(remote *net.UDPAddr) (net.Conn, error)
+
+// DialUDP opens a UDP connection to the remote address through the OS
+func DialUDP(remote *net.UDPAddr) (net.Conn, error) {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
 }
 
-type ServerConnHandler func(*net.UDPConn)
+// RemoteSelector picks the server address for a new client, or returns nil to
+// refuse the client
+type RemoteSelector func(clientAddr net.Addr) *net.UDPAddr
+
+// ErrNoRemote is returned by Get when the RemoteSelector refused the client
+var ErrNoRemote = errors.New("No server selected for client")
+
+// ErrFull is returned by Get when the map already holds MaxClients clients
+var ErrFull = errors.New("Too many clients")
+
+// ErrClosed is returned by Get when the map was closed while the connection
+// was being opened
+var ErrClosed = errors.New("Client map closed")
+
+// How long to wait before the first retry of a failed dial, doubling for each
+// one after
+const dialRetryBackoff = 5 * time.Millisecond
 
 func New(idleTimeout time.Duration, idleCheckInterval time.Duration) *ClientMap {
 	clientMap := ClientMap{
 		idleTimeout,
 		idleCheckInterval,
-		make(map[string]*clientEntry),
+		false,
+		false,
+		nil,
+		0,
+		false,
+		nil,
+		0,
+		nil,
+		nil,
+		false,
+		make(map[string]*ServerConn),
+		make(map[string]chan struct{}),
+		list.New(),
 		abool.New(),
 		&sync.RWMutex{},
 	}
@@ -53,7 +130,7 @@ func (cm *ClientMap) Close() {
 
 	cm.mutex.RLock()
 	for _, client := range cm.clients {
-		client.conn.Close()
+		client.Close()
 	}
 	cm.mutex.RUnlock()
 }
@@ -70,78 +147,275 @@ func (cm *ClientMap) idleCleanupLoop() {
 			break
 		}
 
-		cm.mutex.Lock()
-		for key, client := range cm.clients {
-			if client.lastActive.Add(cm.IdleTimeout).Before(currentTime) {
-				log.Info().Msgf("Cleaning up idle connection: %s", key)
-				cm.clients[key].conn.Close()
-				delete(cm.clients, key)
+		cm.SweepIdle(currentTime)
+	}
+}
+
+// SweepIdle closes and removes every client that has been idle for longer
+// than IdleTimeout as of the given time, or that ShouldEvict picks if it is
+// set, and returns how many there were.
+func (cm *ClientMap) SweepIdle(now time.Time) int {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	swept := 0
+	for key, client := range cm.clients {
+		if cm.ShouldEvict != nil {
+			if !cm.ShouldEvict(client.Info()) {
+				continue
 			}
+
+			client.logger.Info().Msgf("Evicting connection by policy: %s", key)
+		} else if client.lastActive.Add(cm.IdleTimeout).Before(now) {
+			client.logger.Info().Msgf("Cleaning up idle connection: %s", key)
+		} else {
+			continue
+		}
+
+		cm.remove(key, client)
+		swept++
+	}
+
+	return swept
+}
+
+// Len returns the number of clients currently in the map
+func (cm *ClientMap) Len() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return len(cm.clients)
+}
+
+// Has returns whether the map holds a connection for the client
+func (cm *ClientMap) Has(clientAddr net.Addr) bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	_, ok := cm.clients[cm.key(clientAddr)]
+	return ok
+}
+
+// Snapshot returns the statistics of every connection in the map, taken
+// together under the map lock
+func (cm *ClientMap) Snapshot() []ConnStats {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	now := time.Now()
+	snapshot := make([]ConnStats, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		snapshot = append(snapshot, client.stats(now))
+	}
+
+	return snapshot
+}
+
+// Range calls the function for each connection in the map until it returns
+// false. The map is locked meanwhile, so the function must not modify it.
+func (cm *ClientMap) Range(fn func(*ServerConn) bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	for _, client := range cm.clients {
+		if !fn(client) {
+			return
 		}
-		cm.mutex.Unlock()
 	}
 }
 
 func (cm *ClientMap) Delete(clientAddr net.Addr) {
-	key := clientAddr.String()
+	key := cm.key(clientAddr)
 
 	cm.mutex.Lock()
 
 	if client, exists := cm.clients[key]; exists {
-		client.conn.Close()
-		delete(cm.clients, key)
+		cm.remove(key, client)
+	}
+
+	cm.mutex.Unlock()
+}
+
+// DeleteIf removes the client only if the map still holds the given
+// connection for it, so that a reader of a connection that has since been
+// replaced can't remove the newer one
+func (cm *ClientMap) DeleteIf(clientAddr net.Addr, conn *ServerConn) {
+	key := cm.key(clientAddr)
+
+	cm.mutex.Lock()
+
+	if client, exists := cm.clients[key]; exists && client == conn {
+		cm.remove(key, client)
 	}
 
 	cm.mutex.Unlock()
 }
 
+// Returns the key of the client in the map: its address, or only its IP
+// with KeyByIP
+func (cm *ClientMap) key(clientAddr net.Addr) string {
+	if !cm.KeyByIP {
+		return clientAddr.String()
+	}
+
+	if udpAddr, ok := clientAddr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+
+	if host, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		return host
+	}
+
+	return clientAddr.String()
+}
+
+// Closes and forgets a client. Must be called with the mutex held.
+func (cm *ClientMap) remove(key string, client *ServerConn) {
+	client.Close()
+	delete(cm.clients, key)
+	cm.lru.Remove(client.lruElement)
+}
+
 // Get gets or creates a new UDP connection to the remote server and stores it
 // in a map, matching clients to remote server connections. This way, we keep one
-// UDP connection open to the server for each client. The handler parameter is
+// UDP connection open to the server for each client. The selectRemote parameter
+// is invoked to pick the server for a new client. The handler parameter is
 // invoked when a new connection needs to be created (for a new client) to defer
-// that behavior to the caller.
+// that behavior to the caller. Both are called while the map is locked, so the
+// handler should launch any long-running work in a new goroutine. The
+// connection itself is opened without the lock held, while further packets
+// from the same client wait for it.
 func (cm *ClientMap) Get(
 	clientAddr net.Addr,
-	remote *net.UDPAddr,
+	selectRemote RemoteSelector,
 	handler ServerConnHandler,
-) (*net.UDPConn, error) {
-	key := clientAddr.String()
+) (*ServerConn, error) {
+	key := cm.key(clientAddr)
 
 	// Check if connection exists
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
 
-	if client, ok := cm.clients[key]; ok {
-		client.lastActive = time.Now()
-		return client.conn, nil
+	for {
+		if client, ok := cm.clients[key]; ok {
+			client.lastActive = time.Now()
+			cm.lru.MoveToFront(client.lruElement)
+			cm.mutex.Unlock()
+			return client, nil
+		}
+
+		dialing, ok := cm.pending[key]
+		if !ok {
+			break
+		}
+
+		// Another packet from the client is opening its connection
+		cm.mutex.Unlock()
+		<-dialing
+		cm.mutex.Lock()
+	}
+
+	// Connections being opened count towards MaxClients. With EvictLRU, room
+	// is only made once the new connection is open.
+	if cm.full() && (!cm.EvictLRU || cm.lru.Len() == 0) {
+		cm.mutex.Unlock()
+		return nil, ErrFull
 	}
 
 	// New connection needed
+	remote := selectRemote(clientAddr)
+	if remote == nil {
+		cm.mutex.Unlock()
+		return nil, ErrNoRemote
+	}
+
+	// Without an ID the connection couldn't be told apart in logs and events,
+	// so none is opened
+	id, err := newConnID()
+	if err != nil {
+		cm.mutex.Unlock()
+		return nil, err
+	}
+
+	dialing := make(chan struct{})
+	cm.pending[key] = dialing
+	cm.mutex.Unlock()
+
 	log.Info().Msgf("Opening connection to %s for new client %s!", remote, clientAddr)
-	newServerConn, err := newServerConnection(remote)
+	conn, err := cm.newServerConnection(remote)
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	delete(cm.pending, key)
+	close(dialing)
+
 	if err != nil {
 		return nil, err
 	}
 
-	cm.clients[key] = &clientEntry{
-		newServerConn,
-		time.Now(),
+	if cm.dead.IsSet() {
+		conn.Close()
+		return nil, ErrClosed
+	}
+
+	if cm.full() && cm.lru.Len() > 0 {
+		oldest := cm.lru.Back().Value.(*ServerConn)
+		oldest.logger.Info().Msgf("Evicting least recently active client %s to make room for %s", oldest.client, clientAddr)
+		cm.remove(cm.key(oldest.client), oldest)
 	}
 
-	// Launch goroutine to pass packets from server to client
-	go handler(newServerConn)
+	serverConn := newServerConn(conn, clientAddr, id)
+	serverConn.lruElement = cm.lru.PushFront(serverConn)
+	cm.clients[key] = serverConn
+
+	// Let the caller launch a goroutine to pass packets from server to client
+	handler(serverConn)
 
-	return newServerConn, nil
+	return serverConn, nil
 }
 
-// Creates a UDP connection to the remote address
-func newServerConnection(remote *net.UDPAddr) (*net.UDPConn, error) {
+// Returns whether the clients and the connections being opened have reached
+// MaxClients. Must be called with the mutex held.
+func (cm *ClientMap) full() bool {
+	return cm.MaxClients > 0 && len(cm.clients)+len(cm.pending) >= cm.MaxClients
+}
+
+// Creates a UDP connection to the remote address, retrying up to DialRetries
+// times
+func (cm *ClientMap) newServerConnection(remote *net.UDPAddr) (net.Conn, error) {
 	log.Info().Msgf("Opening connection to %s", remote)
 
-	conn, err := net.DialUDP("udp", nil, remote)
-	if err != nil {
-		return nil, err
+	backoff := dialRetryBackoff
+	for retry := 0; ; retry++ {
+		conn, err := cm.dial(remote)
+		if err == nil || retry >= cm.DialRetries {
+			return conn, err
+		}
+
+		log.Debug().Msgf("Failed to open connection to %s, retrying in %v: %v", remote, backoff, err)
+		if cm.OnDialRetry != nil {
+			cm.OnDialRetry(remote, err)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	return conn, nil
+// Creates a UDP connection to the remote address
+func (cm *ClientMap) dial(remote *net.UDPAddr) (net.Conn, error) {
+	if cm.Dial != nil {
+		return cm.Dial(remote)
+	}
+
+	if cm.UnconnectedBackend {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return newUnconnectedConn(conn, remote, cm.VerifyPongSource, cm.OnUnexpectedReply), nil
+	}
+
+	return DialUDP(remote)
 }
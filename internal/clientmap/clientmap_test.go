@@ -0,0 +1,589 @@
+package clientmap
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenLocal(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestUnconnectedBackendFollowsPortChange(t *testing.T) {
+	handshakeSocket := listenLocal(t)
+	defer handshakeSocket.Close()
+
+	sessionSocket := listenLocal(t)
+	defer sessionSocket.Close()
+
+	cm := New(time.Minute, time.Minute)
+	cm.UnconnectedBackend = true
+	defer cm.Close()
+
+	received := make(chan []byte, 1)
+	handler := func(conn *ServerConn) {
+		go func() {
+			buffer := make([]byte, 64)
+			read, err := conn.Read(buffer)
+			if err == nil {
+				received <- buffer[:read]
+			}
+		}()
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	remote := handshakeSocket.LocalAddr().(*net.UDPAddr)
+
+	conn, err := cm.Get(client, func(net.Addr) *net.UDPAddr { return remote }, handler)
+	assert.Nil(t, err)
+
+	// Handshake goes to the original port
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	buffer := make([]byte, 64)
+	_ = handshakeSocket.SetReadDeadline(time.Now().Add(time.Second))
+	read, proxyAddr, err := handshakeSocket.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buffer[:read]))
+
+	// Backend replies from a different port
+	_, err = sessionSocket.WriteTo([]byte("moved"), proxyAddr)
+	assert.Nil(t, err)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, "moved", string(data))
+	case <-time.After(time.Second):
+		t.Fatal("reply from new port was not delivered")
+	}
+
+	// Subsequent packets follow the backend to its new port
+	_, err = conn.Write([]byte("again"))
+	assert.Nil(t, err)
+
+	_ = sessionSocket.SetReadDeadline(time.Now().Add(time.Second))
+	read, _, err = sessionSocket.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(buffer[:read]))
+	assert.Equal(t, sessionSocket.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+func TestUnconnectedBackendVerifiesPongSource(t *testing.T) {
+	serverSocket := listenLocal(t)
+	defer serverSocket.Close()
+
+	spoofSocket := listenLocal(t)
+	defer spoofSocket.Close()
+
+	unexpected := make(chan net.Addr, 1)
+
+	cm := New(time.Minute, time.Minute)
+	cm.UnconnectedBackend = true
+	cm.VerifyPongSource = true
+	cm.OnUnexpectedReply = func(from net.Addr) { unexpected <- from }
+	defer cm.Close()
+
+	received := make(chan []byte, 1)
+	handler := func(conn *ServerConn) {
+		go func() {
+			buffer := make([]byte, 64)
+			read, err := conn.Read(buffer)
+			if err == nil {
+				received <- buffer[:read]
+			}
+		}()
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	remote := serverSocket.LocalAddr().(*net.UDPAddr)
+
+	conn, err := cm.Get(client, func(net.Addr) *net.UDPAddr { return remote }, handler)
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	buffer := make([]byte, 64)
+	_ = serverSocket.SetReadDeadline(time.Now().Add(time.Second))
+	_, proxyAddr, err := serverSocket.ReadFrom(buffer)
+	assert.Nil(t, err)
+
+	// A pong from another port of the server's IP is dropped
+	_, err = spoofSocket.WriteTo([]byte{proto.UnconnectedPongID, 1}, proxyAddr)
+	assert.Nil(t, err)
+
+	select {
+	case from := <-unexpected:
+		assert.Equal(t, spoofSocket.LocalAddr().String(), from.String())
+	case <-time.After(time.Second):
+		t.Fatal("spoofed pong was not reported")
+	}
+
+	// One from the server itself is delivered
+	_, err = serverSocket.WriteTo([]byte{proto.UnconnectedPongID, 2}, proxyAddr)
+	assert.Nil(t, err)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, []byte{proto.UnconnectedPongID, 2}, data)
+	case <-time.After(time.Second):
+		t.Fatal("pong from the server was not delivered")
+	}
+
+	assert.Equal(t, remote.String(), conn.RemoteAddr().String())
+}
+
+func TestSweepIdle(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	cm := New(time.Minute, time.Hour)
+	defer cm.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	_, err := cm.Get(client, func(net.Addr) *net.UDPAddr { return remote }, func(*ServerConn) {})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, cm.SweepIdle(time.Now()))
+	assert.Equal(t, 1, cm.Len())
+
+	assert.Equal(t, 1, cm.SweepIdle(time.Now().Add(2*time.Minute)))
+	assert.Equal(t, 0, cm.Len())
+}
+
+func TestShouldEvict(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	cm := New(time.Minute, time.Hour)
+	defer cm.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	vip := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	heavy := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+
+	for _, client := range []*net.UDPAddr{vip, heavy} {
+		_, err := cm.Get(client, func(net.Addr) *net.UDPAddr { return remote }, func(*ServerConn) {})
+		assert.Nil(t, err)
+	}
+
+	conn, err := cm.Get(heavy, nil, nil)
+	assert.Nil(t, err)
+	conn.CountFromClient(make([]byte, 1000))
+
+	// Keep the VIP however idle, and evict heavy users right away
+	cm.ShouldEvict = func(info ConnInfo) bool {
+		return info.Client.String() != vip.String() && info.BytesFromClient > 500
+	}
+
+	assert.Equal(t, 1, cm.SweepIdle(time.Now()))
+	assert.True(t, cm.Has(vip))
+	assert.False(t, cm.Has(heavy))
+
+	assert.Equal(t, 0, cm.SweepIdle(time.Now().Add(time.Hour)))
+	assert.True(t, cm.Has(vip))
+}
+
+func TestKeyByIP(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+
+	for _, keyByIP := range []bool{false, true} {
+		cm := New(time.Minute, time.Hour)
+		cm.KeyByIP = keyByIP
+
+		conn, err := cm.Get(first, selectRemote, func(*ServerConn) {})
+		assert.Nil(t, err)
+
+		sameConn, err := cm.Get(second, selectRemote, func(*ServerConn) {})
+		assert.Nil(t, err)
+
+		if keyByIP {
+			assert.True(t, conn == sameConn)
+			assert.Equal(t, 1, cm.Len())
+
+			// Either port removes the shared connection
+			cm.Delete(second)
+			assert.Equal(t, 0, cm.Len())
+		} else {
+			assert.False(t, conn == sameConn)
+			assert.Equal(t, 2, cm.Len())
+		}
+
+		cm.Close()
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	cm := New(time.Minute, time.Hour)
+	defer cm.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	old, err := cm.Get(client, selectRemote, func(*ServerConn) {})
+	assert.Nil(t, err)
+
+	// The client reconnects before the reader of its old connection exits
+	cm.Delete(client)
+	current, err := cm.Get(client, selectRemote, func(*ServerConn) {})
+	assert.Nil(t, err)
+	assert.False(t, old == current)
+
+	cm.DeleteIf(client, old)
+	assert.True(t, cm.Has(client))
+
+	cm.DeleteIf(client, current)
+	assert.False(t, cm.Has(client))
+}
+
+func TestMaxClients(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	noop := func(*ServerConn) {}
+
+	clients := []*net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		{IP: net.IPv4(127, 0, 0, 1), Port: 3},
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		cm := New(time.Minute, time.Hour)
+		cm.MaxClients = 2
+		defer cm.Close()
+
+		for _, client := range clients[:2] {
+			_, err := cm.Get(client, selectRemote, noop)
+			assert.Nil(t, err)
+		}
+
+		_, err := cm.Get(clients[2], selectRemote, noop)
+		assert.Equal(t, ErrFull, err)
+
+		// Existing clients are still served
+		_, err = cm.Get(clients[0], selectRemote, noop)
+		assert.Nil(t, err)
+	})
+
+	t.Run("evict_lru", func(t *testing.T) {
+		cm := New(time.Minute, time.Hour)
+		cm.MaxClients = 2
+		cm.EvictLRU = true
+		defer cm.Close()
+
+		for _, client := range clients[:2] {
+			_, err := cm.Get(client, selectRemote, noop)
+			assert.Nil(t, err)
+		}
+
+		// Client 1 becomes the most recently active, leaving client 2 the oldest
+		_, err := cm.Get(clients[0], selectRemote, noop)
+		assert.Nil(t, err)
+
+		_, err = cm.Get(clients[2], selectRemote, noop)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, cm.Len())
+
+		remaining := map[string]bool{}
+		for _, stats := range cm.Snapshot() {
+			remaining[stats.Client] = true
+		}
+
+		assert.True(t, remaining[clients[0].String()])
+		assert.False(t, remaining[clients[1].String()])
+		assert.True(t, remaining[clients[2].String()])
+	})
+}
+
+func TestEvictLRUAfterDial(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	noop := func(*ServerConn) {}
+
+	failing := true
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		if failing {
+			return nil, errors.New("no free ports")
+		}
+
+		return DialUDP(remote)
+	}
+
+	cm := New(time.Minute, time.Hour)
+	cm.MaxClients = 1
+	cm.EvictLRU = true
+	defer cm.Close()
+
+	failing = false
+	_, err := cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, selectRemote, noop)
+	assert.Nil(t, err)
+	cm.Dial = dial
+
+	// A client whose connection can't be opened doesn't evict anyone
+	failing = true
+	_, err = cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, selectRemote, noop)
+	assert.EqualError(t, err, "no free ports")
+	assert.True(t, cm.Has(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}))
+
+	// Nor does one refused by the selector
+	_, err = cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}, func(net.Addr) *net.UDPAddr { return nil }, noop)
+	assert.Equal(t, ErrNoRemote, err)
+	assert.Equal(t, 1, cm.Len())
+
+	failing = false
+	_, err = cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, selectRemote, noop)
+	assert.Nil(t, err)
+	assert.False(t, cm.Has(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}))
+	assert.Equal(t, 1, cm.Len())
+}
+
+func TestDialRetries(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	noop := func(*ServerConn) {}
+
+	// Fails a number of times before dialing for real
+	failures := 0
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		if failures > 0 {
+			failures--
+			return nil, errors.New("no free ports")
+		}
+
+		return DialUDP(remote)
+	}
+
+	cm := New(time.Minute, time.Hour)
+	cm.Dial = dial
+	cm.DialRetries = 2
+	defer cm.Close()
+
+	retries := 0
+	cm.OnDialRetry = func(*net.UDPAddr, error) { retries++ }
+
+	failures = 2
+	_, err := cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, selectRemote, noop)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, retries)
+
+	// Gives up after the last retry
+	failures = 3
+	_, err = cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, selectRemote, noop)
+	assert.EqualError(t, err, "no free ports")
+	assert.Equal(t, 4, retries)
+	assert.Equal(t, 1, cm.Len())
+}
+
+func TestDialWithoutLock(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	selectRemote := func(net.Addr) *net.UDPAddr { return remote }
+	noop := func(*ServerConn) {}
+
+	// Dials for the slow client block until released
+	slow := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	release := make(chan struct{})
+	dialing := make(chan struct{})
+	var dials int32
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			dialing <- struct{}{}
+			<-release
+		}
+
+		return DialUDP(remote)
+	}
+
+	cm := New(time.Minute, time.Hour)
+	cm.Dial = dial
+	defer cm.Close()
+
+	conns := make(chan *ServerConn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := cm.Get(slow, selectRemote, noop)
+			assert.Nil(t, err)
+			conns <- conn
+		}()
+	}
+
+	// Another client gets its connection while the slow one is dialing
+	<-dialing
+	_, err := cm.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, selectRemote, noop)
+	assert.Nil(t, err)
+
+	// Both packets from the slow client share the one connection
+	close(release)
+	assert.True(t, <-conns == <-conns)
+	assert.Equal(t, 2, cm.Len())
+}
+
+func datagram(sequence uint32) []byte {
+	return []byte{0x84, byte(sequence), byte(sequence >> 8), byte(sequence >> 16)}
+}
+
+func TestWaitReady(t *testing.T) {
+	conn := newServerConn(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, "0000abcd")
+
+	released := make(chan struct{})
+	go func() {
+		conn.WaitReady()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		t.Fatal("WaitReady returned before MarkReady")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.MarkReady()
+	conn.MarkReady()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("WaitReady did not return after MarkReady")
+	}
+
+	// Later callers don't wait
+	conn.WaitReady()
+}
+
+func TestClientName(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	conn, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn := newServerConn(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, "0000abcd")
+	defer serverConn.Close()
+
+	assert.Equal(t, "", serverConn.stats(time.Now()).ClientName)
+
+	serverConn.SetClientName("player.example.com")
+	assert.Equal(t, "player.example.com", serverConn.stats(time.Now()).ClientName)
+}
+
+func TestConnID(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	ids := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		conn, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := newConnID()
+		assert.Nil(t, err)
+
+		serverConn := newServerConn(conn, client, id)
+		serverConn.Close()
+
+		assert.Len(t, serverConn.ID(), 8)
+		assert.Equal(t, serverConn.ID(), serverConn.stats(time.Now()).ID)
+		assert.Equal(t, serverConn.ID(), serverConn.Info().ID)
+		ids[serverConn.ID()] = true
+	}
+
+	assert.Len(t, ids, 10)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestConnIDFailureOpensNoConnection(t *testing.T) {
+	server := listenLocal(t)
+	defer server.Close()
+
+	remote := server.LocalAddr().(*net.UDPAddr)
+	dialed := false
+	cm := New(time.Minute, time.Hour)
+	cm.Dial = func(remote *net.UDPAddr) (net.Conn, error) {
+		dialed = true
+		return DialUDP(remote)
+	}
+	defer cm.Close()
+
+	defaultReader := randReader
+	randReader = failingReader{}
+	defer func() { randReader = defaultReader }()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	_, err := cm.Get(client, func(net.Addr) *net.UDPAddr { return remote }, func(*ServerConn) {})
+	assert.NotNil(t, err)
+	assert.False(t, dialed)
+	assert.False(t, cm.Has(client))
+	assert.Equal(t, 0, cm.Len())
+}
+
+func TestSequenceTracker(t *testing.T) {
+	tracker := newSequenceTracker()
+
+	for _, sequence := range []uint32{10, 11, 14, 12, 15} {
+		tracker.observe(datagram(sequence))
+	}
+
+	// ACKs don't count
+	tracker.observe([]byte{0xc0, 0, 0, 0})
+
+	gaps, reordered := tracker.counts()
+	assert.Equal(t, uint64(2), gaps)
+	assert.Equal(t, uint64(1), reordered)
+}
+
+func TestSequenceTrackerWraps(t *testing.T) {
+	tracker := newSequenceTracker()
+
+	for _, sequence := range []uint32{sequenceMask - 1, sequenceMask, 0, 2} {
+		tracker.observe(datagram(sequence))
+	}
+
+	gaps, reordered := tracker.counts()
+	assert.Equal(t, uint64(1), gaps)
+	assert.Equal(t, uint64(0), reordered)
+}
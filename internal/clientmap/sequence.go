@@ -0,0 +1,65 @@
+package clientmap
+
+import (
+	"sync"
+
+	"github.com/jhead/phantom/internal/proto"
+)
+
+// Sequence numbers are 24 bits and wrap around
+const sequenceMask = 1<<24 - 1
+
+// sequenceTracker estimates packet loss and reordering in one direction of a
+// connection from the sequence numbers of RakNet datagrams. It is best-effort:
+// resent datagrams get new sequence numbers, so gaps are only an estimate.
+type sequenceTracker struct {
+	next      uint32
+	started   bool
+	gaps      uint64
+	reordered uint64
+	mutex     *sync.Mutex
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{
+		0,
+		false,
+		0,
+		0,
+		&sync.Mutex{},
+	}
+}
+
+// Records the sequence number of a packet, if it has one
+func (tracker *sequenceTracker) observe(data []byte) {
+	sequence, ok := proto.ReadDatagramSequence(data)
+	if !ok {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if !tracker.started {
+		tracker.started = true
+		tracker.next = (sequence + 1) & sequenceMask
+		return
+	}
+
+	ahead := (sequence - tracker.next) & sequenceMask
+	if ahead < sequenceMask/2 {
+		// Skipped sequence numbers were lost or are yet to arrive
+		tracker.gaps += uint64(ahead)
+		tracker.next = (sequence + 1) & sequenceMask
+	} else {
+		// Arrived after a later datagram
+		tracker.reordered++
+	}
+}
+
+func (tracker *sequenceTracker) counts() (gaps uint64, reordered uint64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.gaps, tracker.reordered
+}
@@ -0,0 +1,239 @@
+package clientmap
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// ServerConn is a client's connection to the remote server, along with
+// statistics about the traffic passing through it.
+type ServerConn struct {
+	// Accessed atomically; kept first for 64-bit alignment on 32-bit platforms
+	bytesFromClient uint64
+	bytesFromServer uint64
+	// Unix nanoseconds of the last packet in each direction and of the last
+	// keep-alive ping, accessed atomically
+	lastClientPacket int64
+	lastServerPacket int64
+	lastKeepAlive    int64
+
+	net.Conn
+	client      net.Addr
+	connectedAt time.Time
+	lastActive  time.Time     // guarded by the ClientMap mutex
+	lruElement  *list.Element // guarded by the ClientMap mutex
+	// Best-effort loss and reordering estimates for each direction
+	clientSequence *sequenceTracker
+	serverSequence *sequenceTracker
+	// Closed once the packet that opened the connection has been forwarded
+	ready     chan struct{}
+	readyOnce *sync.Once
+	// Reverse DNS name of the client, set once it is known
+	clientName *atomic.Value
+	// Random ID identifying the connection in logs and events
+	id     string
+	logger zerolog.Logger
+}
+
+// ConnStats is a snapshot of the statistics of a ServerConn
+type ConnStats struct {
+	ID     string `json:"id"`
+	Client string `json:"client"`
+	// Reverse DNS name of the client, if known
+	ClientName      string    `json:"client_name,omitempty"`
+	Server          string    `json:"server"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	UptimeSeconds   float64   `json:"uptime_seconds"`
+	BytesFromClient uint64    `json:"bytes_from_client"`
+	BytesFromServer uint64    `json:"bytes_from_server"`
+	// Zero if no packet has been sent in that direction yet
+	LastClientPacket time.Time `json:"last_client_packet"`
+	LastServerPacket time.Time `json:"last_server_packet"`
+	// Best-effort estimates from RakNet sequence numbers: datagrams skipped
+	// (lost, or not yet arrived) and datagrams arriving out of order
+	GapsFromClient      uint64 `json:"gaps_from_client"`
+	ReorderedFromClient uint64 `json:"reordered_from_client"`
+	GapsFromServer      uint64 `json:"gaps_from_server"`
+	ReorderedFromServer uint64 `json:"reordered_from_server"`
+}
+
+// ConnInfo describes a ServerConn without formatting anything, for callers
+// that go through many connections
+type ConnInfo struct {
+	ID              string
+	Client          net.Addr
+	Server          net.Addr
+	ConnectedAt     time.Time
+	BytesFromClient uint64
+	BytesFromServer uint64
+	// When the last packet in either direction was seen
+	LastActivity time.Time
+}
+
+func newServerConn(conn net.Conn, client net.Addr, id string) *ServerConn {
+	now := time.Now()
+
+	return &ServerConn{
+		0,
+		0,
+		0,
+		0,
+		0,
+		conn,
+		client,
+		now,
+		now,
+		nil,
+		newSequenceTracker(),
+		newSequenceTracker(),
+		make(chan struct{}),
+		&sync.Once{},
+		&atomic.Value{},
+		id,
+		log.With().Str("conn_id", id).Str("client", client.String()).Logger(),
+	}
+}
+
+// Source of connection IDs, replaced in tests with a failing reader
+var randReader io.Reader = rand.Reader
+
+// Generates a random connection ID, unlikely to repeat across restarts or
+// instances of phantom
+func newConnID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(randReader, id); err != nil {
+		return "", fmt.Errorf("Failed to generate connection ID: %v", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// ID returns the random ID of the connection
+func (conn *ServerConn) ID() string {
+	return conn.id
+}
+
+// Logger returns a logger that tags every line with the connection ID and
+// client address
+func (conn *ServerConn) Logger() *zerolog.Logger {
+	return &conn.logger
+}
+
+// SetClientName records the reverse DNS name of the client
+func (conn *ServerConn) SetClientName(name string) {
+	conn.clientName.Store(name)
+}
+
+// MarkReady records that the packet that opened the connection has been
+// forwarded, releasing packets held back by WaitReady
+func (conn *ServerConn) MarkReady() {
+	conn.readyOnce.Do(func() { close(conn.ready) })
+}
+
+// WaitReady blocks until MarkReady has been called, so that packets that
+// arrive right behind the one that opened the connection are forwarded after it
+func (conn *ServerConn) WaitReady() {
+	<-conn.ready
+}
+
+// CountFromClient records a packet sent by the client to the server
+func (conn *ServerConn) CountFromClient(data []byte) {
+	atomic.AddUint64(&conn.bytesFromClient, uint64(len(data)))
+	atomic.StoreInt64(&conn.lastClientPacket, time.Now().UnixNano())
+	conn.clientSequence.observe(data)
+}
+
+// CountFromServer records a packet sent by the server to the client
+func (conn *ServerConn) CountFromServer(data []byte) {
+	atomic.AddUint64(&conn.bytesFromServer, uint64(len(data)))
+	atomic.StoreInt64(&conn.lastServerPacket, time.Now().UnixNano())
+	conn.serverSequence.observe(data)
+}
+
+// LastPacket returns when the last packet in either direction was counted, or
+// when the connection was opened if none has been
+func (conn *ServerConn) LastPacket() time.Time {
+	last := atomic.LoadInt64(&conn.lastClientPacket)
+	if server := atomic.LoadInt64(&conn.lastServerPacket); server > last {
+		last = server
+	}
+
+	if last == 0 {
+		return conn.connectedAt
+	}
+
+	return time.Unix(0, last)
+}
+
+// MarkKeepAlive records that a keep-alive ping was sent to the server. Its
+// answer isn't counted as traffic, so LastPacket doesn't move.
+func (conn *ServerConn) MarkKeepAlive(now time.Time) {
+	atomic.StoreInt64(&conn.lastKeepAlive, now.UnixNano())
+}
+
+// LastKeepAlive returns when the last keep-alive ping was sent, or when the
+// connection was opened if none has been
+func (conn *ServerConn) LastKeepAlive() time.Time {
+	last := atomic.LoadInt64(&conn.lastKeepAlive)
+	if last == 0 {
+		return conn.connectedAt
+	}
+
+	return time.Unix(0, last)
+}
+
+// Info returns a description of the connection
+func (conn *ServerConn) Info() ConnInfo {
+	return ConnInfo{
+		ID:              conn.id,
+		Client:          conn.client,
+		Server:          conn.RemoteAddr(),
+		ConnectedAt:     conn.connectedAt,
+		BytesFromClient: atomic.LoadUint64(&conn.bytesFromClient),
+		BytesFromServer: atomic.LoadUint64(&conn.bytesFromServer),
+		LastActivity:    conn.LastPacket(),
+	}
+}
+
+// Must be called with the ClientMap mutex held
+func (conn *ServerConn) stats(now time.Time) ConnStats {
+	gapsFromClient, reorderedFromClient := conn.clientSequence.counts()
+	gapsFromServer, reorderedFromServer := conn.serverSequence.counts()
+	clientName, _ := conn.clientName.Load().(string)
+
+	return ConnStats{
+		ID:                  conn.id,
+		Client:              conn.client.String(),
+		ClientName:          clientName,
+		Server:              conn.RemoteAddr().String(),
+		ConnectedAt:         conn.connectedAt,
+		UptimeSeconds:       now.Sub(conn.connectedAt).Seconds(),
+		BytesFromClient:     atomic.LoadUint64(&conn.bytesFromClient),
+		BytesFromServer:     atomic.LoadUint64(&conn.bytesFromServer),
+		LastClientPacket:    unixNanoTime(atomic.LoadInt64(&conn.lastClientPacket)),
+		LastServerPacket:    unixNanoTime(atomic.LoadInt64(&conn.lastServerPacket)),
+		GapsFromClient:      gapsFromClient,
+		ReorderedFromClient: reorderedFromClient,
+		GapsFromServer:      gapsFromServer,
+		ReorderedFromServer: reorderedFromServer,
+	}
+}
+
+// Converts Unix nanoseconds to a time, keeping 0 as the zero time
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
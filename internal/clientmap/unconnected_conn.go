@@ -0,0 +1,102 @@
+package clientmap
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// unconnectedConn adapts an unconnected UDP socket to net.Conn. Unlike a
+// connected socket, it still accepts packets when the backend starts replying
+// from a different port after the handshake, and re-associates itself with
+// that port so that subsequent writes follow the backend.
+type unconnectedConn struct {
+	*net.UDPConn
+	remote *net.UDPAddr
+	// The address the connection was opened to
+	origin *net.UDPAddr
+	// Only accept unconnected pongs from origin
+	verifyPongs bool
+	// Called with the source of each packet dropped for not coming from the
+	// backend, if set
+	onUnexpected func(from net.Addr)
+	mutex        *sync.RWMutex
+}
+
+func newUnconnectedConn(conn *net.UDPConn, remote *net.UDPAddr, verifyPongs bool, onUnexpected func(from net.Addr)) *unconnectedConn {
+	return &unconnectedConn{
+		conn,
+		remote,
+		remote,
+		verifyPongs,
+		onUnexpected,
+		&sync.RWMutex{},
+	}
+}
+
+// Read reads the next packet from the backend, ignoring packets from any
+// other host. A packet from the backend's IP on a new port migrates the
+// connection to that port, except that with verifyPongs, unconnected pongs
+// from anywhere but the address the connection was opened to are ignored, so
+// that a spoofed pong can neither reach the client nor move the connection.
+func (c *unconnectedConn) Read(b []byte) (int, error) {
+	for {
+		read, addr, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return read, err
+		}
+
+		c.mutex.Lock()
+		remote := c.remote
+
+		if !addr.IP.Equal(remote.IP) {
+			c.mutex.Unlock()
+			log.Debug().Msgf("Ignoring packet from unexpected host %s (expected %s)", addr, remote)
+			c.unexpected(addr)
+			continue
+		}
+
+		if c.verifyPongs && read > 0 && b[0] == proto.UnconnectedPongID && !sameUDPAddr(addr, c.origin) {
+			c.mutex.Unlock()
+			log.Debug().Msgf("Ignoring pong from unexpected address %s (expected %s)", addr, c.origin)
+			c.unexpected(addr)
+			continue
+		}
+
+		if addr.Port != remote.Port {
+			log.Info().Msgf("Backend %s changed its reply port, migrating connection to %s", remote, addr)
+			c.remote = addr
+		}
+
+		c.mutex.Unlock()
+		return read, nil
+	}
+}
+
+func (c *unconnectedConn) unexpected(from net.Addr) {
+	if c.onUnexpected != nil {
+		c.onUnexpected(from)
+	}
+}
+
+// Write sends a packet to the most recently seen backend address.
+func (c *unconnectedConn) Write(b []byte) (int, error) {
+	return c.UDPConn.WriteToUDP(b, c.remoteAddr())
+}
+
+func (c *unconnectedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr()
+}
+
+func (c *unconnectedConn) remoteAddr() *net.UDPAddr {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.remote
+}
+
+func sameUDPAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
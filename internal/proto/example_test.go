@@ -0,0 +1,34 @@
+package proto_test
+
+import (
+	"fmt"
+
+	"github.com/jhead/phantom/internal/proto"
+)
+
+func ExampleNewUnconnectedReply() {
+	reply := proto.NewUnconnectedReply(proto.Pong{
+		Edition:         "MCPE",
+		MOTD:            "Test server",
+		ProtocolVersion: "390",
+		Version:         "1.14.60",
+		Players:         "3",
+		MaxPlayers:      "10",
+		ServerID:        "12345",
+		GameType:        "Survival",
+		NintendoLimited: "1",
+	})
+
+	packet := reply.Build()
+	parsed, err := proto.ReadUnconnectedReply(packet.Bytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(parsed.Pong.MOTD)
+	fmt.Println(parsed.Pong.Players + "/" + parsed.Pong.MaxPlayers)
+	// Output:
+	// Test server
+	// 3/10
+}
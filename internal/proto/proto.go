@@ -3,7 +3,10 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"reflect"
 	"regexp"
 	"strings"
 
@@ -11,16 +14,43 @@ import (
 )
 
 var UnconnectedPingID byte = 0x01
+var UnconnectedPingOpenConnectionsID byte = 0x02
 var UnconnectedPongID byte = 0x1C
+var OpenConnectionRequest1ID byte = 0x05
+var OpenConnectionRequest2ID byte = 0x07
+var IncompatibleProtocolID byte = 0x19
+var NoFreeIncomingConnectionsID byte = 0x14
 
+// RakNet protocol version spoken by Bedrock
+var RakNetProtocolVersion byte = 10
+
+// Flags in the first byte of RakNet datagrams. Game data is sent in valid
+// datagrams that are neither ACKs nor NAKs.
+var DatagramValidFlag byte = 0x80
+var DatagramACKFlag byte = 0x40
+var DatagramNAKFlag byte = 0x20
+
+// Magic bytes identifying RakNet offline messages
+var Magic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// UnconnectedPing is an Unconnected Ping sent by a client looking for servers
 type UnconnectedPing struct {
+	PingTime   []byte
+	Magic      []byte
+	ClientGUID []byte
+}
+
+// UnconnectedReply is an Unconnected Pong, sent in reply to an Unconnected Ping
+type UnconnectedReply struct {
 	PingTime []byte
 	ID       []byte
 	Magic    []byte
-	Pong     PongData
+	Pong     Pong
 }
 
-type PongData struct {
+// Pong holds the semicolon-separated fields of the server info string sent in
+// an Unconnected Pong, in wire order.
+type Pong struct {
 	Edition         string
 	MOTD            string
 	ProtocolVersion string
@@ -35,11 +65,12 @@ type PongData struct {
 	Port6           string
 }
 
-var OfflinePong = UnconnectedPing{
+// OfflineReply is the pong sent to clients while the server is offline
+var OfflineReply = UnconnectedReply{
 	PingTime: []byte{0, 0, 0, 0, 0, 0, 0, 0},
 	ID:       []byte{0, 0, 0, 0, 0, 0, 0, 0},
-	Magic:    []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78},
-	Pong: PongData{
+	Magic:    Magic,
+	Pong: Pong{
 		Edition:         "MCPE",
 		MOTD:            "phantom §cServer offline",
 		ProtocolVersion: "390",
@@ -49,12 +80,49 @@ var OfflinePong = UnconnectedPing{
 		GameType:        "Creative",
 		NintendoLimited: "1",
 	},
-}.Build()
+}
+
+var OfflinePong = OfflineReply.Build()
 
 var dupeSemicolonRegex = regexp.MustCompile(";{2,}$")
 
-func ReadUnconnectedPing(in []byte) (reply *UnconnectedPing, err error) {
-	reply = &UnconnectedPing{}
+// ReadUnconnectedPing parses an Unconnected Ping packet
+func ReadUnconnectedPing(in []byte) (*UnconnectedPing, error) {
+	ping := &UnconnectedPing{
+		make([]byte, 8),
+		make([]byte, 16),
+		make([]byte, 8),
+	}
+
+	buf := bytes.NewBuffer(in)
+
+	// Packet ID
+	buf.ReadByte()
+
+	for _, field := range [][]byte{ping.PingTime, ping.Magic, ping.ClientGUID} {
+		if _, err := io.ReadFull(buf, field); err != nil {
+			return nil, err
+		}
+	}
+
+	return ping, nil
+}
+
+// Build encodes the ping as an Unconnected Ping packet
+func (p UnconnectedPing) Build() bytes.Buffer {
+	var outBuffer bytes.Buffer
+
+	outBuffer.WriteByte(UnconnectedPingID)
+	outBuffer.Write(p.PingTime)
+	outBuffer.Write(p.Magic)
+	outBuffer.Write(p.ClientGUID)
+
+	return outBuffer
+}
+
+// ReadUnconnectedReply parses an Unconnected Pong packet
+func ReadUnconnectedReply(in []byte) (reply *UnconnectedReply, err error) {
+	reply = &UnconnectedReply{}
 	buf := bytes.NewBuffer(in)
 
 	// Packet ID
@@ -92,7 +160,19 @@ func ReadUnconnectedPing(in []byte) (reply *UnconnectedPing, err error) {
 	return
 }
 
-func (r UnconnectedPing) Build() bytes.Buffer {
+// NewUnconnectedReply returns a reply advertising the given pong, with the
+// ping time and server GUID zeroed and the RakNet magic set.
+func NewUnconnectedReply(pong Pong) *UnconnectedReply {
+	return &UnconnectedReply{
+		PingTime: make([]byte, 8),
+		ID:       make([]byte, 8),
+		Magic:    Magic,
+		Pong:     pong,
+	}
+}
+
+// Build encodes the reply as an Unconnected Pong packet
+func (r UnconnectedReply) Build() bytes.Buffer {
 	var outBuffer bytes.Buffer
 
 	outBuffer.WriteByte(UnconnectedPongID)
@@ -112,9 +192,255 @@ func (r UnconnectedPing) Build() bytes.Buffer {
 	return outBuffer
 }
 
-// Reads pong data from the string off the wire into an empty PongData struct
-func readPong(raw string) PongData {
-	pong := PongData{}
+// ReadDatagramSequence returns the 24-bit sequence number of a RakNet datagram
+// carrying game data, or false if the packet is not one
+func ReadDatagramSequence(in []byte) (uint32, bool) {
+	if len(in) < 4 || in[0]&DatagramValidFlag == 0 || in[0]&(DatagramACKFlag|DatagramNAKFlag) != 0 {
+		return 0, false
+	}
+
+	// Little-endian uint24
+	return uint32(in[1]) | uint32(in[2])<<8 | uint32(in[3])<<16, true
+}
+
+// BuildNoFreeIncomingConnections builds a RakNet No Free Incoming Connections
+// reply, which makes the client show that the server is full.
+func BuildNoFreeIncomingConnections(serverID int64) []byte {
+	var outBuffer bytes.Buffer
+
+	outBuffer.WriteByte(NoFreeIncomingConnectionsID)
+	outBuffer.Write(Magic)
+	binary.Write(&outBuffer, binary.BigEndian, serverID)
+
+	return outBuffer.Bytes()
+}
+
+// PacketType is the kind of RakNet packet, as told by its first byte
+type PacketType int
+
+const (
+	PacketUnknown PacketType = iota
+	PacketUnconnectedPing
+	PacketUnconnectedReply
+	PacketOpenConnectionRequest1
+	PacketOpenConnectionRequest2
+	// A datagram sent once connected, carrying game data, an ACK or a NAK
+	PacketConnected
+)
+
+var packetTypeNames = map[PacketType]string{
+	PacketUnknown:                "unknown",
+	PacketUnconnectedPing:        "unconnected_ping",
+	PacketUnconnectedReply:       "unconnected_reply",
+	PacketOpenConnectionRequest1: "open_connection_request_1",
+	PacketOpenConnectionRequest2: "open_connection_request_2",
+	PacketConnected:              "connected",
+}
+
+func (packetType PacketType) String() string {
+	if name, ok := packetTypeNames[packetType]; ok {
+		return name
+	}
+
+	return packetTypeNames[PacketUnknown]
+}
+
+// ClassifyPacket returns the type of the packet, or PacketUnknown and false if
+// it is empty or its message ID is not one phantom knows
+func ClassifyPacket(in []byte) (PacketType, bool) {
+	if len(in) == 0 {
+		return PacketUnknown, false
+	}
+
+	switch in[0] {
+	case UnconnectedPingID, UnconnectedPingOpenConnectionsID:
+		return PacketUnconnectedPing, true
+	case UnconnectedPongID:
+		return PacketUnconnectedReply, true
+	case OpenConnectionRequest1ID:
+		return PacketOpenConnectionRequest1, true
+	case OpenConnectionRequest2ID:
+		return PacketOpenConnectionRequest2, true
+	}
+
+	if in[0]&DatagramValidFlag != 0 {
+		return PacketConnected, true
+	}
+
+	return PacketUnknown, false
+}
+
+// IsClientPacket returns whether the packet looks like one a RakNet client
+// sends to a server: a ping, a connection request or a datagram
+func IsClientPacket(in []byte) bool {
+	packetType, ok := ClassifyPacket(in)
+	return ok && packetType != PacketUnconnectedReply
+}
+
+// BuildIncompatibleProtocol builds a RakNet Incompatible Protocol Version
+// reply, which makes the client give up connecting and show an error.
+func BuildIncompatibleProtocol(protocol byte, serverID int64) []byte {
+	var outBuffer bytes.Buffer
+
+	outBuffer.WriteByte(IncompatibleProtocolID)
+	outBuffer.WriteByte(protocol)
+	outBuffer.Write(Magic)
+	binary.Write(&outBuffer, binary.BigEndian, serverID)
+
+	return outBuffer.Bytes()
+}
+
+// Index of each field of Pong
+const (
+	pongEdition = iota
+	pongMOTD
+	pongProtocolVersion
+	pongVersion
+	pongPlayers
+	pongMaxPlayers
+	pongServerID
+	pongSubMOTD
+	pongGameType
+	pongNintendoLimited
+	pongPort4
+	pongPort6
+	pongFieldCount
+)
+
+// PongOverrides replaces chosen fields of a Pong. It is built with its
+// setters, such as PongOverrides{}.MOTD("My server").SubMOTD(""). Fields that
+// were set replace the pong's even when empty, and the others pass through
+// unchanged. The zero value replaces nothing. In JSON, it is an object of Pong
+// field names to values.
+type PongOverrides struct {
+	values Pong
+	set    [pongFieldCount]bool
+}
+
+// Edition sets the edition, such as MCPE
+func (overrides PongOverrides) Edition(edition string) PongOverrides {
+	overrides.values.Edition = edition
+	overrides.set[pongEdition] = true
+	return overrides
+}
+
+// MOTD sets the server name shown in the server list
+func (overrides PongOverrides) MOTD(motd string) PongOverrides {
+	overrides.values.MOTD = motd
+	overrides.set[pongMOTD] = true
+	return overrides
+}
+
+// ProtocolVersion sets the protocol version
+func (overrides PongOverrides) ProtocolVersion(version string) PongOverrides {
+	overrides.values.ProtocolVersion = version
+	overrides.set[pongProtocolVersion] = true
+	return overrides
+}
+
+// Version sets the game version, such as 1.14.60
+func (overrides PongOverrides) Version(version string) PongOverrides {
+	overrides.values.Version = version
+	overrides.set[pongVersion] = true
+	return overrides
+}
+
+// Players sets the number of players online
+func (overrides PongOverrides) Players(players string) PongOverrides {
+	overrides.values.Players = players
+	overrides.set[pongPlayers] = true
+	return overrides
+}
+
+// MaxPlayers sets the maximum number of players
+func (overrides PongOverrides) MaxPlayers(maxPlayers string) PongOverrides {
+	overrides.values.MaxPlayers = maxPlayers
+	overrides.set[pongMaxPlayers] = true
+	return overrides
+}
+
+// ServerID sets the server's unique ID
+func (overrides PongOverrides) ServerID(id string) PongOverrides {
+	overrides.values.ServerID = id
+	overrides.set[pongServerID] = true
+	return overrides
+}
+
+// SubMOTD sets the second line of the server name, or the world name
+func (overrides PongOverrides) SubMOTD(motd string) PongOverrides {
+	overrides.values.SubMOTD = motd
+	overrides.set[pongSubMOTD] = true
+	return overrides
+}
+
+// GameType sets the game mode, such as Survival
+func (overrides PongOverrides) GameType(gameType string) PongOverrides {
+	overrides.values.GameType = gameType
+	overrides.set[pongGameType] = true
+	return overrides
+}
+
+// NintendoLimited sets the numeric game mode
+func (overrides PongOverrides) NintendoLimited(limited string) PongOverrides {
+	overrides.values.NintendoLimited = limited
+	overrides.set[pongNintendoLimited] = true
+	return overrides
+}
+
+// Port4 sets the IPv4 port
+func (overrides PongOverrides) Port4(port string) PongOverrides {
+	overrides.values.Port4 = port
+	overrides.set[pongPort4] = true
+	return overrides
+}
+
+// Port6 sets the IPv6 port
+func (overrides PongOverrides) Port6(port string) PongOverrides {
+	overrides.values.Port6 = port
+	overrides.set[pongPort6] = true
+	return overrides
+}
+
+// Reads overrides from an object such as {"MOTD": "My server"}
+func (overrides *PongOverrides) UnmarshalJSON(data []byte) error {
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	target := reflect.ValueOf(&overrides.values).Elem()
+	for name, value := range values {
+		field, ok := target.Type().FieldByName(name)
+		if !ok {
+			return fmt.Errorf("Unknown pong field: %s", name)
+		}
+
+		target.Field(field.Index[0]).SetString(value)
+		overrides.set[field.Index[0]] = true
+	}
+
+	return nil
+}
+
+// Override returns a copy of the pong with the fields set in overrides
+// replaced
+func (pong Pong) Override(overrides PongOverrides) Pong {
+	fields := util.MapStructToFields(&pong)
+
+	for i, value := range util.MapStructToFields(&overrides.values) {
+		if overrides.set[i] {
+			fields[i] = value
+		}
+	}
+
+	util.MapFieldsToStruct(fields, &pong)
+
+	return pong
+}
+
+// Reads pong data from the string off the wire into an empty Pong struct
+func readPong(raw string) Pong {
+	pong := Pong{}
 	pongParts := []interface{}{}
 
 	stringParts := strings.Split(raw, ";")
@@ -127,9 +453,9 @@ func readPong(raw string) PongData {
 	return pong
 }
 
-// Turns a PongData into a string that complies with the Bedrock protocol,
+// Turns a Pong into a string that complies with the Bedrock protocol,
 // separating the fields with ;
-func writePong(pong PongData) string {
+func writePong(pong Pong) string {
 	var pongDataFields []string
 	pongDataFieldsRaw := util.MapStructToFields(&pong)
 	for _, value := range pongDataFieldsRaw {
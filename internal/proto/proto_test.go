@@ -0,0 +1,206 @@
+package proto
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPongOverride(t *testing.T) {
+	pong := Pong{
+		Edition:    "MCPE",
+		MOTD:       "Backend",
+		Players:    "3",
+		MaxPlayers: "10",
+	}
+
+	overridden := pong.Override(PongOverrides{}.MOTD("phantom").MaxPlayers("20").Players(""))
+
+	assert.Equal(t, Pong{
+		Edition:    "MCPE",
+		MOTD:       "phantom",
+		Players:    "",
+		MaxPlayers: "20",
+	}, overridden)
+
+	// The original is left untouched
+	assert.Equal(t, "Backend", pong.MOTD)
+}
+
+func TestPongOverrideEmpty(t *testing.T) {
+	pong := Pong{Edition: "MCPE", MOTD: "Backend"}
+
+	assert.Equal(t, pong, pong.Override(PongOverrides{}))
+}
+
+func TestPongOverridesSetters(t *testing.T) {
+	overrides := PongOverrides{}.
+		Edition("MCEE").
+		MOTD("motd").
+		ProtocolVersion("400").
+		Version("1.16.0").
+		Players("1").
+		MaxPlayers("2").
+		ServerID("3").
+		SubMOTD("").
+		GameType("Creative").
+		NintendoLimited("0").
+		Port4("4").
+		Port6("6")
+
+	assert.Equal(t, Pong{
+		Edition:         "MCEE",
+		MOTD:            "motd",
+		ProtocolVersion: "400",
+		Version:         "1.16.0",
+		Players:         "1",
+		MaxPlayers:      "2",
+		ServerID:        "3",
+		SubMOTD:         "",
+		GameType:        "Creative",
+		NintendoLimited: "0",
+		Port4:           "4",
+		Port6:           "6",
+	}, Pong{SubMOTD: "world"}.Override(overrides))
+
+	// Setting a field returns a copy, leaving the original untouched
+	base := PongOverrides{}.MOTD("a")
+	_ = base.MOTD("b")
+	assert.Equal(t, "a", Pong{}.Override(base).MOTD)
+}
+
+func TestPongOverridesJSON(t *testing.T) {
+	var overrides PongOverrides
+	assert.Nil(t, json.Unmarshal([]byte(`{"MOTD": "phantom", "SubMOTD": ""}`), &overrides))
+
+	pong := Pong{MOTD: "Backend", SubMOTD: "world", Players: "3"}
+	assert.Equal(t, Pong{MOTD: "phantom", SubMOTD: "", Players: "3"}, pong.Override(overrides))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"Motd": "phantom"}`), &overrides))
+}
+
+func TestPongRoundTrip(t *testing.T) {
+	pong := Pong{
+		Edition:         "MCPE",
+		MOTD:            "phantom",
+		ProtocolVersion: "390",
+		Version:         "1.14.60",
+		Players:         "0",
+		MaxPlayers:      "10",
+		ServerID:        "1234",
+		SubMOTD:         "world",
+		GameType:        "Survival",
+		NintendoLimited: "1",
+		Port4:           "19132",
+		Port6:           "19133",
+	}
+
+	assert.Equal(t, pong, readPong(writePong(pong)))
+}
+
+func TestBuildIncompatibleProtocol(t *testing.T) {
+	packet := BuildIncompatibleProtocol(10, 0x0102030405060708)
+
+	assert.Equal(t, IncompatibleProtocolID, packet[0])
+	assert.Equal(t, byte(10), packet[1])
+	assert.Equal(t, Magic, packet[2:18])
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, packet[18:])
+}
+
+func TestReadUnconnectedPing(t *testing.T) {
+	packet := []byte{UnconnectedPingID, 0, 0, 0, 0, 0, 0, 1, 2}
+	packet = append(packet, Magic...)
+	packet = append(packet, 9, 9, 9, 9, 9, 9, 9, 9)
+
+	ping, err := ReadUnconnectedPing(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 1, 2}, ping.PingTime)
+	assert.Equal(t, Magic, ping.Magic)
+	assert.Equal(t, []byte{9, 9, 9, 9, 9, 9, 9, 9}, ping.ClientGUID)
+
+	_, err = ReadUnconnectedPing(packet[:20])
+	assert.NotNil(t, err)
+}
+
+func TestUnconnectedPingRoundTrip(t *testing.T) {
+	ping := UnconnectedPing{
+		PingTime:   []byte{0, 0, 0, 0, 0, 0, 0, 9},
+		Magic:      Magic,
+		ClientGUID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+
+	packet := ping.Build()
+	data := packet.Bytes()
+	assert.Equal(t, UnconnectedPingID, data[0])
+	assert.Len(t, data, 33)
+
+	read, err := ReadUnconnectedPing(data)
+	assert.Nil(t, err)
+	assert.Equal(t, ping, *read)
+}
+
+func TestBuildNoFreeIncomingConnections(t *testing.T) {
+	reply := BuildNoFreeIncomingConnections(258)
+
+	assert.Equal(t, NoFreeIncomingConnectionsID, reply[0])
+	assert.Equal(t, Magic, reply[1:17])
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 1, 2}, reply[17:])
+}
+
+func TestIsClientPacket(t *testing.T) {
+	assert.True(t, IsClientPacket([]byte{UnconnectedPingID}))
+	assert.True(t, IsClientPacket([]byte{OpenConnectionRequest1ID, 0}))
+	assert.True(t, IsClientPacket([]byte{OpenConnectionRequest2ID, 0}))
+	assert.True(t, IsClientPacket([]byte{0x84, 0, 0, 0}))
+	assert.True(t, IsClientPacket([]byte{0xc0, 0, 0}))
+
+	assert.False(t, IsClientPacket(nil))
+	assert.False(t, IsClientPacket([]byte("GET / HTTP/1.1")))
+	assert.False(t, IsClientPacket([]byte{0x00, 0, 0}))
+}
+
+func TestClassifyPacket(t *testing.T) {
+	for _, test := range []struct {
+		packet []byte
+		want   PacketType
+		ok     bool
+	}{
+		{[]byte{UnconnectedPingID, 0}, PacketUnconnectedPing, true},
+		{[]byte{UnconnectedPingOpenConnectionsID, 0}, PacketUnconnectedPing, true},
+		{[]byte{UnconnectedPongID, 0}, PacketUnconnectedReply, true},
+		{[]byte{OpenConnectionRequest1ID, 0}, PacketOpenConnectionRequest1, true},
+		{[]byte{OpenConnectionRequest2ID, 0}, PacketOpenConnectionRequest2, true},
+		{[]byte{0x84, 0, 0, 0}, PacketConnected, true},
+		{[]byte{0xc0, 0, 0}, PacketConnected, true},
+		{[]byte{0xa0, 0, 0}, PacketConnected, true},
+		{[]byte{0x00, 0, 0}, PacketUnknown, false},
+		{[]byte{IncompatibleProtocolID}, PacketUnknown, false},
+		{[]byte("GET / HTTP/1.1"), PacketUnknown, false},
+		{nil, PacketUnknown, false},
+	} {
+		packetType, ok := ClassifyPacket(test.packet)
+		assert.Equal(t, test.want, packetType, "%v", test.packet)
+		assert.Equal(t, test.ok, ok, "%v", test.packet)
+	}
+
+	assert.Equal(t, "open_connection_request_1", PacketOpenConnectionRequest1.String())
+	assert.Equal(t, "unknown", PacketType(100).String())
+}
+
+func TestReadDatagramSequence(t *testing.T) {
+	sequence, ok := ReadDatagramSequence([]byte{0x84, 0x03, 0x02, 0x01, 0xff})
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0x010203), sequence)
+
+	// ACKs, NAKs and offline messages have no sequence number
+	for _, packet := range [][]byte{
+		{0xc0, 0x00, 0x01, 0x00},
+		{0xa0, 0x00, 0x01, 0x00},
+		{UnconnectedPingID, 0x00, 0x00, 0x00},
+		{0x84, 0x00},
+	} {
+		_, ok := ReadDatagramSequence(packet)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Starts the admin HTTP server on the given address
+func (proxy *ProxyServer) startAdminServer(addr string) error {
+	log.Info().Msgf("Binding admin server to: %s", addr)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", proxy.handleConnections)
+	mux.HandleFunc("/stats", proxy.handleStats)
+	mux.HandleFunc("/stats/reset", proxy.handleResetStats)
+	mux.HandleFunc("/metrics", proxy.handleMetrics)
+	mux.HandleFunc("/usage", proxy.handleUsage)
+	mux.HandleFunc("/blocklist", proxy.handleBlocklist)
+	mux.HandleFunc("/backends", proxy.handleBackends)
+
+	proxy.admin = &http.Server{Handler: mux}
+
+	proxy.goLoop(func() {
+		if err := proxy.admin.Serve(listener); err != http.ErrServerClosed {
+			log.Warn().Msgf("Admin server stopped: %v", err)
+		}
+	})
+
+	return nil
+}
+
+// Lists active connections and their statistics
+func (proxy *ProxyServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, proxy.clientMap.Snapshot())
+}
+
+// Shows the current stats
+func (proxy *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, proxy.Stats())
+}
+
+// Resets the cumulative counters, see ResetStats()
+func (proxy *ProxyServer) handleResetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST to reset stats", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !proxy.authorizeAdmin(w, r) {
+		return
+	}
+
+	proxy.ResetStats()
+	writeJSON(w, proxy.Stats())
+}
+
+// Lists the usage of each client IP, see Usage()
+func (proxy *ProxyServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, proxy.Usage())
+}
+
+// Lists the blocklist, or with POST blocks the "ip" parameter for the
+// optional "duration" and with DELETE unblocks it. See Block().
+func (proxy *ProxyServer) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		if !proxy.authorizeAdmin(w, r) {
+			return
+		}
+
+		ip := net.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "Invalid ip", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var duration time.Duration
+			if value := r.FormValue("duration"); value != "" {
+				parsed, err := time.ParseDuration(value)
+				if err != nil {
+					http.Error(w, "Invalid duration", http.StatusBadRequest)
+					return
+				}
+				duration = parsed
+			}
+
+			proxy.Block(ip, duration)
+		case http.MethodDelete:
+			proxy.Unblock(ip)
+		default:
+			http.Error(w, "Use GET, POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	writeJSON(w, proxy.Blocklist())
+}
+
+// Lists the servers and their health, or with POST drains the "server"
+// parameter and with DELETE resumes it. See DrainBackend().
+func (proxy *ProxyServer) handleBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && !proxy.authorizeAdmin(w, r) {
+		return
+	}
+
+	server := r.FormValue("server")
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		err = proxy.DrainBackend(server)
+	case http.MethodDelete:
+		err = proxy.ResumeBackend(server)
+	default:
+		http.Error(w, "Use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, proxy.backends.statuses())
+}
+
+// Errors refusing admin requests that change state
+var (
+	errInvalidAdminToken = errors.New("Invalid admin token")
+	errAdminNotLocal     = errors.New("Set an admin token to make changes from other hosts")
+)
+
+// Checks that a request that changes state is allowed: it must carry
+// AdminToken as a bearer token in its authorization, or come from a loopback
+// IP when no token is set. Shared by the HTTP and gRPC admin servers.
+func (proxy *ProxyServer) checkAdmin(authorization string, ip net.IP) error {
+	if token := proxy.prefs.AdminToken; token != "" {
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+token)) != 1 {
+			return errInvalidAdminToken
+		}
+
+		return nil
+	}
+
+	if ip == nil || !ip.IsLoopback() {
+		return errAdminNotLocal
+	}
+
+	return nil
+}
+
+// Returns whether a request that changes state is allowed, see checkAdmin.
+// Otherwise writes an error response.
+func (proxy *ProxyServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	switch err := proxy.checkAdmin(r.Header.Get("Authorization"), net.ParseIP(host)); err {
+	case nil:
+		return true
+	case errInvalidAdminToken:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warn().Msgf("Failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Service queried for the public IP when DetectPublicIP is set
+var publicIPURL = "https://api.ipify.org"
+
+const publicIPTimeout = 5 * time.Second
+
+// Returns the address players should connect to: AdvertiseHost and
+// AdvertisePort when set, or else the best guess at this host's address and
+// the port the proxy listens on.
+func (proxy *ProxyServer) advertisedAddress() string {
+	host := proxy.prefs.AdvertiseHost
+	if host == "" && proxy.prefs.DetectPublicIP {
+		if ip, err := detectPublicIP(); err == nil {
+			host = ip.String()
+		} else {
+			log.Warn().Msgf("Failed to detect public IP: %v", err)
+		}
+	}
+
+	if host == "" && !proxy.bindAddress.IP.IsUnspecified() && proxy.bindAddress.IP != nil {
+		host = proxy.bindAddress.IP.String()
+	}
+
+	if host == "" {
+		host = outboundIP(proxy.remoteServerAddress).String()
+	}
+
+	port := proxy.prefs.AdvertisePort
+	if port == 0 {
+		port = proxy.BoundPort()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// Returns the local IP used to reach the given address. No packets are sent.
+func outboundIP(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return net.IPv4zero
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// Asks an external service for the IP this host's traffic comes from
+func detectPublicIP() (net.IP, error) {
+	client := http.Client{Timeout: publicIPTimeout}
+
+	response, err := client.Get(publicIPURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response: %s", response.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address: %q", body)
+	}
+
+	return ip, nil
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvertisedAddress(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:   "127.0.0.1",
+		BindPort:      19200,
+		RemoteServer:  "127.0.0.1:19140",
+		AdvertiseHost: "play.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	assert.Equal(t, "play.example.com:19200", proxyServer.advertisedAddress())
+
+	proxyServer.prefs.AdvertiseHost = ""
+	proxyServer.prefs.AdvertisePort = 25565
+	assert.Equal(t, "127.0.0.1:25565", proxyServer.advertisedAddress())
+}
+
+func TestAdvertisedAddressPublicIP(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer service.Close()
+
+	defaultURL := publicIPURL
+	publicIPURL = service.URL
+	defer func() { publicIPURL = defaultURL }()
+
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:    "0.0.0.0",
+		BindPort:       19200,
+		RemoteServer:   "127.0.0.1:19140",
+		DetectPublicIP: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	assert.Equal(t, "203.0.113.7:19200", proxyServer.advertisedAddress())
+}
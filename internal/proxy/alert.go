@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Levels of Alert
+const (
+	AlertHigh   = "high"
+	AlertLow    = "low"
+	AlertNormal = "normal"
+)
+
+// Shortest time between two alerts, so that a count hovering around a
+// threshold doesn't flood the webhook
+const alertDebounce = time.Minute
+
+const alertTimeout = 10 * time.Second
+
+// Alert is posted as JSON to AlertWebhook when the number of connections
+// crosses AlertHighConnections or AlertLowConnections, or returns between
+// them
+type Alert struct {
+	Level       string    `json:"level"`
+	Label       string    `json:"label"`
+	Connections int       `json:"connections"`
+	Time        time.Time `json:"time"`
+}
+
+// alerter tracks which side of the thresholds the connection count was last
+// reported on
+type alerter struct {
+	high     int
+	low      int
+	reported string
+	lastSent time.Time
+	mutex    *sync.Mutex
+}
+
+func newAlerter(high int, low int) *alerter {
+	return &alerter{
+		high,
+		low,
+		AlertNormal,
+		time.Time{},
+		&sync.Mutex{},
+	}
+}
+
+// Returns the level for the number of connections
+func (alerter *alerter) level(connections int) string {
+	if alerter.high > 0 && connections >= alerter.high {
+		return AlertHigh
+	}
+
+	if connections < alerter.low {
+		return AlertLow
+	}
+
+	return AlertNormal
+}
+
+// Returns the level to alert about if it changed since the last alert, unless
+// the last alert was too recent, in which case the change is reported once
+// it isn't
+func (alerter *alerter) check(connections int, now time.Time) (string, bool) {
+	alerter.mutex.Lock()
+	defer alerter.mutex.Unlock()
+
+	level := alerter.level(connections)
+	if level == alerter.reported || now.Sub(alerter.lastSent) < alertDebounce {
+		return "", false
+	}
+
+	alerter.reported = level
+	alerter.lastSent = now
+	return level, true
+}
+
+// Posts an alert to the webhook if the number of connections crossed a
+// threshold
+func (proxy *ProxyServer) checkAlerts(now time.Time) {
+	connections := proxy.ConnectionCount()
+	level, ok := proxy.alerts.check(connections, now)
+	if !ok {
+		return
+	}
+
+	alert := Alert{level, proxy.Label(), connections, now}
+	log.Info().Msgf("Connection count %d is %s, sending alert", connections, level)
+
+	proxy.goLoop(func() {
+		if err := postAlert(proxy.prefs.AlertWebhook, alert); err != nil {
+			log.Warn().Msgf("Failed to send alert to webhook: %v", err)
+		}
+	})
+}
+
+func postAlert(url string, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: alertTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response: %s", response.Status)
+	}
+
+	return nil
+}
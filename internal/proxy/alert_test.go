@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerterCheck(t *testing.T) {
+	alerts := newAlerter(10, 2)
+	now := time.Now()
+
+	_, ok := alerts.check(5, now)
+	assert.False(t, ok)
+
+	level, ok := alerts.check(10, now)
+	assert.True(t, ok)
+	assert.Equal(t, AlertHigh, level)
+
+	// Going back to normal right away is held back
+	_, ok = alerts.check(5, now.Add(time.Second))
+	assert.False(t, ok)
+
+	level, ok = alerts.check(5, now.Add(alertDebounce))
+	assert.True(t, ok)
+	assert.Equal(t, AlertNormal, level)
+
+	level, ok = alerts.check(1, now.Add(2*alertDebounce))
+	assert.True(t, ok)
+	assert.Equal(t, AlertLow, level)
+
+	_, ok = alerts.check(0, now.Add(3*alertDebounce))
+	assert.False(t, ok)
+
+	// Thresholds of 0 never alert
+	alerts = newAlerter(0, 0)
+	for _, connections := range []int{0, 1000} {
+		_, ok = alerts.check(connections, now.Add(time.Hour))
+		assert.False(t, ok)
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	received := make(chan Alert, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&alert))
+		received <- alert
+	}))
+	defer webhook.Close()
+
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:        server.addr(),
+		Label:               "survival",
+		AlertWebhook:        webhook.URL,
+		AlertLowConnections: 1,
+	})
+
+	proxyServer.checkAlerts(time.Now())
+
+	select {
+	case alert := <-received:
+		assert.Equal(t, AlertLow, alert.Level)
+		assert.Equal(t, "survival", alert.Label)
+		assert.Equal(t, 0, alert.Connections)
+	case <-time.After(2 * time.Second):
+		t.Fatal("alert was not sent")
+	}
+}
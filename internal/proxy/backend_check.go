@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+)
+
+// How long to wait for the server to answer the check at startup
+const backendCheckTimeout = 3 * time.Second
+
+// Size of a standard unconnected ping
+const unconnectedPingSize = 33
+
+// Pings the server and returns an error if it doesn't answer in time
+func checkBackend(dial clientmap.DialFunc, remote *net.UDPAddr) error {
+	log.Info().Msgf("Checking that the server at %s is reachable", remote)
+
+	conn, err := dial(remote)
+	if err != nil {
+		return fmt.Errorf("Server %s is unreachable: %s", remote, err)
+	}
+	defer conn.Close()
+
+	if err := sendProbe(conn, unconnectedPingSize, backendCheckTimeout); err != nil {
+		return fmt.Errorf("Server %s did not answer a ping: %s", remote, err)
+	}
+
+	log.Info().Msgf("Server at %s is reachable", remote)
+	return nil
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBackend(t *testing.T) {
+	server := startFakeServer(t)
+
+	remote, err := net.ResolveUDPAddr("udp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, checkBackend(clientmap.DialUDP, remote))
+}
+
+func TestCheckBackendUnreachable(t *testing.T) {
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	assert.NotNil(t, checkBackend(clientmap.DialUDP, closed.LocalAddr().(*net.UDPAddr)))
+}
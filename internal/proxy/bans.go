@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// How long ban checks are cached when BanCacheTTL is not set
+const defaultBanCacheTTL = time.Minute
+
+// Returns a cache of the answers of a ProxyPrefs.BanChecker, so that it isn't
+// consulted for every new connection from the same IP
+func newBanCache(checker func(ip net.IP) bool, ttl time.Duration) *ttlCache {
+	if ttl <= 0 {
+		ttl = defaultBanCacheTTL
+	}
+
+	return newTTLCache(func(key string) interface{} {
+		return checker(net.ParseIP(key))
+	}, ttl)
+}
+
+// Returns whether the IP is banned, and whether the BanChecker has answered
+// for it yet. Until it has, it is asked in the background so that the packet
+// path never waits on the ban service.
+func (proxy *ProxyServer) checkBan(ip net.IP) (bool, bool) {
+	banned, ok := proxy.bans.peek(ip.String())
+	if !ok {
+		return false, false
+	}
+
+	return banned.(bool), true
+}
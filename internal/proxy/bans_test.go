@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanCache(t *testing.T) {
+	calls := 0
+	cache := newBanCache(func(ip net.IP) bool {
+		calls++
+		return ip.Equal(net.IPv4(10, 0, 0, 1))
+	}, time.Minute)
+
+	assert.Equal(t, true, cache.load("10.0.0.1"))
+	assert.Equal(t, true, cache.load("10.0.0.1"))
+	assert.Equal(t, false, cache.load("10.0.0.2"))
+	assert.Equal(t, 2, calls)
+
+	// Expired answers are checked again
+	cache.expire(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, true, cache.load("10.0.0.1"))
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Maximum number of packets read from or written to a socket in one syscall
+const maxBatchSize = 32
+
+// Reads and writes several packets at once. Implemented by both
+// ipv4.PacketConn and ipv6.PacketConn, whose messages are the same type.
+type batchConn interface {
+	ReadBatch(messages []ipv4.Message, flags int) (int, error)
+	WriteBatch(messages []ipv4.Message, flags int) (int, error)
+}
+
+// Wraps the socket for batched reads and writes according to its address
+// family. IPv6 sockets, including dual-stack ones, have 16-byte local
+// addresses even when bound to an IPv4-mapped address.
+func newBatchConn(conn net.PacketConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && len(addr.IP) == net.IPv6len {
+		return ipv6.NewPacketConn(conn)
+	}
+
+	return ipv4.NewPacketConn(conn)
+}
+
+// Returns whether the error means that the platform can't batch writes at
+// all, rather than that this batch failed. golang.org/x/net reports platforms
+// it doesn't implement them on with an unexported "not implemented" error.
+func batchUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOSYS) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		strings.Contains(err.Error(), "not implemented")
+}
+
+// batchWriter sends several packets to the same client at once, using a
+// single sendmmsg syscall where the platform supports it and falling back to
+// one WriteTo per packet where it doesn't.
+type batchWriter struct {
+	conn        net.PacketConn
+	batchConn   batchConn
+	messages    []ipv4.Message
+	unsupported bool
+}
+
+func newBatchWriter(conn net.PacketConn) *batchWriter {
+	return &batchWriter{
+		conn,
+		newBatchConn(conn),
+		make([]ipv4.Message, 0, maxBatchSize),
+		false,
+	}
+}
+
+// Sends all packets to the given address, in order
+func (writer *batchWriter) writeBatch(packets [][]byte, addr net.Addr) {
+	if !writer.unsupported {
+		writer.messages = writer.messages[:0]
+		for _, packet := range packets {
+			writer.messages = append(writer.messages, ipv4.Message{
+				Buffers: [][]byte{packet},
+				Addr:    addr,
+			})
+		}
+
+		sent, err := writer.batchConn.WriteBatch(writer.messages, 0)
+		for err == nil && sent < len(packets) {
+			var n int
+			n, err = writer.batchConn.WriteBatch(writer.messages[sent:], 0)
+			sent += n
+		}
+
+		if err == nil {
+			return
+		}
+
+		if batchUnsupported(err) {
+			log.Debug().Msgf("Batched writes unavailable, falling back to single writes: %v", err)
+			writer.unsupported = true
+		} else {
+			log.Trace().Msgf("Batched write failed, retrying with single writes: %v", err)
+		}
+
+		packets = packets[sent:]
+	}
+
+	for _, packet := range packets {
+		writer.conn.WriteTo(packet, addr)
+	}
+}
+
+// Like processDataFromServer, but reads as many packets as are available from
+// the server in one syscall and writes them to the client in one syscall.
+func (proxy *ProxyServer) processBatchesFromServer(remoteConn *clientmap.ServerConn, client net.Addr) {
+	reader := newBatchConn(remoteConn.Conn.(*net.UDPConn))
+	writer := newBatchWriter(proxy.server)
+
+	messages := make([]ipv4.Message, maxBatchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, proxy.mtu)}
+	}
+
+	packets := make([][]byte, 0, maxBatchSize)
+
+	logger := remoteConn.Logger()
+
+	stopConnectTimer := proxy.startConnectTimer(client, logger)
+	defer stopConnectTimer()
+
+	endHandshake := proxy.handshakes.releaser()
+	defer endHandshake()
+
+	for !proxy.dead.IsSet() {
+		// Read the next packets from the server
+		count, err := reader.ReadBatch(messages, 0)
+
+		// Remove read timeout, server responded
+		_ = remoteConn.SetReadDeadline(time.Time{})
+
+		// Read error
+		if err != nil {
+			proxy.handleServerReadError(err, client, remoteConn, logger)
+			break
+		}
+
+		stopConnectTimer()
+		endHandshake()
+		proxy.breaker.success()
+
+		packets = packets[:0]
+		for _, message := range messages[:count] {
+			// Empty read
+			if message.N < 1 {
+				continue
+			}
+
+			if isKeepAlivePong(message.Buffers[0][:message.N]) {
+				continue
+			}
+
+			remoteConn.CountFromServer(message.Buffers[0][:message.N])
+			proxy.counters().fromServer(message.N)
+			proxy.recordUsage(client, message.N)
+			proxy.checkTruncated(message.N, message.Buffers[0], remoteConn.RemoteAddr())
+
+			data := proxy.handleServerPacket(message.Buffers[0][:message.N], client)
+
+			if proxy.faults.shouldDrop() {
+				logger.Trace().Msgf("Fault injection: dropping packet to %s", client.String())
+				proxy.counters().dropped()
+				continue
+			}
+
+			if !proxy.waitForEgress(len(data)) {
+				logger.Trace().Msgf("Dropping packet to %s, over the egress limit", client.String())
+				continue
+			}
+
+			// Delayed packets are sent individually once their time comes
+			if proxy.prefs.AddedLatency > 0 {
+				proxy.faults.delay(data, func(delayed []byte) {
+					proxy.server.WriteTo(delayed, client)
+				})
+				continue
+			}
+
+			packets = append(packets, data)
+		}
+
+		if len(packets) > 0 {
+			writer.writeBatch(packets, client)
+		}
+	}
+
+	proxy.clientMap.DeleteIf(client, remoteConn)
+}
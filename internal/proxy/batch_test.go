@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Opens a loopback sender and a receiver that discards everything it reads
+func benchmarkConns(b *testing.B) (*net.UDPConn, net.Addr) {
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	go func() {
+		buffer := make([]byte, maxMTU)
+		for {
+			if _, _, err := receiver.ReadFrom(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+
+	return sender, receiver.LocalAddr()
+}
+
+func benchmarkPackets() [][]byte {
+	packets := make([][]byte, maxBatchSize)
+	for i := range packets {
+		packets[i] = make([]byte, 512)
+	}
+
+	return packets
+}
+
+func BenchmarkBatchWrites(b *testing.B) {
+	sender, addr := benchmarkConns(b)
+	writer := newBatchWriter(sender)
+	packets := benchmarkPackets()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.writeBatch(packets, addr)
+	}
+}
+
+func BenchmarkSingleWrites(b *testing.B) {
+	sender, addr := benchmarkConns(b)
+	packets := benchmarkPackets()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, packet := range packets {
+			sender.WriteTo(packet, addr)
+		}
+	}
+}
+
+func TestBatchWriterDualStack(t *testing.T) {
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("No dual-stack sockets: %v", err)
+	}
+	defer sender.Close()
+
+	writer := newBatchWriter(sender)
+
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Skipf("No loopback for %s: %v", ip, err)
+		}
+		defer receiver.Close()
+
+		writer.writeBatch([][]byte{{1}, {2}, {3}}, receiver.LocalAddr())
+
+		buffer := make([]byte, maxMTU)
+		for i := byte(1); i <= 3; i++ {
+			_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+			read, _, err := receiver.ReadFrom(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, []byte{i}, buffer[:read])
+		}
+	}
+
+	assert.False(t, writer.unsupported)
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	assert.True(t, batchUnsupported(&net.OpError{Op: "write", Err: os.NewSyscallError("sendmmsg", syscall.ENOSYS)}))
+	assert.False(t, batchUnsupported(&net.OpError{Op: "write", Err: os.NewSyscallError("sendmmsg", syscall.ENOBUFS)}))
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// blocklist holds IPs blocked while phantom is running, each until an expiry
+// time or for good. With a state path, it is saved to and restored from a JSON
+// file so that blocks survive restarts.
+type blocklist struct {
+	path string
+	// Expiry of each blocked IP, or the zero time for no expiry
+	entries map[string]time.Time
+	// Whether entries changed since they were last saved
+	dirty bool
+	mutex *sync.RWMutex
+	// Copy of the blocked IPs, replaced whenever entries change so that
+	// packets are checked without locking. Expired blocks stay in it until
+	// the next housekeeping tick removes them.
+	active *atomic.Value
+}
+
+// BlockedIP is an IP blocked with Block(), as listed by Blocklist() and saved
+// in the state file
+type BlockedIP struct {
+	IP      string     `json:"ip"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Creates a blocklist, restoring the unexpired entries saved at the path if
+// there is a file there
+func newBlocklist(path string) (*blocklist, error) {
+	list := &blocklist{
+		path,
+		make(map[string]time.Time),
+		false,
+		&sync.RWMutex{},
+		&atomic.Value{},
+	}
+	list.active.Store(map[string]bool{})
+
+	if path == "" {
+		return list, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []BlockedIP
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, entry := range saved {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			continue
+		}
+
+		var expires time.Time
+		if entry.Expires != nil {
+			if !entry.Expires.After(now) {
+				continue
+			}
+			expires = *entry.Expires
+		}
+
+		list.entries[ip.String()] = expires
+	}
+	list.publish()
+
+	log.Info().Msgf("Restored %d blocked IPs from %s", len(list.entries), path)
+
+	return list, nil
+}
+
+// Blocks the IP until the expiry, or for good if it is the zero time
+func (list *blocklist) add(ip net.IP, expires time.Time) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	list.entries[ip.String()] = expires
+	list.dirty = true
+	list.publish()
+}
+
+func (list *blocklist) remove(ip net.IP) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	if _, ok := list.entries[ip.String()]; ok {
+		delete(list.entries, ip.String())
+		list.dirty = true
+		list.publish()
+	}
+}
+
+// Replaces the copy of the blocked IPs read by blocked. Must be called with
+// the mutex held.
+func (list *blocklist) publish() {
+	active := make(map[string]bool, len(list.entries))
+	for key := range list.entries {
+		active[key] = true
+	}
+
+	list.active.Store(active)
+}
+
+// Returns whether the IP is blocked, without locking so that it can be called
+// for every packet
+func (list *blocklist) blocked(ip net.IP) bool {
+	active := list.active.Load().(map[string]bool)
+	if len(active) == 0 || ip == nil {
+		return false
+	}
+
+	return active[ip.String()]
+}
+
+// Forgets blocks that have expired
+func (list *blocklist) expire(now time.Time) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	expired := false
+	for key, expires := range list.entries {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(list.entries, key)
+			expired = true
+		}
+	}
+
+	if expired {
+		list.dirty = true
+		list.publish()
+	}
+}
+
+// Lists the entries, ordered by IP. Must be called with the mutex held.
+func (list *blocklist) snapshot() []BlockedIP {
+	snapshot := make([]BlockedIP, 0, len(list.entries))
+	for key, expires := range list.entries {
+		entry := BlockedIP{key, nil}
+		if !expires.IsZero() {
+			expires := expires
+			entry.Expires = &expires
+		}
+
+		snapshot = append(snapshot, entry)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].IP < snapshot[j].IP })
+
+	return snapshot
+}
+
+// Writes the entries to the state path if they changed since the last save.
+// The file is replaced atomically, so a crash never leaves it half written.
+func (list *blocklist) save() error {
+	if list.path == "" {
+		return nil
+	}
+
+	list.mutex.Lock()
+	if !list.dirty {
+		list.mutex.Unlock()
+		return nil
+	}
+
+	saved := list.snapshot()
+	list.dirty = false
+	list.mutex.Unlock()
+
+	contents, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileAtomic(list.path, contents)
+	}
+
+	// Try again next time
+	if err != nil {
+		list.mutex.Lock()
+		list.dirty = true
+		list.mutex.Unlock()
+	}
+
+	return err
+}
+
+// Writes the file through a temporary file in the same directory, renamed
+// over the destination once complete
+func writeFileAtomic(path string, contents []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Block drops all packets from the IP, for the duration or for good if it is
+// zero. Expiry is checked every few seconds, so a block may last that much
+// longer. Unlike BlockedClients, blocks can be added while phantom is running
+// and are saved to BlocklistStatePath if it is set.
+func (proxy *ProxyServer) Block(ip net.IP, duration time.Duration) {
+	var expires time.Time
+	if duration > 0 {
+		expires = time.Now().Add(duration)
+	}
+
+	log.Info().Msgf("Blocking %s for %v", ip, duration)
+	proxy.blocklist.add(ip, expires)
+}
+
+// Unblock lifts a block added with Block
+func (proxy *ProxyServer) Unblock(ip net.IP) {
+	log.Info().Msgf("Unblocking %s", ip)
+	proxy.blocklist.remove(ip)
+}
+
+// Blocklist returns the IPs blocked with Block() that are still blocked
+func (proxy *ProxyServer) Blocklist() []BlockedIP {
+	proxy.blocklist.expire(time.Now())
+
+	proxy.blocklist.mutex.RLock()
+	defer proxy.blocklist.mutex.RUnlock()
+
+	return proxy.blocklist.snapshot()
+}
+
+// Saves the blocklist, logging a failure
+func (proxy *ProxyServer) saveBlocklist() {
+	if err := proxy.blocklist.save(); err != nil {
+		log.Warn().Msgf("Failed to save blocklist to %s: %v", proxy.prefs.BlocklistStatePath, err)
+	}
+}
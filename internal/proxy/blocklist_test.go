@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocklistExpiry(t *testing.T) {
+	list, err := newBlocklist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	permanent := net.ParseIP("10.0.0.1")
+	temporary := net.ParseIP("2001:db8::1")
+
+	list.add(permanent, time.Time{})
+	list.add(temporary, now.Add(time.Minute))
+
+	assert.True(t, list.blocked(permanent))
+	assert.True(t, list.blocked(temporary))
+	assert.False(t, list.blocked(net.ParseIP("10.0.0.2")))
+
+	// IPv4-mapped addresses are the same IP
+	assert.True(t, list.blocked(net.ParseIP("::ffff:10.0.0.1")))
+
+	// Expired blocks are lifted by the next expiry check
+	later := now.Add(2 * time.Minute)
+	list.expire(now)
+	assert.True(t, list.blocked(temporary))
+	list.expire(later)
+	assert.False(t, list.blocked(temporary))
+	assert.Len(t, list.entries, 1)
+
+	list.remove(permanent)
+	assert.False(t, list.blocked(permanent))
+}
+
+func TestBlocklistState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+
+	list, err := newBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	list.add(net.ParseIP("10.0.0.1"), time.Time{})
+	list.add(net.ParseIP("10.0.0.2"), now.Add(time.Hour))
+	list.add(net.ParseIP("10.0.0.3"), now.Add(50*time.Millisecond))
+	assert.Nil(t, list.save())
+
+	// Only the state file is left behind
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	time.Sleep(100 * time.Millisecond)
+
+	restored, err := newBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, restored.blocked(net.ParseIP("10.0.0.1")))
+	assert.True(t, restored.blocked(net.ParseIP("10.0.0.2")))
+	assert.False(t, restored.blocked(net.ParseIP("10.0.0.3")))
+
+	// Blocks that ran out while phantom was stopped are not restored
+	assert.Len(t, restored.entries, 2)
+
+	// A missing file starts empty, a corrupt one is an error
+	_, err = newBlocklist(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = newBlocklist(path)
+	assert.NotNil(t, err)
+}
+
+func TestBlock(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	proxyServer.Block(net.IPv4(127, 0, 0, 1), time.Hour)
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet from blocked client was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	proxyServer.Unblock(net.IPv4(127, 0, 0, 1))
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+}
+
+// Builds an admin request coming from localhost
+func localRequest(method string, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "127.0.0.1:50000"
+	return r
+}
+
+func TestHandleBlocklist(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		RemoteServer: "127.0.0.1:19140",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	recorder := httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, localRequest("POST", "/blocklist?ip=10.0.0.1&duration=1h"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, localRequest("POST", "/blocklist?ip=10.0.0.2"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var blocked []BlockedIP
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &blocked))
+	if assert.Len(t, blocked, 2) {
+		assert.Equal(t, "10.0.0.1", blocked[0].IP)
+		assert.NotNil(t, blocked[0].Expires)
+		assert.Equal(t, "10.0.0.2", blocked[1].IP)
+		assert.Nil(t, blocked[1].Expires)
+	}
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, localRequest("DELETE", "/blocklist?ip=10.0.0.1"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, proxyServer.Blocklist(), 1)
+
+	for _, target := range []string{"/blocklist?ip=nope", "/blocklist?ip=10.0.0.3&duration=soon"} {
+		recorder = httptest.NewRecorder()
+		proxyServer.handleBlocklist(recorder, localRequest("POST", target))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		RemoteServer: "127.0.0.1:19140",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	// Without a token, only localhost may make changes, but anyone may look
+	remote := httptest.NewRequest("POST", "/blocklist?ip=10.0.0.1", nil)
+	recorder := httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, remote)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, httptest.NewRequest("GET", "/blocklist", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, proxyServer.Blocklist(), 0)
+
+	// With a token, every change needs it, even from localhost
+	proxyServer.prefs.AdminToken = "secret"
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, localRequest("POST", "/blocklist?ip=10.0.0.1"))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	remote = httptest.NewRequest("POST", "/blocklist?ip=10.0.0.1", nil)
+	remote.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBlocklist(recorder, remote)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, proxyServer.Blocklist(), 1)
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long the circuit breaker stays open when BreakerCooldown is not set
+const defaultBreakerCooldown = 30 * time.Second
+
+// circuitBreaker stops new connections from piling up while the server is
+// failing. After threshold consecutive failures it opens, refusing new
+// connections for the cooldown. Then it half-opens, letting one new
+// connection through to probe the server: an answer closes the breaker, a
+// failure opens it again.
+type circuitBreaker struct {
+	// Whether there are failures to reset, accessed atomically so that
+	// successes are cheap to report
+	failing   int32
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	// When the breaker opened, or the zero time while it is closed
+	openedAt time.Time
+	// When the last probe was let through while half-open
+	probeStarted time.Time
+	mutex        *sync.Mutex
+}
+
+// Creates a breaker that opens after threshold failures, or never if it is 0
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &circuitBreaker{
+		0,
+		threshold,
+		cooldown,
+		0,
+		time.Time{},
+		time.Time{},
+		&sync.Mutex{},
+	}
+}
+
+// Returns whether a new connection may be opened. While half-open, one
+// connection is let through per cooldown, in case a probe never finishes.
+func (breaker *circuitBreaker) allow(now time.Time) bool {
+	if breaker.threshold <= 0 || atomic.LoadInt32(&breaker.failing) == 0 {
+		return true
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.openedAt.IsZero() {
+		return true
+	}
+
+	if now.Before(breaker.openedAt.Add(breaker.cooldown)) || now.Before(breaker.probeStarted.Add(breaker.cooldown)) {
+		return false
+	}
+
+	breaker.probeStarted = now
+	log.Info().Msgf("Circuit breaker half-open, letting a connection through to probe the server")
+	return true
+}
+
+// Records that the server failed a connection and returns whether that opened
+// the breaker
+func (breaker *circuitBreaker) failure(now time.Time) bool {
+	if breaker.threshold <= 0 {
+		return false
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	atomic.StoreInt32(&breaker.failing, 1)
+	breaker.failures++
+
+	if breaker.openedAt.IsZero() {
+		if breaker.failures < breaker.threshold {
+			return false
+		}
+	} else if breaker.probeStarted.IsZero() {
+		// Already open. Only a failure while half-open opens it again.
+		return false
+	}
+
+	breaker.openedAt = now
+	breaker.probeStarted = time.Time{}
+	log.Warn().Msgf("Circuit breaker open after %d consecutive server failures, refusing new connections for %v", breaker.failures, breaker.cooldown)
+	return true
+}
+
+// Returns whether the breaker is open or half-open
+func (breaker *circuitBreaker) isOpen() bool {
+	if atomic.LoadInt32(&breaker.failing) == 0 {
+		return false
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return !breaker.openedAt.IsZero()
+}
+
+// Records that the server answered, closing the breaker
+func (breaker *circuitBreaker) success() {
+	if atomic.LoadInt32(&breaker.failing) == 0 {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if !breaker.openedAt.IsZero() {
+		log.Info().Msgf("Server answered, circuit breaker closed")
+	}
+
+	atomic.StoreInt32(&breaker.failing, 0)
+	breaker.failures = 0
+	breaker.openedAt = time.Time{}
+	breaker.probeStarted = time.Time{}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(3, time.Minute)
+	now := time.Now()
+
+	// Opens after the threshold of consecutive failures
+	assert.False(t, breaker.failure(now))
+	assert.False(t, breaker.failure(now))
+	breaker.success()
+	assert.False(t, breaker.failure(now))
+	assert.False(t, breaker.failure(now))
+	assert.True(t, breaker.allow(now))
+	assert.True(t, breaker.failure(now))
+	assert.True(t, breaker.isOpen())
+
+	// Refuses connections for the cooldown
+	assert.False(t, breaker.allow(now.Add(30*time.Second)))
+
+	// Failures from connections opened earlier don't extend it
+	assert.False(t, breaker.failure(now.Add(30*time.Second)))
+
+	// Then lets one probe through
+	later := now.Add(time.Minute)
+	assert.True(t, breaker.allow(later))
+	assert.False(t, breaker.allow(later))
+
+	// A failed probe opens it again
+	assert.True(t, breaker.failure(later))
+	assert.False(t, breaker.allow(later.Add(30*time.Second)))
+
+	// A probe that never finishes is followed by another
+	later = later.Add(time.Minute)
+	assert.True(t, breaker.allow(later))
+	assert.True(t, breaker.allow(later.Add(time.Minute)))
+
+	// An answer closes it
+	breaker.success()
+	assert.False(t, breaker.isOpen())
+	assert.True(t, breaker.allow(later))
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := newCircuitBreaker(0, 0)
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		assert.False(t, breaker.failure(now))
+	}
+
+	assert.True(t, breaker.allow(now))
+	assert.False(t, breaker.isOpen())
+}
+
+func TestBreakerRefusesConnections(t *testing.T) {
+	// A server that is down refuses every connection
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:     closed.LocalAddr().String(),
+		BreakerThreshold: 2,
+	})
+
+	for i := 0; i < 2; i++ {
+		client := dialProxy(t, proxyServer)
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !proxyServer.Stats().BreakerOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit breaker did not open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("new connection was not refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// LoadPrefs reads ProxyPrefs from a JSON file, whose keys are the json tags of
+// ProxyPrefs. Durations are strings such as "30s" or "5m", and message IDs are
+// lists of numbers. Unknown keys and malformed values are reported as errors.
+// Options left out keep the same defaults as the command line.
+func LoadPrefs(path string) (ProxyPrefs, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ProxyPrefs{}, err
+	}
+	defer file.Close()
+
+	var values map[string]json.RawMessage
+	if err := json.NewDecoder(file).Decode(&values); err != nil {
+		return ProxyPrefs{}, fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+
+	prefs := ProxyPrefs{
+		BindAddress: "0.0.0.0",
+		IdleTimeout: 60 * time.Second,
+		NumWorkers:  1,
+	}
+
+	fields := configFields()
+	target := reflect.ValueOf(&prefs).Elem()
+
+	for key, value := range values {
+		index, ok := fields[key]
+		if !ok {
+			return ProxyPrefs{}, fmt.Errorf("Invalid config file %s: unknown key %q", path, key)
+		}
+
+		if err := decodeConfigValue(value, target.Field(index)); err != nil {
+			return ProxyPrefs{}, fmt.Errorf("Invalid %s in config file %s: %s", key, path, err)
+		}
+	}
+
+	return prefs, nil
+}
+
+// Returns the index in ProxyPrefs of the field for each config file key.
+// Fields tagged "-", such as callbacks, can only be set from code.
+func configFields() map[string]int {
+	fields := make(map[string]int)
+
+	prefsType := reflect.TypeOf(ProxyPrefs{})
+	for i := 0; i < prefsType.NumField(); i++ {
+		if key := prefsType.Field(i).Tag.Get("json"); key != "" && key != "-" {
+			fields[key] = i
+		}
+	}
+
+	return fields
+}
+
+// Decodes a config file value into a ProxyPrefs field
+func decodeConfigValue(value json.RawMessage, field reflect.Value) error {
+	switch field.Interface().(type) {
+	case time.Duration:
+		var duration string
+		if err := json.Unmarshal(value, &duration); err != nil {
+			return err
+		}
+
+		if duration == "" {
+			return nil
+		}
+
+		parsed, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+
+		field.Set(reflect.ValueOf(parsed))
+
+	case []byte:
+		var ids []int
+		if err := json.Unmarshal(value, &ids); err != nil {
+			return err
+		}
+
+		// An empty list is kept apart from a missing one
+		messageIDs := []byte{}
+		for _, id := range ids {
+			if id < 0 || id > 0xff {
+				return fmt.Errorf("%d is not a message ID", id)
+			}
+
+			messageIDs = append(messageIDs, byte(id))
+		}
+
+		field.Set(reflect.ValueOf(messageIDs))
+
+	default:
+		return json.Unmarshal(value, field.Addr().Interface())
+	}
+
+	return nil
+}
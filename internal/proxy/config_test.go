@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "phantom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "phantom.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrefs(t *testing.T) {
+	path := writeConfig(t, `{
+		"server": "play.example.com:19132",
+		"idle_timeout": "5m",
+		"pong_cache_ttl": "30s",
+		"pong_overrides": {"MOTD": "Hello"},
+		"drop_message_ids": [254]
+	}`)
+
+	prefs, err := LoadPrefs(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "play.example.com:19132", prefs.RemoteServer)
+	assert.Equal(t, 5*time.Minute, prefs.IdleTimeout)
+	assert.Equal(t, 30*time.Second, prefs.PongCacheTTL)
+	assert.Equal(t, "Hello", proto.Pong{}.Override(prefs.PongOverrides).MOTD)
+	assert.Equal(t, []byte{0xfe}, prefs.DropMessageIDs)
+
+	// Defaults match the command line
+	assert.Equal(t, "0.0.0.0", prefs.BindAddress)
+	assert.Equal(t, uint(1), prefs.NumWorkers)
+}
+
+func TestLoadPrefsInvalid(t *testing.T) {
+	_, err := LoadPrefs(writeConfig(t, `{"idle_timeout": "5 minutes"}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "idle_timeout")
+
+	_, err = LoadPrefs(writeConfig(t, `{"idle_timout": "5m"}`))
+	assert.Error(t, err)
+
+	_, err = LoadPrefs(writeConfig(t, `{"drop_message_ids": [256]}`))
+	assert.Error(t, err)
+
+	_, err = LoadPrefs(writeConfig(t, `{"handshake_exempt_ids": [-1]}`))
+	assert.Error(t, err)
+
+	_, err = LoadPrefs(writeConfig(t, `{"max_connections": "10"}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "max_connections")
+
+	// Options only settable from code have no key
+	_, err = LoadPrefs(writeConfig(t, `{"ListenConn": null}`))
+	assert.Error(t, err)
+}
+
+func TestLoadPrefsEmptyList(t *testing.T) {
+	prefs, err := LoadPrefs(writeConfig(t, `{"handshake_exempt_ids": []}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, prefs.HandshakeExemptIDs)
+	assert.Len(t, prefs.HandshakeExemptIDs, 0)
+
+	prefs, err = LoadPrefs(writeConfig(t, `{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, prefs.HandshakeExemptIDs)
+}
+
+// Every option has a config file key, or is marked as settable only from code
+func TestConfigKeysCoverPrefs(t *testing.T) {
+	prefsType := reflect.TypeOf(ProxyPrefs{})
+	keys := map[string]string{}
+
+	for i := 0; i < prefsType.NumField(); i++ {
+		field := prefsType.Field(i)
+		key := field.Tag.Get("json")
+		assert.NotEmpty(t, key, "%s has no json tag", field.Name)
+
+		if key != "-" {
+			assert.Empty(t, keys[key], "%s and %s share the key %s", keys[key], field.Name, key)
+			keys[key] = field.Name
+		}
+	}
+
+	assert.Equal(t, len(keys), len(configFields()))
+}
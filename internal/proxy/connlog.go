@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+)
+
+// Number of rotated connection logs kept, as .1 (newest) to .N (oldest)
+const connLogBackups = 5
+
+// ConnRecord is a completed connection, written as a line of JSON to the
+// ConnLogPath file
+type ConnRecord struct {
+	ID              string    `json:"id"`
+	Client          string    `json:"client"`
+	Server          string    `json:"server"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	BytesFromClient uint64    `json:"bytes_from_client"`
+	BytesFromServer uint64    `json:"bytes_from_server"`
+}
+
+// connLog appends a record of each completed connection to a file. Once the
+// file would grow past maxBytes it is rotated, keeping connLogBackups old
+// files. With no limit, the file can be rotated by an external tool instead,
+// and reopened with reopen().
+type connLog struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	mutex    *sync.Mutex
+}
+
+// Opens the connection log at the path, appending to it if it exists
+func newConnLog(path string, maxBytes int64) (*connLog, error) {
+	connLog := &connLog{
+		path,
+		maxBytes,
+		nil,
+		0,
+		&sync.Mutex{},
+	}
+
+	if err := connLog.open(); err != nil {
+		return nil, err
+	}
+
+	return connLog, nil
+}
+
+// Opens the file at the path. Must be called with the mutex held.
+func (connLog *connLog) open() error {
+	file, err := os.OpenFile(connLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	connLog.file = file
+	connLog.size = info.Size()
+	return nil
+}
+
+// Appends the record, rotating the file first if it would grow too large
+func (connLog *connLog) write(record ConnRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	connLog.mutex.Lock()
+	defer connLog.mutex.Unlock()
+
+	if connLog.file == nil {
+		return os.ErrClosed
+	}
+
+	if connLog.maxBytes > 0 && connLog.size > 0 && connLog.size+int64(len(line)) > connLog.maxBytes {
+		if err := connLog.rotate(); err != nil {
+			return err
+		}
+	}
+
+	written, err := connLog.file.Write(line)
+	connLog.size += int64(written)
+	return err
+}
+
+// Shifts the rotated files along, dropping the oldest, moves the current file
+// to .1 and starts a new one. Must be called with the mutex held.
+func (connLog *connLog) rotate() error {
+	connLog.file.Close()
+	connLog.file = nil
+
+	for i := connLogBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", connLog.path, i), fmt.Sprintf("%s.%d", connLog.path, i+1))
+	}
+
+	if err := os.Rename(connLog.path, connLog.path+".1"); err != nil {
+		log.Warn().Msgf("Failed to rotate connection log %s: %v", connLog.path, err)
+	}
+
+	return connLog.open()
+}
+
+// Closes and reopens the file at the path, for after it has been moved away
+// by an external tool such as logrotate
+func (connLog *connLog) reopen() error {
+	connLog.mutex.Lock()
+	defer connLog.mutex.Unlock()
+
+	if connLog.file != nil {
+		connLog.file.Close()
+		connLog.file = nil
+	}
+
+	return connLog.open()
+}
+
+func (connLog *connLog) Close() error {
+	connLog.mutex.Lock()
+	defer connLog.mutex.Unlock()
+
+	if connLog.file == nil {
+		return nil
+	}
+
+	err := connLog.file.Close()
+	connLog.file = nil
+	return err
+}
+
+// Records a completed connection if there is a connection log
+func (proxy *ProxyServer) logConnection(conn *clientmap.ServerConn) {
+	if proxy.connLog == nil {
+		return
+	}
+
+	info := conn.Info()
+	record := ConnRecord{
+		info.ID,
+		info.Client.String(),
+		info.Server.String(),
+		info.ConnectedAt,
+		time.Now(),
+		info.BytesFromClient,
+		info.BytesFromServer,
+	}
+
+	if err := proxy.connLog.write(record); err != nil {
+		log.Warn().Msgf("Failed to write to connection log %s: %v", proxy.prefs.ConnLogPath, err)
+	}
+}
+
+// ReopenConnLog closes and reopens the ConnLogPath file, so that logging
+// continues in a new file after an external tool has rotated the old one. It
+// does nothing without a connection log.
+func (proxy *ProxyServer) ReopenConnLog() error {
+	if proxy.connLog == nil {
+		return nil
+	}
+
+	log.Info().Msgf("Reopening connection log: %s", proxy.prefs.ConnLogPath)
+	return proxy.connLog.reopen()
+}
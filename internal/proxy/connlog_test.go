@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func readConnRecords(t *testing.T, path string) []ConnRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []ConnRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record ConnRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestConnLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+
+	// Room for about two records per file
+	connLog, err := newConnLog(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connLog.Close()
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, connLog.write(ConnRecord{ID: fmt.Sprintf("%08d", i), Client: "127.0.0.1:1234"}))
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, files, connLogBackups+1)
+
+	for _, file := range files {
+		assert.True(t, file.Size() <= 400, file.Name())
+	}
+
+	// The newest record is in the current file, the ones before it rotated out
+	records := readConnRecords(t, path)
+	assert.Equal(t, "00000019", records[len(records)-1].ID)
+
+	rotated := readConnRecords(t, path+".1")
+	assert.Equal(t, fmt.Sprintf("%08d", 20-len(records)), records[0].ID)
+	assert.Equal(t, fmt.Sprintf("%08d", 19-len(records)), rotated[len(rotated)-1].ID)
+}
+
+func TestConnLogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+
+	connLog, err := newConnLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, connLog.write(ConnRecord{ID: "first"}))
+
+	// As logrotate would
+	assert.Nil(t, os.Rename(path, path+".old"))
+	assert.Nil(t, connLog.reopen())
+	assert.Nil(t, connLog.write(ConnRecord{ID: "second"}))
+
+	assert.Equal(t, "first", readConnRecords(t, path+".old")[0].ID)
+	assert.Equal(t, "second", readConnRecords(t, path)[0].ID)
+
+	assert.Nil(t, connLog.Close())
+	assert.NotNil(t, connLog.write(ConnRecord{ID: "third"}))
+}
+
+func TestConnLog(t *testing.T) {
+	server := startFakeServer(t)
+	path := filepath.Join(t.TempDir(), "connections.log")
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		ConnLogPath:  path,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	connID := proxyServer.clientMap.Snapshot()[0].ID
+	proxyServer.clientMap.Delete(client.LocalAddr())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(contents), "\n") {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	records := readConnRecords(t, path)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, connID, records[0].ID)
+		assert.Equal(t, client.LocalAddr().String(), records[0].Client)
+		assert.Equal(t, server.addr(), records[0].Server)
+		assert.Equal(t, uint64(4), records[0].BytesFromClient)
+		assert.False(t, records[0].End.Before(records[0].Start))
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// Sets the Don't Fragment bit on the socket's packets, so that packets larger
+// than the path MTU are dropped rather than fragmented
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
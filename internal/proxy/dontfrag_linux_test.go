@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDontFragment(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Nil(t, setDontFragment(conn, false))
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var discover int
+	_ = rawConn.Control(func(fd uintptr) {
+		discover, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.IP_PMTUDISC_DO, discover)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Setting the Don't Fragment bit is only implemented on Linux and Windows
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	return errors.New("Don't Fragment is not supported on this platform")
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// IP_DONTFRAGMENT and IPV6_DONTFRAG, which the syscall package does not define
+const sockoptDontFragment = 14
+
+// Sets the Don't Fragment bit on the socket's packets, so that packets larger
+// than the path MTU are dropped rather than fragmented
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	level := syscall.IPPROTO_IP
+	if ipv6 {
+		level = syscall.IPPROTO_IPV6
+	}
+
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), level, sockoptDontFragment, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+)
+
+// Marks the server, given by name or address, as draining or not, and returns
+// its address, or nil if it isn't one of the servers
+func (backends *backendSet) setDraining(server string, draining bool) *net.UDPAddr {
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+
+	for i, addr := range backends.addrs {
+		if server == backends.names[i] || server == addr.String() {
+			backends.draining[i] = draining
+			return addr
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the server is draining
+func (backends *backendSet) isDraining(addr *net.UDPAddr) bool {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	for i, other := range backends.addrs {
+		if other.String() == addr.String() {
+			return backends.draining[i]
+		}
+	}
+
+	return false
+}
+
+// DrainBackend takes one of RemoteServer or the FallbackServers, by name or
+// address, out of rotation for maintenance: new clients skip it as if it were
+// unhealthy, until ResumeBackend is called. With DrainGracePeriod, the
+// connections still on it afterwards are closed so that their players
+// reconnect to another server.
+func (proxy *ProxyServer) DrainBackend(server string) error {
+	addr := proxy.backends.setDraining(server, true)
+	if addr == nil {
+		return fmt.Errorf("%s is not one of the servers", server)
+	}
+
+	grace := proxy.prefs.DrainGracePeriod
+	if grace <= 0 {
+		log.Info().Msgf("Draining server %s", addr)
+		return nil
+	}
+
+	log.Info().Msgf("Draining server %s, closing its connections in %v", addr, grace)
+
+	proxy.goLoop(func() {
+		select {
+		case <-proxy.stop:
+			return
+		case <-time.After(grace):
+		}
+
+		if proxy.backends.isDraining(addr) {
+			closed := proxy.closeConnectionsTo(addr)
+			log.Info().Msgf("Closed %d remaining connections to drained server %s", closed, addr)
+		}
+	})
+
+	return nil
+}
+
+// ResumeBackend puts a server taken out of rotation by DrainBackend back in
+func (proxy *ProxyServer) ResumeBackend(server string) error {
+	addr := proxy.backends.setDraining(server, false)
+	if addr == nil {
+		return fmt.Errorf("%s is not one of the servers", server)
+	}
+
+	log.Info().Msgf("Resuming server %s", addr)
+	return nil
+}
+
+// Closes every connection to the server and returns how many were closed
+func (proxy *ProxyServer) closeConnectionsTo(server *net.UDPAddr) int {
+	var clients []net.Addr
+	proxy.clientMap.Range(func(conn *clientmap.ServerConn) bool {
+		if info := conn.Info(); info.Server.String() == server.String() {
+			clients = append(clients, info.Client)
+		}
+
+		return true
+	})
+
+	for _, client := range clients {
+		proxy.clientMap.Delete(client)
+	}
+
+	return len(clients)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainBackend(t *testing.T) {
+	primary := startFakeServer(t)
+	fallback := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:     primary.addr(),
+		FallbackServers:  []string{fallback.addr()},
+		DrainGracePeriod: 100 * time.Millisecond,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// New clients skip the drained server
+	assert.Nil(t, proxyServer.DrainBackend(primary.addr()))
+	assert.Equal(t, fallback.addr(), proxyServer.RemoteAddr().String())
+	assert.True(t, proxyServer.Stats().Backends[0].Draining)
+
+	// And its connections are closed after the grace period
+	waitForConnections(t, proxyServer, 0)
+
+	assert.Nil(t, proxyServer.ResumeBackend(primary.addr()))
+	assert.Equal(t, primary.addr(), proxyServer.RemoteAddr().String())
+	assert.False(t, proxyServer.Stats().Backends[0].Draining)
+
+	assert.NotNil(t, proxyServer.DrainBackend("127.0.0.1:1"))
+}
+
+func TestHandleBackends(t *testing.T) {
+	primary := startFakeServer(t)
+	fallback := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:    primary.addr(),
+		FallbackServers: []string{fallback.addr()},
+	})
+
+	// Draining is refused from other hosts without an admin token
+	recorder := httptest.NewRecorder()
+	proxyServer.handleBackends(recorder, httptest.NewRequest("POST", "/backends?server="+primary.addr(), nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.False(t, proxyServer.Stats().Backends[0].Draining)
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBackends(recorder, localRequest("POST", "/backends?server="+primary.addr()))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, proxyServer.Stats().Backends[0].Draining)
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBackends(recorder, localRequest("DELETE", "/backends?server="+primary.addr()))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.False(t, proxyServer.Stats().Backends[0].Draining)
+
+	// Anyone may list them
+	recorder = httptest.NewRecorder()
+	proxyServer.handleBackends(recorder, httptest.NewRequest("GET", "/backends", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Longest a packet to a client is held back by TotalEgressBytesPerSec before
+// it is dropped instead
+const maxEgressDelay = 250 * time.Millisecond
+
+// Share of the rate allowed right at the start of a ramp up
+const minRampFraction = 0.1
+
+// tokenBucket limits a byte rate, allowing bursts of up to one second's worth
+// of bytes. With a ramp up, the rate and the burst start at a tenth and grow
+// to the full rate over the ramp, so that a storm of reconnects right after
+// startup doesn't slam into the limit all at once.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	start  time.Time
+	ramp   time.Duration
+	mutex  *sync.Mutex
+}
+
+func newTokenBucket(bytesPerSec int, ramp time.Duration) *tokenBucket {
+	now := time.Now()
+	bucket := &tokenBucket{
+		float64(bytesPerSec),
+		0,
+		now,
+		now,
+		ramp,
+		&sync.Mutex{},
+	}
+
+	_, bucket.tokens = bucket.limits(now)
+	return bucket
+}
+
+// Returns the rate and burst allowed at the time
+func (bucket *tokenBucket) limits(now time.Time) (float64, float64) {
+	rate := bucket.rate
+	if elapsed := now.Sub(bucket.start); bucket.ramp > 0 && elapsed < bucket.ramp {
+		fraction := elapsed.Seconds() / bucket.ramp.Seconds()
+		if fraction < minRampFraction {
+			fraction = minRampFraction
+		}
+
+		rate *= fraction
+	}
+
+	// Always allow a full packet through
+	burst := rate
+	if burst < maxMTU {
+		burst = maxMTU
+	}
+
+	return rate, burst
+}
+
+// Reserves the bytes and returns how long to wait before sending them. If
+// that would be longer than maxWait, nothing is reserved and false is
+// returned.
+func (bucket *tokenBucket) reserve(bytes int, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	rate, burst := bucket.limits(now)
+
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.last = now
+	}
+
+	needed := float64(bytes)
+	if bucket.tokens >= needed {
+		bucket.tokens -= needed
+		return 0, true
+	}
+
+	wait := time.Duration((needed - bucket.tokens) / rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+
+	bucket.tokens -= needed
+	return wait, true
+}
+
+// Waits until TotalEgressBytesPerSec allows sending the bytes to a client.
+// Returns false if the packet should be dropped because the wait would be
+// too long.
+func (proxy *ProxyServer) waitForEgress(bytes int) bool {
+	if proxy.egress == nil {
+		return true
+	}
+
+	wait, ok := proxy.egress.reserve(bytes, time.Now(), maxEgressDelay)
+	if !ok {
+		proxy.counters().dropped()
+		return false
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return true
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10000, 0)
+	now := bucket.last
+
+	// A second's worth goes through right away
+	wait, ok := bucket.reserve(10000, now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// Then senders wait their turn
+	wait, ok = bucket.reserve(1000, now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	wait, ok = bucket.reserve(1000, now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, wait)
+
+	// Waits that are too long are refused without reserving anything
+	_, ok = bucket.reserve(1000, now, 250*time.Millisecond)
+	assert.False(t, ok)
+
+	// Tokens refill over time
+	wait, ok = bucket.reserve(1000, now.Add(400*time.Millisecond), time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+}
+
+func TestTokenBucketRampUp(t *testing.T) {
+	bucket := newTokenBucket(1000000, 10*time.Second)
+	now := bucket.start
+
+	// Only a tenth of the rate is allowed at first
+	wait, ok := bucket.reserve(100000, now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, ok = bucket.reserve(10000, now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	// Halfway through, half of it
+	rate, burst := bucket.limits(now.Add(5 * time.Second))
+	assert.Equal(t, 500000.0, rate)
+	assert.Equal(t, 500000.0, burst)
+
+	wait, ok = bucket.reserve(500000, now.Add(5*time.Second), time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// And all of it once the ramp is over
+	rate, _ = bucket.limits(now.Add(time.Minute))
+	assert.Equal(t, 1000000.0, rate)
+}
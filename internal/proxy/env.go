@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Environment variables read by PrefsFromEnv. Durations are either seconds,
+// like the command line, or strings such as "30s" or "5m".
+const (
+	envBindAddress        = "PHANTOM_BIND"
+	envBindPort           = "PHANTOM_BIND_PORT"
+	envRemoteServer       = "PHANTOM_SERVER"
+	envIdleTimeout        = "PHANTOM_TIMEOUT"
+	envConnectTimeout     = "PHANTOM_CONNECT_TIMEOUT"
+	envBackendIdleTimeout = "PHANTOM_SERVER_TIMEOUT"
+	envEnableIPv6         = "PHANTOM_IPV6"
+	envIPv6Only           = "PHANTOM_IPV6_ONLY"
+)
+
+// PrefsFromEnv returns the ProxyPrefs set by PHANTOM_* environment variables,
+// for container deployments. Variables that aren't set, or can't be parsed,
+// leave their field zero.
+func PrefsFromEnv() ProxyPrefs {
+	prefs := ProxyPrefs{
+		BindAddress:  os.Getenv(envBindAddress),
+		RemoteServer: os.Getenv(envRemoteServer),
+	}
+
+	if value := os.Getenv(envBindPort); value != "" {
+		if port, err := strconv.ParseUint(value, 10, 16); err != nil {
+			log.Warn().Msgf("Ignoring invalid %s %q: %v", envBindPort, value, err)
+		} else {
+			prefs.BindPort = uint16(port)
+		}
+	}
+
+	durations := []struct {
+		name string
+		dest *time.Duration
+	}{
+		{envIdleTimeout, &prefs.IdleTimeout},
+		{envConnectTimeout, &prefs.ConnectTimeout},
+		{envBackendIdleTimeout, &prefs.BackendIdleTimeout},
+	}
+
+	for _, duration := range durations {
+		value := os.Getenv(duration.name)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := parseEnvDuration(value)
+		if err != nil {
+			log.Warn().Msgf("Ignoring invalid %s %q: %v", duration.name, value, err)
+			continue
+		}
+
+		*duration.dest = parsed
+	}
+
+	bools := []struct {
+		name string
+		dest *bool
+	}{
+		{envEnableIPv6, &prefs.EnableIPv6},
+		{envIPv6Only, &prefs.IPv6Only},
+	}
+
+	for _, flag := range bools {
+		value := os.Getenv(flag.name)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Warn().Msgf("Ignoring invalid %s %q: %v", flag.name, value, err)
+			continue
+		}
+
+		*flag.dest = parsed
+	}
+
+	return prefs
+}
+
+// WithEnv returns the ProxyPrefs with the fields covered by PrefsFromEnv that
+// are zero filled in from the environment. Fields already set take precedence
+// over the environment, which in turn takes precedence over the defaults
+// applied by New.
+func (prefs ProxyPrefs) WithEnv() ProxyPrefs {
+	env := PrefsFromEnv()
+
+	if prefs.BindAddress == "" {
+		prefs.BindAddress = env.BindAddress
+	}
+	if prefs.BindPort == 0 {
+		prefs.BindPort = env.BindPort
+	}
+	if prefs.RemoteServer == "" {
+		prefs.RemoteServer = env.RemoteServer
+	}
+	if prefs.IdleTimeout == 0 {
+		prefs.IdleTimeout = env.IdleTimeout
+	}
+	if prefs.ConnectTimeout == 0 {
+		prefs.ConnectTimeout = env.ConnectTimeout
+	}
+	if prefs.BackendIdleTimeout == 0 {
+		prefs.BackendIdleTimeout = env.BackendIdleTimeout
+	}
+
+	prefs.EnableIPv6 = prefs.EnableIPv6 || env.EnableIPv6
+	prefs.IPv6Only = prefs.IPv6Only || env.IPv6Only
+
+	return prefs
+}
+
+// Parses seconds, or a duration string such as "30s"
+func parseEnvDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setEnv(t *testing.T, name, value string) {
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestPrefsFromEnv(t *testing.T) {
+	setEnv(t, "PHANTOM_SERVER", "play.example.com:19132")
+	setEnv(t, "PHANTOM_BIND_PORT", "19200")
+	setEnv(t, "PHANTOM_TIMEOUT", "30")
+	setEnv(t, "PHANTOM_CONNECT_TIMEOUT", "5s")
+	setEnv(t, "PHANTOM_SERVER_TIMEOUT", "forever")
+	setEnv(t, "PHANTOM_IPV6", "true")
+
+	prefs := PrefsFromEnv()
+	assert.Equal(t, "play.example.com:19132", prefs.RemoteServer)
+	assert.Equal(t, uint16(19200), prefs.BindPort)
+	assert.Equal(t, 30*time.Second, prefs.IdleTimeout)
+	assert.Equal(t, 5*time.Second, prefs.ConnectTimeout)
+	assert.True(t, prefs.EnableIPv6)
+
+	// Invalid values are ignored
+	assert.Equal(t, time.Duration(0), prefs.BackendIdleTimeout)
+
+	// Fields already set win over the environment
+	prefs = ProxyPrefs{RemoteServer: "1.2.3.4:19132", IdleTimeout: time.Minute}.WithEnv()
+	assert.Equal(t, "1.2.3.4:19132", prefs.RemoteServer)
+	assert.Equal(t, time.Minute, prefs.IdleTimeout)
+	assert.Equal(t, uint16(19200), prefs.BindPort)
+	assert.Equal(t, 5*time.Second, prefs.ConnectTimeout)
+	assert.Equal(t, "", prefs.BindAddress)
+}
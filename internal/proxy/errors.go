@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// ClientError is a non-fatal error that occurred while proxying traffic for
+// a specific client.
+type ClientError struct {
+	Client net.Addr
+	Err    error
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("client %s: %v", e.Client, e.Err)
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+// BindError is returned by Start when a port phantom needs to listen on is
+// already taken by another process.
+type BindError struct {
+	Port int
+	Err  error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf(
+		"Port %d is already in use, most likely by another program such as a Minecraft server running on this device: %v",
+		e.Port,
+		e.Err,
+	)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps an error from binding the given port in a BindError if it was caused
+// by the port being in use
+func wrapBindError(err error, port int) error {
+	if isAddrInUse(err) {
+		return &BindError{port, err}
+	}
+
+	return err
+}
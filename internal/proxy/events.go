@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+)
+
+// Types of Event
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+)
+
+// Number of events queued for a reader before further events are dropped for
+// that reader
+const eventQueueSize = 64
+
+// Event is a change to the connections of the proxy, streamed as a line of
+// JSON to readers of the EventSocketPath socket
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Server string    `json:"server"`
+	// ID of the connection, as tagged on its log lines
+	ConnID string `json:"conn_id"`
+}
+
+// eventStream sends events to every reader connected to a Unix socket. Each
+// reader has its own queue, so a slow reader only misses events itself.
+type eventStream struct {
+	listener net.Listener
+	readers  map[*eventReader]bool
+	closed   bool
+	mutex    *sync.Mutex
+}
+
+type eventReader struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+// Listens on a Unix socket at the path, replacing a socket left behind by a
+// previous run
+func newEventStream(path string) (*eventStream, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventStream{
+		listener,
+		make(map[*eventReader]bool),
+		false,
+		&sync.Mutex{},
+	}, nil
+}
+
+// Accepts readers until the stream is closed
+func (events *eventStream) serve() {
+	for {
+		conn, err := events.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		reader := &eventReader{conn, make(chan []byte, eventQueueSize)}
+
+		events.mutex.Lock()
+		if events.closed {
+			events.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		events.readers[reader] = true
+		events.mutex.Unlock()
+
+		go events.write(reader)
+	}
+}
+
+// Sends queued events to a reader until it goes away or the stream is closed
+func (events *eventStream) write(reader *eventReader) {
+	for line := range reader.queue {
+		if _, err := reader.conn.Write(line); err != nil {
+			log.Debug().Msgf("Event reader went away: %v", err)
+			events.remove(reader)
+		}
+	}
+
+	reader.conn.Close()
+}
+
+func (events *eventStream) remove(reader *eventReader) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	if events.readers[reader] {
+		delete(events.readers, reader)
+		close(reader.queue)
+	}
+}
+
+// Queues an event for every reader without blocking
+func (events *eventStream) publish(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Warn().Msgf("Failed to encode event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	for reader := range events.readers {
+		select {
+		case reader.queue <- line:
+		default:
+			log.Debug().Msgf("Dropping %s event for slow event reader", event.Type)
+		}
+	}
+}
+
+func (events *eventStream) Close() error {
+	events.mutex.Lock()
+	events.closed = true
+	for reader := range events.readers {
+		delete(events.readers, reader)
+		close(reader.queue)
+	}
+	events.mutex.Unlock()
+
+	return events.listener.Close()
+}
+
+// Publishes an event for a connection if there is an event stream
+func (proxy *ProxyServer) publishEvent(eventType string, conn *clientmap.ServerConn) {
+	if proxy.events == nil {
+		return
+	}
+
+	info := conn.Info()
+	proxy.events.publish(Event{eventType, time.Now(), info.Client.String(), info.Server.String(), info.ID})
+}
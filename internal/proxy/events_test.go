@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialEvents(t *testing.T, path string) net.Conn {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readEvent(t *testing.T, conn net.Conn, reader *bufio.Reader) Event {
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event Event
+	if err := json.Unmarshal(line, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func TestEventSocket(t *testing.T) {
+	server := startFakeServer(t)
+	path := filepath.Join(t.TempDir(), "events.sock")
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:    server.addr(),
+		EventSocketPath: path,
+	})
+
+	readers := []net.Conn{dialEvents(t, path), dialEvents(t, path)}
+	// Let the stream accept both readers
+	time.Sleep(50 * time.Millisecond)
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	proxyServer.clientMap.Delete(client.LocalAddr())
+
+	for _, conn := range readers {
+		reader := bufio.NewReader(conn)
+
+		event := readEvent(t, conn, reader)
+		assert.Equal(t, EventConnect, event.Type)
+		assert.Equal(t, client.LocalAddr().String(), event.Client)
+		assert.Equal(t, server.addr(), event.Server)
+		assert.Len(t, event.ConnID, 8)
+		connID := event.ConnID
+
+		event = readEvent(t, conn, reader)
+		assert.Equal(t, EventDisconnect, event.Type)
+		assert.Equal(t, client.LocalAddr().String(), event.Client)
+		assert.Equal(t, connID, event.ConnID)
+	}
+}
+
+func TestEventStreamDropsForSlowReader(t *testing.T) {
+	events, err := newEventStream(filepath.Join(t.TempDir(), "events.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+
+	// A reader that is never drained
+	reader := &eventReader{nil, make(chan []byte, eventQueueSize)}
+	events.readers[reader] = true
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for i := 0; i < eventQueueSize+10; i++ {
+		events.publish(Event{EventConnect, time.Now(), client.String(), client.String(), "0123abcd"})
+	}
+
+	assert.Len(t, reader.queue, eventQueueSize)
+}
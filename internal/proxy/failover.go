@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often the servers are resolved again while there are fallback servers
+const backendRefreshInterval = 5 * time.Minute
+
+// backendSet holds RemoteServer and the FallbackServers resolved ahead of
+// time, so that failing over is only a swap of addresses, without a DNS
+// lookup in the middle of an outage. The addresses are resolved again
+// periodically to follow DNS changes. With health checks, servers that fail
+// unhealthyAfter checks in a row are skipped until one succeeds, as are
+// servers drained with DrainBackend.
+type backendSet struct {
+	// Index of the server new clients are connected to, accessed atomically
+	active     int32
+	names      []string
+	preferIPv6 bool
+	addrs      []*net.UDPAddr
+	// Consecutive failed health checks, the last round trip time and the
+	// last failed check of each server
+	failures       []int
+	rtts           []time.Duration
+	lastFailures   []time.Time
+	unhealthyAfter int
+	// Whether every server is unhealthy
+	allDown bool
+	// Whether each server is taken out of rotation
+	draining []bool
+	mutex    *sync.RWMutex
+}
+
+// Creates the set from the already resolved primary server and resolves the
+// fallbacks
+func newBackendSet(primaryName string, primary *net.UDPAddr, fallbacks []string, preferIPv6 bool, unhealthyAfter int) (*backendSet, error) {
+	names := []string{primaryName}
+	addrs := []*net.UDPAddr{primary}
+
+	for _, name := range fallbacks {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		addr, err := resolveServerAddress(name, preferIPv6)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+		addrs = append(addrs, addr)
+	}
+
+	if unhealthyAfter <= 0 {
+		unhealthyAfter = defaultHealthCheckFailures
+	}
+
+	return &backendSet{
+		0,
+		names,
+		preferIPv6,
+		addrs,
+		make([]int, len(addrs)),
+		make([]time.Duration, len(addrs)),
+		make([]time.Time, len(addrs)),
+		unhealthyAfter,
+		false,
+		make([]bool, len(addrs)),
+		&sync.RWMutex{},
+	}, nil
+}
+
+// Returns the server new clients are connected to: the active one, or if it
+// is unhealthy or draining, the next healthy one after it. If none are
+// healthy, it is the one whose last failed health check was longest ago,
+// preferring servers that aren't draining. Servers are checked in parallel,
+// so failures within healthCheckTimeout of each other are ties, won by the
+// server configured first.
+func (backends *backendSet) current() *net.UDPAddr {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	active := int(atomic.LoadInt32(&backends.active))
+	for i := range backends.addrs {
+		index := (active + i) % len(backends.addrs)
+		if backends.failures[index] < backends.unhealthyAfter && !backends.draining[index] {
+			return backends.addrs[index]
+		}
+	}
+
+	leastRecent := -1
+	for i, lastFailure := range backends.lastFailures {
+		if backends.draining[i] {
+			continue
+		}
+
+		if leastRecent < 0 || lastFailure.Add(healthCheckTimeout).Before(backends.lastFailures[leastRecent]) {
+			leastRecent = i
+		}
+	}
+
+	// With every server draining, the active one is used anyway
+	if leastRecent < 0 {
+		leastRecent = active
+	}
+
+	return backends.addrs[leastRecent]
+}
+
+// Returns all servers, the primary first
+func (backends *backendSet) all() []*net.UDPAddr {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	return append([]*net.UDPAddr(nil), backends.addrs...)
+}
+
+// Moves on to the next server if the failed one is the current one, and
+// returns whether it did. Failures of servers already failed over from are
+// ignored, so that a burst of failures only moves on once.
+func (backends *backendSet) failover(failed net.Addr) bool {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	if len(backends.addrs) < 2 || failed == nil {
+		return false
+	}
+
+	active := atomic.LoadInt32(&backends.active)
+	if failed.String() != backends.addrs[active].String() {
+		return false
+	}
+
+	next := (active + 1) % int32(len(backends.addrs))
+	if !atomic.CompareAndSwapInt32(&backends.active, active, next) {
+		return false
+	}
+
+	log.Warn().Msgf("Server %s failed, failing over to %s", failed, backends.addrs[next])
+	return true
+}
+
+// Resolves every server again, keeping the previous address of any that
+// fails to resolve or whose new address validate rejects
+func (backends *backendSet) refresh(validate func(*net.UDPAddr) error) {
+	resolved := make([]*net.UDPAddr, len(backends.names))
+	for i, name := range backends.names {
+		addr, err := lookupServerAddress(name, backends.preferIPv6)
+		if err != nil {
+			log.Warn().Msgf("Failed to resolve server %s again: %v", name, err)
+			continue
+		}
+
+		if err := validate(addr); err != nil {
+			log.Warn().Msgf("Ignoring new address of server %s: %v", name, err)
+			continue
+		}
+
+		resolved[i] = addr
+	}
+
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+
+	for i, addr := range resolved {
+		if addr == nil || addr.String() == backends.addrs[i].String() {
+			continue
+		}
+
+		log.Info().Msgf("Server %s now resolves to %s", backends.names[i], addr)
+		backends.addrs[i] = addr
+	}
+}
+
+// Resolves the servers again periodically until the ProxyServer has been
+// closed
+func (proxy *ProxyServer) refreshBackendsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+			proxy.backends.refresh(proxy.validateBackend)
+		}
+	}
+}
+
+// Returns an error if a server resolved after startup must not be used, as
+// New checks at startup: if it isn't one of the AllowedBackends or it would
+// loop packets back to phantom
+func (proxy *ProxyServer) validateBackend(server *net.UDPAddr) error {
+	if !proxy.allowedBackends.allows(server) {
+		return fmt.Errorf("%s is not an allowed backend", server)
+	}
+
+	bindAddress := *proxy.bindAddress
+	bindAddress.Port = int(proxy.BoundPort())
+
+	return checkLoop(server, listenAddrs(proxy.prefs, &bindAddress, proxy.pingBindAddrs))
+}
+
+// RemoteAddrs returns the resolved addresses of RemoteServer followed by the
+// FallbackServers, as cached for failing over
+func (proxy *ProxyServer) RemoteAddrs() []*net.UDPAddr {
+	return proxy.backends.all()
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendSetFailover(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	backends, err := newBackendSet("127.0.0.1:1", primary, []string{"127.0.0.1:2", " 127.0.0.1:3 ", ""}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := backends.all()
+	if assert.Len(t, all, 3) {
+		assert.Equal(t, "127.0.0.1:1", all[0].String())
+		assert.Equal(t, "127.0.0.1:2", all[1].String())
+		assert.Equal(t, "127.0.0.1:3", all[2].String())
+	}
+
+	assert.Equal(t, primary, backends.current())
+
+	// Only a failure of the current server moves on
+	assert.False(t, backends.failover(all[2]))
+	assert.True(t, backends.failover(primary))
+	assert.False(t, backends.failover(primary))
+	assert.Equal(t, all[1], backends.current())
+
+	// Wrapping around to the primary after the last one
+	assert.True(t, backends.failover(all[1]))
+	assert.True(t, backends.failover(all[2]))
+	assert.Equal(t, primary, backends.current())
+
+	_, err = newBackendSet("127.0.0.1:1", primary, []string{"nope"}, false, 0)
+	assert.NotNil(t, err)
+}
+
+func TestBackendSetRefresh(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	backends, err := newBackendSet("127.0.0.1:1", primary, []string{"127.0.0.1:2"}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the name resolved elsewhere at startup
+	backends.addrs[1] = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2}
+	backends.refresh(func(*net.UDPAddr) error { return nil })
+
+	assert.Equal(t, "127.0.0.1:2", backends.all()[1].String())
+
+	// New addresses that fail validation are ignored
+	backends.addrs[1] = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2}
+	backends.refresh(func(addr *net.UDPAddr) error {
+		return fmt.Errorf("%s is not an allowed backend", addr)
+	})
+
+	assert.Equal(t, "10.0.0.1:2", backends.all()[1].String())
+
+	// With a single server there is nothing to fail over to
+	alone, err := newBackendSet("127.0.0.1:1", primary, nil, false, 0)
+	assert.Nil(t, err)
+	assert.False(t, alone.failover(primary))
+}
+
+func TestValidateBackend(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:     "127.0.0.1",
+		BindPort:        19200,
+		RemoteServer:    "127.0.0.1:19201",
+		AllowedBackends: []string{"127.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	assert.Nil(t, proxyServer.validateBackend(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19202}))
+
+	err = proxyServer.validateBackend(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 19132})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "not an allowed backend")
+	}
+
+	err = proxyServer.validateBackend(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19200})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "loop")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// A server that is down refuses every connection
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	fallback := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:    closed.LocalAddr().String(),
+		FallbackServers: []string{fallback.addr()},
+	})
+
+	assert.Len(t, proxyServer.RemoteAddrs(), 2)
+	assert.Equal(t, closed.LocalAddr().String(), proxyServer.RemoteAddr().String())
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.RemoteAddr().String() != fallback.addr() {
+		if time.Now().After(deadline) {
+			t.Fatal("did not fail over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New clients go to the fallback server
+	client = dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for fallback.sourceCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("new client did not reach the fallback server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Starts a server that answers the first packet it receives and then goes
+// quiet, like a session with nothing to say
+func startQuietServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buffer := make([]byte, maxMTU)
+		read, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		conn.WriteTo(buffer[:read], addr)
+		for {
+			if _, _, err := conn.ReadFrom(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestQuietSessionIsNotAFailure(t *testing.T) {
+	quiet := startQuietServer(t)
+	fallback := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:       quiet.LocalAddr().String(),
+		FallbackServers:    []string{fallback.addr()},
+		BackendIdleTimeout: 100 * time.Millisecond,
+		BreakerThreshold:   1,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	buffer := make([]byte, maxMTU)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = client.Read(buffer)
+	assert.Nil(t, err)
+
+	// The server doesn't answer this one, so the session times out
+	_, err = client.Write([]byte{0x84, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 0)
+	assert.Equal(t, quiet.LocalAddr().String(), proxyServer.RemoteAddr().String())
+
+	// Nor does it count towards the circuit breaker
+	assert.False(t, proxyServer.Stats().BreakerOpen)
+}
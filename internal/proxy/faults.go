@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faultInjector simulates a lossy, high-latency network by randomly dropping
+// and delaying packets. It is meant for testing client resilience and is off
+// unless configured.
+type faultInjector struct {
+	dropProbability float64
+	latency         time.Duration
+	random          *rand.Rand
+	mutex           *sync.Mutex
+}
+
+func newFaultInjector(prefs ProxyPrefs) *faultInjector {
+	seed := prefs.FaultSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &faultInjector{
+		prefs.DropProbability,
+		prefs.AddedLatency,
+		rand.New(rand.NewSource(seed)),
+		&sync.Mutex{},
+	}
+}
+
+// Decides whether the next packet should be dropped
+func (faults *faultInjector) shouldDrop() bool {
+	if faults.dropProbability <= 0 {
+		return false
+	}
+
+	return faults.float64() < faults.dropProbability
+}
+
+// Returns a random number in [0, 1) from the seeded source
+func (faults *faultInjector) float64() float64 {
+	faults.mutex.Lock()
+	defer faults.mutex.Unlock()
+
+	return faults.random.Float64()
+}
+
+// Calls send with the packet once the added latency has passed, without
+// blocking the caller. The packet is copied, so the caller may reuse it.
+func (faults *faultInjector) delay(data []byte, send func([]byte)) {
+	if faults.latency <= 0 {
+		send(data)
+		return
+	}
+
+	delayed := make([]byte, len(data))
+	copy(delayed, data)
+
+	time.AfterFunc(faults.latency, func() {
+		send(delayed)
+	})
+}
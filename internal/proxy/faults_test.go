@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dropSequence(faults *faultInjector, n int) []bool {
+	drops := make([]bool, n)
+	for i := range drops {
+		drops[i] = faults.shouldDrop()
+	}
+
+	return drops
+}
+
+func TestFaultInjectorSeeded(t *testing.T) {
+	prefs := ProxyPrefs{DropProbability: 0.5, FaultSeed: 42}
+
+	first := dropSequence(newFaultInjector(prefs), 100)
+	second := dropSequence(newFaultInjector(prefs), 100)
+
+	assert.Equal(t, first, second)
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+}
+
+func TestFaultInjectorDisabled(t *testing.T) {
+	faults := newFaultInjector(ProxyPrefs{})
+
+	assert.NotContains(t, dropSequence(faults, 100), true)
+}
+
+func TestFaultInjectorAlwaysDrops(t *testing.T) {
+	faults := newFaultInjector(ProxyPrefs{DropProbability: 1})
+
+	assert.NotContains(t, dropSequence(faults, 100), false)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/jhead/phantom/internal/adminpb"
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Starts the gRPC admin server on the given address
+func (proxy *ProxyServer) startGRPCServer(addr string) error {
+	log.Info().Msgf("Binding gRPC admin server to: %s", addr)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	proxy.serveGRPC(listener)
+	return nil
+}
+
+// Serves the Admin service on the listener until the proxy is closed
+func (proxy *ProxyServer) serveGRPC(listener net.Listener) {
+	proxy.grpc = grpc.NewServer(grpc.UnaryInterceptor(proxy.authorizeGRPC))
+	adminpb.RegisterAdminServer(proxy.grpc, &grpcAdmin{proxy: proxy})
+
+	proxy.goLoop(func() {
+		if err := proxy.grpc.Serve(listener); err != nil {
+			log.Warn().Msgf("gRPC admin server stopped: %v", err)
+		}
+	})
+}
+
+// Methods of the Admin service that only read state, which anyone who can
+// reach the server may call, like GET requests to the admin HTTP server
+var grpcReadOnlyMethods = map[string]bool{
+	adminpb.Admin_Stats_FullMethodName:           true,
+	adminpb.Admin_ListConnections_FullMethodName: true,
+}
+
+// Refuses calls that change state unless they are allowed by checkAdmin, with
+// the token in the "authorization" metadata
+func (proxy *ProxyServer) authorizeGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if grpcReadOnlyMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	var authorization string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+
+	var ip net.IP
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = addrIP(p.Addr)
+	}
+
+	switch err := proxy.checkAdmin(authorization, ip); err {
+	case nil:
+		return handler(ctx, req)
+	case errInvalidAdminToken:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+}
+
+// Implements the Admin service defined in admin.proto
+type grpcAdmin struct {
+	adminpb.UnimplementedAdminServer
+	proxy *ProxyServer
+}
+
+func (admin *grpcAdmin) Stats(ctx context.Context, req *adminpb.StatsRequest) (*adminpb.StatsResponse, error) {
+	stats := admin.proxy.Stats()
+
+	res := &adminpb.StatsResponse{}
+	for _, metric := range metrics {
+		res.Metrics = append(res.Metrics, &adminpb.Metric{
+			Name:  metric.name,
+			Type:  metric.metricType,
+			Value: metric.value(stats),
+		})
+	}
+
+	return res, nil
+}
+
+func (admin *grpcAdmin) ListConnections(ctx context.Context, req *adminpb.ListConnectionsRequest) (*adminpb.ListConnectionsResponse, error) {
+	res := &adminpb.ListConnectionsResponse{}
+	admin.proxy.Range(func(info clientmap.ConnInfo) bool {
+		res.Connections = append(res.Connections, &adminpb.Connection{
+			Id:              info.ID,
+			Client:          info.Client.String(),
+			Server:          info.Server.String(),
+			ConnectedAt:     timestamppb.New(info.ConnectedAt),
+			BytesFromClient: info.BytesFromClient,
+			BytesFromServer: info.BytesFromServer,
+			LastActivity:    timestamppb.New(info.LastActivity),
+		})
+
+		return true
+	})
+
+	return res, nil
+}
+
+func (admin *grpcAdmin) Disconnect(ctx context.Context, req *adminpb.DisconnectRequest) (*adminpb.DisconnectResponse, error) {
+	if !admin.proxy.Disconnect(req.Client) {
+		return nil, status.Errorf(codes.NotFound, "no connection for %s", req.Client)
+	}
+
+	return &adminpb.DisconnectResponse{}, nil
+}
+
+func (admin *grpcAdmin) SetMaintenance(ctx context.Context, req *adminpb.SetMaintenanceRequest) (*adminpb.SetMaintenanceResponse, error) {
+	admin.proxy.SetMaintenance(req.Enabled)
+	return &adminpb.SetMaintenanceResponse{}, nil
+}
+
+func (admin *grpcAdmin) Reload(ctx context.Context, req *adminpb.ReloadRequest) (*adminpb.ReloadResponse, error) {
+	if err := admin.proxy.ReopenConnLog(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reopen connection log: %v", err)
+	}
+
+	return &adminpb.ReloadResponse{}, nil
+}
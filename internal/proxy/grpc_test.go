@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jhead/phantom/internal/adminpb"
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCAdmin(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer.serveGRPC(listener)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	admin := adminpb.NewAdminClient(conn)
+	ctx := context.Background()
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	connections, err := admin.ListConnections(ctx, &adminpb.ListConnectionsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, connections.Connections, 1)
+	assert.Equal(t, client.LocalAddr().String(), connections.Connections[0].Client)
+	assert.Equal(t, server.addr(), connections.Connections[0].Server)
+	assert.Equal(t, uint64(4), connections.Connections[0].BytesFromClient)
+
+	stats, err := admin.Stats(ctx, &adminpb.StatsRequest{})
+	assert.Nil(t, err)
+	values := map[string]float64{}
+	for _, metric := range stats.Metrics {
+		values[metric.Name] = metric.Value
+	}
+	assert.Equal(t, float64(1), values["phantom_connections"])
+	assert.Equal(t, float64(4), values["phantom_bytes_from_clients_total"])
+
+	_, err = admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Enabled: true})
+	assert.Nil(t, err)
+	assert.True(t, proxyServer.Stats().Maintenance)
+
+	_, err = admin.Disconnect(ctx, &adminpb.DisconnectRequest{Client: "127.0.0.1:1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = admin.Disconnect(ctx, &adminpb.DisconnectRequest{Client: connections.Connections[0].Id})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	// Without a connection log there is nothing to reopen
+	_, err = admin.Reload(ctx, &adminpb.ReloadRequest{})
+	assert.Nil(t, err)
+}
+
+func TestGRPCAdminAuthorization(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		AdminToken:   "secret",
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer.serveGRPC(listener)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	admin := adminpb.NewAdminClient(conn)
+	ctx := context.Background()
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Anyone may look
+	connections, err := admin.ListConnections(ctx, &adminpb.ListConnectionsRequest{})
+	assert.Nil(t, err)
+	id := connections.Connections[0].Id
+
+	// Changes need the token, even from localhost
+	_, err = admin.Disconnect(ctx, &adminpb.DisconnectRequest{Client: id})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	wrong := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer nope")
+	_, err = admin.SetMaintenance(wrong, &adminpb.SetMaintenanceRequest{Enabled: true})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.False(t, proxyServer.Stats().Maintenance)
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	_, err = admin.Disconnect(authorized, &adminpb.DisconnectRequest{Client: id})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
+
+func TestCheckAdmin(t *testing.T) {
+	proxyServer := &ProxyServer{}
+
+	// Without a token, only loopback IPs may make changes
+	assert.Nil(t, proxyServer.checkAdmin("", net.IPv4(127, 0, 0, 1)))
+	assert.Nil(t, proxyServer.checkAdmin("", net.IPv6loopback))
+	assert.Equal(t, errAdminNotLocal, proxyServer.checkAdmin("", net.IPv4(192, 0, 2, 1)))
+	assert.Equal(t, errAdminNotLocal, proxyServer.checkAdmin("", nil))
+
+	// With one, everyone needs it
+	proxyServer.prefs.AdminToken = "secret"
+	assert.Equal(t, errInvalidAdminToken, proxyServer.checkAdmin("", net.IPv4(127, 0, 0, 1)))
+	assert.Nil(t, proxyServer.checkAdmin("Bearer secret", net.IPv4(192, 0, 2, 1)))
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// handshakeLimiter caps how many new connections can wait on the server's
+// first reply at once, so that a storm of reconnects after a server restart
+// reaches the server a few at a time. Packets from new clients beyond the
+// limit are dropped, and their clients retry the handshake.
+type handshakeLimiter struct {
+	active int32
+	max    int32
+}
+
+func newHandshakeLimiter(max int) *handshakeLimiter {
+	return &handshakeLimiter{0, int32(max)}
+}
+
+// Takes a slot for a new connection, returning false if there is none free.
+// There is no limit without a maximum.
+func (limiter *handshakeLimiter) acquire() bool {
+	if limiter.max <= 0 {
+		return true
+	}
+
+	for {
+		active := atomic.LoadInt32(&limiter.active)
+		if active >= limiter.max {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&limiter.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+func (limiter *handshakeLimiter) release() {
+	if limiter.max <= 0 {
+		return
+	}
+
+	atomic.AddInt32(&limiter.active, -1)
+}
+
+// Returns a function releasing a connection's slot, which only does so the
+// first time it is called, for when the server first replies as well as when
+// the connection closes without a reply
+func (limiter *handshakeLimiter) releaser() func() {
+	once := &sync.Once{}
+	return func() { once.Do(limiter.release) }
+}
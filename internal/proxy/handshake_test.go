@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	limiter := newHandshakeLimiter(2)
+
+	assert.True(t, limiter.acquire())
+	assert.True(t, limiter.acquire())
+	assert.False(t, limiter.acquire())
+
+	// Releasing twice for the same connection frees only one slot
+	release := limiter.releaser()
+	release()
+	release()
+	assert.True(t, limiter.acquire())
+	assert.False(t, limiter.acquire())
+
+	unlimited := newHandshakeLimiter(0)
+	for i := 0; i < 10; i++ {
+		assert.True(t, unlimited.acquire())
+	}
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	// A server that only answers when told to
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:            server.LocalAddr().String(),
+		MaxConcurrentHandshakes: 1,
+	})
+
+	first := dialProxy(t, proxyServer)
+	_, err = first.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// The second client waits for the first to be answered
+	second := dialProxy(t, proxyServer)
+	_, err = second.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second handshake was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+
+	buffer := make([]byte, maxMTU)
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, addr, err := server.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Open Connection Reply 1
+	_, err = server.WriteTo([]byte{0x06, 1, 2, 3}, addr)
+	assert.Nil(t, err)
+
+	// Then its retry gets through
+	deadline = time.Now().Add(2 * time.Second)
+	for proxyServer.ConnectionCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("second handshake was not let through")
+		}
+		_, err = second.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Number of failed health checks in a row after which a server is skipped,
+// unless HealthCheckFailures is set
+const defaultHealthCheckFailures = 3
+
+// How long to wait for a server to answer a health check
+const healthCheckTimeout = 2 * time.Second
+
+// BackendStatus is the health of one of the servers new clients can be
+// connected to, as of its last health check
+type BackendStatus struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+	// Number of failed health checks in a row
+	Failures int `json:"failures"`
+	// Round trip time of the last successful health check, or 0 if there
+	// has been none
+	RTTSeconds float64 `json:"rtt_seconds"`
+	// Whether it was taken out of rotation with DrainBackend
+	Draining bool `json:"draining"`
+}
+
+// Records the result of a health check of the server at the index
+func (backends *backendSet) recordCheck(index int, rtt time.Duration, err error) {
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+
+	server := backends.addrs[index]
+	failures := backends.failures[index]
+
+	if err != nil {
+		backends.failures[index]++
+		backends.lastFailures[index] = time.Now()
+		if backends.failures[index] == backends.unhealthyAfter {
+			log.Warn().Msgf("Server %s failed %d health checks, skipping it: %v", server, backends.unhealthyAfter, err)
+		}
+	} else {
+		if failures >= backends.unhealthyAfter {
+			log.Info().Msgf("Server %s is healthy again", server)
+		}
+
+		backends.failures[index] = 0
+		backends.rtts[index] = rtt
+	}
+
+	allDown := true
+	for _, failures := range backends.failures {
+		if failures < backends.unhealthyAfter {
+			allDown = false
+		}
+	}
+
+	if allDown && !backends.allDown {
+		log.Error().Msgf("All %d servers are unhealthy, running in degraded mode until one answers again", len(backends.addrs))
+	} else if !allDown && backends.allDown {
+		log.Info().Msgf("Server %s is answering again, leaving degraded mode", server)
+	}
+	backends.allDown = allDown
+}
+
+// Returns whether every server has failed enough health checks in a row to
+// be skipped
+func (backends *backendSet) allUnhealthy() bool {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	return backends.allDown
+}
+
+// Returns the health of every server, the primary first
+func (backends *backendSet) statuses() []BackendStatus {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+
+	statuses := make([]BackendStatus, len(backends.addrs))
+	for i, addr := range backends.addrs {
+		statuses[i] = BackendStatus{
+			addr.String(),
+			backends.failures[i] < backends.unhealthyAfter,
+			backends.failures[i],
+			backends.rtts[i].Seconds(),
+			backends.draining[i],
+		}
+	}
+
+	return statuses
+}
+
+// Pings every server, all at once, and records whether they answered
+func (proxy *ProxyServer) checkBackends() {
+	var wg sync.WaitGroup
+
+	for i, server := range proxy.backends.all() {
+		i, server := i, server
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rtt, err := proxy.pingBackend(server)
+			proxy.backends.recordCheck(i, rtt, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Pings a server over a new connection and returns how long it took to answer
+func (proxy *ProxyServer) pingBackend(server *net.UDPAddr) (time.Duration, error) {
+	conn, err := proxy.dialBackend(server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := sendProbe(conn, unconnectedPingSize, healthCheckTimeout); err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+// Checks the health of the servers periodically until the ProxyServer has
+// been closed
+func (proxy *ProxyServer) healthCheckLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+			proxy.checkBackends()
+		}
+	}
+}
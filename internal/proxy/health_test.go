@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendHealth(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	backends, err := newBackendSet("127.0.0.1:1", primary, []string{"127.0.0.1:2", "127.0.0.1:3"}, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("timeout")
+
+	// One failure isn't enough to skip a server
+	backends.recordCheck(0, 0, failed)
+	assert.Equal(t, "127.0.0.1:1", backends.current().String())
+
+	backends.recordCheck(0, 0, failed)
+	assert.Equal(t, "127.0.0.1:2", backends.current().String())
+
+	// Unhealthy servers are skipped in order
+	backends.recordCheck(1, 0, failed)
+	backends.recordCheck(1, 0, failed)
+	backends.recordCheck(2, 5*time.Millisecond, nil)
+	assert.Equal(t, "127.0.0.1:3", backends.current().String())
+
+	statuses := backends.statuses()
+	assert.Equal(t, BackendStatus{"127.0.0.1:1", false, 2, 0, false}, statuses[0])
+	assert.Equal(t, BackendStatus{"127.0.0.1:3", true, 0, 0.005, false}, statuses[2])
+
+	// With none healthy, the one that failed longest ago is used anyway
+	assert.False(t, backends.allUnhealthy())
+	backends.recordCheck(2, 0, failed)
+	backends.recordCheck(2, 0, failed)
+	assert.True(t, backends.allUnhealthy())
+
+	now := time.Now()
+	backends.lastFailures[0] = now
+	backends.lastFailures[1] = now.Add(-10 * time.Second)
+	backends.lastFailures[2] = now.Add(-5 * time.Second)
+	assert.Equal(t, "127.0.0.1:2", backends.current().String())
+
+	// Failures found by the same round of checks are ties, won by the server
+	// configured first, whatever order the checks finished in
+	backends.lastFailures[0] = now
+	backends.lastFailures[1] = now.Add(-time.Second)
+	backends.lastFailures[2] = now.Add(-healthCheckTimeout + time.Millisecond)
+	assert.Equal(t, "127.0.0.1:1", backends.current().String())
+
+	backends.lastFailures[2] = now.Add(-healthCheckTimeout - time.Second)
+	assert.Equal(t, "127.0.0.1:3", backends.current().String())
+
+	// A server resumes once it answers again
+	backends.recordCheck(0, time.Millisecond, nil)
+	assert.Equal(t, "127.0.0.1:1", backends.current().String())
+	assert.True(t, backends.statuses()[0].Healthy)
+	assert.False(t, backends.allUnhealthy())
+}
+
+func TestHealthChecks(t *testing.T) {
+	// A server that is down refuses every connection
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	fallback := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:        closed.LocalAddr().String(),
+		FallbackServers:     []string{fallback.addr()},
+		HealthCheckInterval: 50 * time.Millisecond,
+		HealthCheckFailures: 1,
+	})
+
+	// The fallback counts as healthy before its first check, so also wait for
+	// that check to record its round trip time
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.RemoteAddr().String() != fallback.addr() || proxyServer.backends.statuses()[1].RTTSeconds == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("unhealthy server was not skipped, or the fallback was not checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	backends := proxyServer.Stats().Backends
+	assert.Len(t, backends, 2)
+	assert.False(t, backends[0].Healthy)
+	assert.True(t, backends[1].Healthy)
+	assert.NotZero(t, backends[1].RTTSeconds)
+}
+
+func TestAllUnhealthyReject(t *testing.T) {
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:        closed.LocalAddr().String(),
+		HealthCheckInterval: 50 * time.Millisecond,
+		HealthCheckFailures: 1,
+		AllUnhealthyPolicy:  AllUnhealthyReject,
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !proxyServer.backends.allUnhealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("server was not found unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Pings are answered as offline
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write(buildPing(7))
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, proto.OfflineReply.Pong.MOTD, pong.Pong.MOTD)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 7}, pong.PingTime)
+
+	// And new clients are refused
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("new client was not refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	_, err = New(ProxyPrefs{RemoteServer: "127.0.0.1:19140", AllUnhealthyPolicy: "panic"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ipList matches client addresses against a list of IPv4 and IPv6 networks
+type ipList []*net.IPNet
+
+// Parses a list of IP addresses and CIDR ranges. IPv4-mapped IPv6 entries are
+// treated as the IPv4 addresses they map, so they match either form.
+func parseIPList(entries []string) (ipList, error) {
+	list := make(ipList, 0, len(entries))
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// A single address is a network of one
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address: %s", entry)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				entry = ip4.String() + "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, normalizeIPNet(network))
+	}
+
+	return list, nil
+}
+
+// Converts an IPv4-mapped IPv6 network to the IPv4 network it maps
+func normalizeIPNet(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	ip4 := network.IP.To4()
+
+	if bits != 8*net.IPv6len || ip4 == nil || ones < 96 {
+		return network
+	}
+
+	return &net.IPNet{
+		IP:   ip4,
+		Mask: net.CIDRMask(ones-96, 8*net.IPv4len),
+	}
+}
+
+// Returns whether the IP of the address is in any of the networks. IPv4
+// addresses match whether or not they are IPv4-mapped.
+func (list ipList) contains(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the IP of an address, or nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// Converts an IPv4-mapped IPv6 address, as a dual-stack listener reports IPv4
+// clients, to the plain IPv4 address, so that a client is known by one
+// address however it was reported. Other addresses are returned as they are.
+func canonicalAddr(addr net.Addr) net.Addr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := udpAddr.IP.To4(); ip4 != nil && len(udpAddr.IP) != net.IPv4len {
+			return &net.UDPAddr{IP: ip4, Port: udpAddr.Port}
+		}
+
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil || !strings.Contains(host, ":") {
+		return addr
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return addr
+	}
+
+	return &net.UDPAddr{IP: ip.To4(), Port: portNumber}
+}
+
+// backendList matches server addresses against a list of allowed hosts, each
+// optionally restricted to one port
+type backendList []allowedBackend
+
+type allowedBackend struct {
+	networks ipList
+	// Zero allows any port
+	port int
+}
+
+// Parses a list of allowed servers, each an IP address, CIDR range or
+// hostname, optionally followed by a port. Hostnames are resolved once, here.
+func parseBackendList(entries []string) (backendList, error) {
+	list := make(backendList, 0, len(entries))
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, port := entry, 0
+		if splitHost, splitPort, err := net.SplitHostPort(entry); err == nil {
+			if port, err = strconv.Atoi(splitPort); err != nil {
+				return nil, fmt.Errorf("Invalid port in %s", entry)
+			}
+
+			host = splitHost
+		}
+
+		hosts := []string{host}
+		if !strings.Contains(host, "/") && net.ParseIP(host) == nil {
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return nil, err
+			}
+
+			hosts = hosts[:0]
+			for _, ip := range ips {
+				hosts = append(hosts, ip.String())
+			}
+		}
+
+		networks, err := parseIPList(hosts)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, allowedBackend{networks, port})
+	}
+
+	return list, nil
+}
+
+// Returns whether the server address is allowed. An empty list allows all.
+func (list backendList) allows(addr *net.UDPAddr) bool {
+	if len(list) == 0 {
+		return true
+	}
+
+	for _, backend := range list {
+		if (backend.port == 0 || backend.port == addr.Port) && backend.networks.contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
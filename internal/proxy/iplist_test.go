@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 19132}
+}
+
+func TestIPListIPv4(t *testing.T) {
+	list, err := parseIPList([]string{"10.0.0.0/8", "192.168.1.5"})
+	assert.Nil(t, err)
+
+	assert.True(t, list.contains(udpAddr("10.1.2.3")))
+	assert.True(t, list.contains(udpAddr("192.168.1.5")))
+	assert.False(t, list.contains(udpAddr("192.168.1.6")))
+
+	// IPv4-mapped sources, as seen on dual-stack listeners
+	assert.True(t, list.contains(udpAddr("::ffff:10.1.2.3")))
+	assert.False(t, list.contains(udpAddr("::ffff:11.1.2.3")))
+}
+
+func TestIPListIPv6(t *testing.T) {
+	list, err := parseIPList([]string{"2001:db8::/32", "fe80::1"})
+	assert.Nil(t, err)
+
+	assert.True(t, list.contains(udpAddr("2001:db8:1::42")))
+	assert.True(t, list.contains(udpAddr("fe80::1")))
+	assert.False(t, list.contains(udpAddr("fe80::2")))
+	assert.False(t, list.contains(udpAddr("10.0.0.1")))
+}
+
+func TestIPListIPv4Mapped(t *testing.T) {
+	list, err := parseIPList([]string{"::ffff:10.0.0.0/104", "::ffff:192.168.1.5"})
+	assert.Nil(t, err)
+
+	assert.True(t, list.contains(udpAddr("10.1.2.3")))
+	assert.True(t, list.contains(udpAddr("::ffff:10.1.2.3")))
+	assert.True(t, list.contains(udpAddr("192.168.1.5")))
+	assert.False(t, list.contains(udpAddr("11.0.0.1")))
+}
+
+// An address that is only known by its string, as some PacketConns report
+type stringAddr string
+
+func (addr stringAddr) Network() string { return "udp" }
+func (addr stringAddr) String() string  { return string(addr) }
+
+func TestCanonicalAddr(t *testing.T) {
+	plain := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 5}
+
+	for _, addr := range []net.Addr{
+		plain,
+		&net.UDPAddr{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 5},
+		stringAddr("[::ffff:1.2.3.4]:5"),
+		stringAddr("1.2.3.4:5"),
+	} {
+		canonical := canonicalAddr(addr)
+		assert.Equal(t, "1.2.3.4:5", canonical.String())
+		assert.Equal(t, plain.IP, addrIP(canonical).To4())
+	}
+
+	// The plain IPv4 form is kept, as are other addresses
+	assert.True(t, canonicalAddr(plain) == plain)
+
+	ipv6 := stringAddr("[2001:db8::1]:5")
+	assert.Equal(t, ipv6, canonicalAddr(ipv6))
+	assert.Equal(t, stringAddr("nonsense"), canonicalAddr(stringAddr("nonsense")))
+}
+
+func TestIPListInvalid(t *testing.T) {
+	_, err := parseIPList([]string{"not-an-ip"})
+	assert.NotNil(t, err)
+
+	_, err = parseIPList([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+}
+
+func TestBackendList(t *testing.T) {
+	list, err := parseBackendList([]string{"10.0.0.1:19132", "192.168.0.0/16", "[2001:db8::1]:19133", "localhost:19134"})
+	assert.Nil(t, err)
+
+	allowed := func(ip string, port int) bool {
+		return list.allows(&net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	}
+
+	assert.True(t, allowed("10.0.0.1", 19132))
+	assert.False(t, allowed("10.0.0.1", 19133))
+	assert.True(t, allowed("192.168.4.2", 1234))
+	assert.True(t, allowed("2001:db8::1", 19133))
+	assert.False(t, allowed("2001:db8::2", 19133))
+	assert.True(t, allowed("127.0.0.1", 19134))
+	assert.False(t, allowed("172.16.0.1", 19132))
+
+	// An empty list allows everything
+	assert.True(t, backendList{}.allows(&net.UDPAddr{IP: net.ParseIP("172.16.0.1"), Port: 1}))
+}
+
+func TestNewRefusesDisallowedBackend(t *testing.T) {
+	_, err := New(ProxyPrefs{
+		BindAddress:     "127.0.0.1",
+		RemoteServer:    "127.0.0.1:19140",
+		AllowedBackends: []string{"10.0.0.0/8"},
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// How long a session goes without traffic before KeepAlive pings the server
+const keepAliveIdle = 15 * time.Second
+
+// Timestamp sent in keep-alive pings, which marks the pongs answering them
+var keepAlivePingTime = []byte("phntmKA!")
+
+// Sends a keep-alive ping to the server on every session that has been quiet,
+// and not pinged, for keepAliveIdle. Connected pings are part of the session's numbered
+// datagrams, so phantom can't inject one without clashing with the client's
+// sequence numbers. Instead it sends an unconnected ping from the session's
+// socket, which the server answers outside the session and which refreshes
+// the same NAT bindings.
+func (proxy *ProxyServer) sendKeepAlives(now time.Time) {
+	ping := proto.UnconnectedPing{
+		PingTime:   keepAlivePingTime,
+		Magic:      proto.Magic,
+		ClientGUID: make([]byte, 8),
+	}
+	packet := ping.Build()
+	data := packet.Bytes()
+
+	proxy.clientMap.Range(func(conn *clientmap.ServerConn) bool {
+		if now.Sub(conn.LastPacket()) >= keepAliveIdle && now.Sub(conn.LastKeepAlive()) >= keepAliveIdle {
+			log.Debug().Msgf("Sending keep-alive ping to %s", conn.RemoteAddr())
+			conn.MarkKeepAlive(now)
+			if _, err := conn.Write(data); err != nil {
+				log.Debug().Msgf("Failed to send keep-alive ping: %v", err)
+			}
+		}
+
+		return true
+	})
+}
+
+// Returns whether the packet from the server answers a keep-alive ping, and
+// so is neither passed on to the client nor counted as its traffic
+func isKeepAlivePong(data []byte) bool {
+	return len(data) >= pingTimeOffset+pingTimeLength &&
+		data[0] == proto.UnconnectedPongID &&
+		bytes.Equal(data[pingTimeOffset:pingTimeOffset+pingTimeLength], keepAlivePingTime)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepAlive(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		KeepAlive:    true,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Recently active sessions are left alone
+	proxyServer.sendKeepAlives(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, uint64(0), proxyServer.Stats().PacketsFromServer)
+
+	// Quiet sessions are pinged, and the server's answer is neither passed on
+	// nor counted as the client's traffic
+	later := time.Now().Add(keepAliveIdle)
+	proxyServer.sendKeepAlives(later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.pongCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not answer the keep-alive ping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = client.Read(make([]byte, maxMTU))
+	assert.NotNil(t, err)
+
+	stats := proxyServer.Stats()
+	assert.Equal(t, uint64(0), stats.PacketsFromServer)
+	assert.Equal(t, uint64(0), stats.BytesFromServer)
+	proxyServer.Range(func(info clientmap.ConnInfo) bool {
+		assert.Equal(t, uint64(0), info.BytesFromServer)
+		return true
+	})
+
+	// The session isn't pinged again until another keepAliveIdle has passed
+	proxyServer.sendKeepAlives(later.Add(time.Second))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, server.pongCount())
+}
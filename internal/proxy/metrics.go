@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A metric exported in the Prometheus text format
+type metric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(stats Stats) float64
+}
+
+var metrics = []metric{
+	{"phantom_connections", "gauge", "Number of clients with an open connection to the server.",
+		func(stats Stats) float64 { return float64(stats.Connections) }},
+	{"phantom_maintenance", "gauge", "Whether maintenance mode is on.",
+		func(stats Stats) float64 { return boolValue(stats.Maintenance) }},
+	{"phantom_breaker_open", "gauge", "Whether the circuit breaker is refusing new connections.",
+		func(stats Stats) float64 { return boolValue(stats.BreakerOpen) }},
+	{"phantom_ping_sources", "gauge", "Number of clients with pings awaiting a pong.",
+		func(stats Stats) float64 { return float64(stats.PingSources) }},
+	{"phantom_packets_from_clients_total", "counter", "Packets received from clients.",
+		func(stats Stats) float64 { return float64(stats.PacketsFromClients) }},
+	{"phantom_bytes_from_clients_total", "counter", "Bytes received from clients.",
+		func(stats Stats) float64 { return float64(stats.BytesFromClients) }},
+	{"phantom_packets_from_server_total", "counter", "Packets received from the server.",
+		func(stats Stats) float64 { return float64(stats.PacketsFromServer) }},
+	{"phantom_bytes_from_server_total", "counter", "Bytes received from the server.",
+		func(stats Stats) float64 { return float64(stats.BytesFromServer) }},
+	{"phantom_dropped_packets_total", "counter", "Packets dropped instead of being forwarded.",
+		func(stats Stats) float64 { return float64(stats.DroppedPackets) }},
+	{"phantom_short_writes_total", "counter", "Packets only partly written to the server.",
+		func(stats Stats) float64 { return float64(stats.ShortWrites) }},
+	{"phantom_truncated_packets_total", "counter", "Packets that filled the read buffer, likely truncated by the MTU.",
+		func(stats Stats) float64 { return float64(stats.TruncatedPackets) }},
+	{"phantom_unknown_packets_total", "counter", "Packets from clients that don't look like RakNet.",
+		func(stats Stats) float64 { return float64(stats.UnknownPackets) }},
+	{"phantom_reflected_packets_total", "counter", "Unconnected Pongs from clients, dropped since only servers send them.",
+		func(stats Stats) float64 { return float64(stats.ReflectedPackets) }},
+	{"phantom_backend_dial_retries_total", "counter", "Failed attempts to open a connection to the server that were retried.",
+		func(stats Stats) float64 { return float64(stats.BackendDialRetries) }},
+	{"phantom_backend_dial_failures_total", "counter", "Connections to the server that couldn't be opened after retrying.",
+		func(stats Stats) float64 { return float64(stats.BackendDialFailures) }},
+	{"phantom_mirror_failures_total", "counter", "Copies of packets that couldn't be sent to the mirror.",
+		func(stats Stats) float64 { return float64(stats.MirrorFailures) }},
+}
+
+// A histogram exported in the Prometheus text format
+type histogram struct {
+	name string
+	help string
+	// Upper bounds of the buckets, not counting the last one for the rest
+	bounds []float64
+	// Returns the number of observations in each bucket and their sum
+	value func(stats Stats) ([]uint64, float64)
+}
+
+var histograms = []histogram{
+	{"phantom_connection_duration_seconds", "How long closed connections lasted.", connectionDurationBounds,
+		func(stats Stats) ([]uint64, float64) {
+			return stats.ConnectionDurations, stats.ConnectionDurationSeconds
+		}},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the stats of the given proxies in the Prometheus text
+// format, with each proxy's Label as the "listener" label. Counters reset with
+// ResetStats() or a restart, which Prometheus handles as a counter reset.
+func WriteMetrics(w io.Writer, proxies ...*ProxyServer) error {
+	stats := make([]Stats, len(proxies))
+	for i, proxy := range proxies {
+		stats[i] = proxy.Stats()
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.metricType); err != nil {
+			return err
+		}
+
+		for i, proxy := range proxies {
+			if _, err := fmt.Fprintf(w, "%s{listener=\"%s\"} %v\n", metric.name, labelEscaper.Replace(proxy.Label()), metric.value(stats[i])); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, histogram := range histograms {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name); err != nil {
+			return err
+		}
+
+		for i, proxy := range proxies {
+			if err := histogram.write(w, labelEscaper.Replace(proxy.Label()), stats[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Writes the cumulative buckets, sum and count of the histogram for a proxy
+func (histogram histogram) write(w io.Writer, label string, stats Stats) error {
+	counts, sum := histogram.value(stats)
+	return histogram.writeCounts(w, fmt.Sprintf("listener=\"%s\"", label), counts, sum)
+}
+
+// Writes the cumulative buckets, sum and count of the observations, with the
+// labels, if any, on every line
+func (histogram histogram) writeCounts(w io.Writer, labels string, counts []uint64, sum float64) error {
+	var total uint64
+	for i, count := range counts {
+		total += count
+
+		bound := "+Inf"
+		if i < len(histogram.bounds) {
+			bound = fmt.Sprintf("%v", histogram.bounds[i])
+		}
+
+		bucketLabels := fmt.Sprintf("le=\"%s\"", bound)
+		if labels != "" {
+			bucketLabels = labels + "," + bucketLabels
+		}
+
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s} %v\n", histogram.name, bucketLabels, total); err != nil {
+			return err
+		}
+	}
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+
+	_, err := fmt.Fprintf(w, "%s_sum%s %v\n%s_count%s %v\n", histogram.name, labels, sum, histogram.name, labels, total)
+	return err
+}
+
+// Label returns the label identifying this proxy in metrics: Label from its
+// prefs, or else the port it listens on
+func (proxy *ProxyServer) Label() string {
+	if proxy.prefs.Label != "" {
+		return proxy.prefs.Label
+	}
+
+	return fmt.Sprintf("%d", proxy.BoundPort())
+}
+
+// Serves the metrics of this proxy
+func (proxy *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := WriteMetrics(w, proxy); err != nil {
+		log.Warn().Msgf("Failed to write metrics: %v", err)
+	}
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+// PrometheusSink is a MetricsSink that keeps the metrics reported to it and
+// serves them over HTTP in the Prometheus text format, for programs embedding
+// phantom that serve metrics of their own. Histograms use the buckets of the
+// matching phantom histogram, if any.
+type PrometheusSink struct {
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*sinkHistogram
+	mutex      *sync.Mutex
+}
+
+// Observations of a histogram, counted in each bucket with the last for the
+// rest
+type sinkHistogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+}
+
+// NewPrometheusSink returns an empty PrometheusSink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		map[string]float64{},
+		map[string]float64{},
+		map[string]*sinkHistogram{},
+		&sync.Mutex{},
+	}
+}
+
+func (sink *PrometheusSink) IncCounter(name string, delta float64) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.counters[name] += delta
+}
+
+func (sink *PrometheusSink) SetGauge(name string, value float64) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.gauges[name] = value
+}
+
+func (sink *PrometheusSink) ObserveHistogram(name string, value float64) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	observed, ok := sink.histograms[name]
+	if !ok {
+		var bounds []float64
+		for _, histogram := range histograms {
+			if histogram.name == name {
+				bounds = histogram.bounds
+			}
+		}
+
+		observed = &sinkHistogram{bounds, make([]uint64, len(bounds)+1), 0}
+		sink.histograms[name] = observed
+	}
+
+	bucket := len(observed.bounds)
+	for i, bound := range observed.bounds {
+		if value < bound {
+			bucket = i
+			break
+		}
+	}
+
+	observed.counts[bucket]++
+	observed.sum += value
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (sink *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := sink.write(w); err != nil {
+		log.Warn().Msgf("Failed to write metrics: %v", err)
+	}
+}
+
+func (sink *PrometheusSink) write(w io.Writer) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	for _, values := range []struct {
+		metricType string
+		values     map[string]float64
+	}{{"counter", sink.counters}, {"gauge", sink.gauges}} {
+		for _, name := range sortedKeys(values.values) {
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, values.metricType, name, values.values[name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(sink.histograms))
+	for name := range sink.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		observed := sink.histograms[name]
+		histogram := histogram{name, "", observed.bounds, nil}
+
+		if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+			return err
+		}
+
+		if err := histogram.writeCounts(w, "", observed.counts, observed.sum); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
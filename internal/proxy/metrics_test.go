@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	labelled, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		BindPort:     19200,
+		RemoteServer: "127.0.0.1:19140",
+		Label:        `survival "main"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer labelled.Close()
+
+	unlabelled, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		BindPort:     19201,
+		RemoteServer: "127.0.0.1:19140",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlabelled.Close()
+
+	labelled.counters().fromClient(10)
+	labelled.counters().connectionClosed(5 * time.Second)
+	labelled.counters().connectionClosed(90 * time.Second)
+	labelled.counters().connectionClosed(2 * time.Hour)
+
+	var output bytes.Buffer
+	assert.Nil(t, WriteMetrics(&output, labelled, unlabelled))
+
+	text := output.String()
+	assert.Contains(t, text, "# TYPE phantom_bytes_from_clients_total counter\n")
+	assert.Contains(t, text, `phantom_bytes_from_clients_total{listener="survival \"main\""} 10`+"\n")
+	assert.Contains(t, text, `phantom_bytes_from_clients_total{listener="19201"} 0`+"\n")
+	assert.Contains(t, text, `phantom_connections{listener="19201"} 0`+"\n")
+
+	assert.Contains(t, text, "# TYPE phantom_connection_duration_seconds histogram\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{listener="survival \"main\"",le="10"} 1`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{listener="survival \"main\"",le="60"} 1`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{listener="survival \"main\"",le="600"} 2`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{listener="survival \"main\"",le="+Inf"} 3`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_sum{listener="survival \"main\""} 7295`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_count{listener="survival \"main\""} 3`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_count{listener="19201"} 0`+"\n")
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Number of packets waiting to be sent to MirrorAddr, beyond which copies are
+// dropped
+const mirrorQueueSize = 1024
+
+// mirror sends copies of the packets from clients to an analysis endpoint,
+// from its own goroutine so that it never holds up the packets themselves
+type mirror struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+func newMirror(addr string) (*mirror, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mirror{
+		conn,
+		make(chan []byte, mirrorQueueSize),
+	}, nil
+}
+
+// Queues a copy of the packet, or returns false if the queue is full
+func (mirror *mirror) send(data []byte) bool {
+	select {
+	case mirror.queue <- append([]byte(nil), data...):
+		return true
+	default:
+		return false
+	}
+}
+
+// Sends the queued packets until the ProxyServer has been closed
+func (proxy *ProxyServer) mirrorLoop(mirror *mirror) {
+	defer mirror.conn.Close()
+
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case data := <-mirror.queue:
+			if _, err := mirror.conn.Write(data); err != nil {
+				log.Trace().Msgf("Failed to mirror packet: %v", err)
+				proxy.counters().mirrorFailed()
+			}
+		}
+	}
+}
+
+// Sends a copy of a packet forwarded to the server to MirrorAddr, if set
+func (proxy *ProxyServer) mirrorPacket(data []byte) {
+	if proxy.mirror != nil && !proxy.mirror.send(data) {
+		proxy.counters().mirrorFailed()
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		MirrorAddr:   collector.LocalAddr().String(),
+	})
+
+	packet := []byte{proto.OpenConnectionRequest1ID, 1, 2, 3}
+	_, err = dialProxy(t, proxyServer).Write(packet)
+	assert.Nil(t, err)
+
+	// The collector gets a copy of what the server got
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	read, _, err := collector.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, packet, buffer[:read])
+	waitForConnections(t, proxyServer, 1)
+}
+
+func TestMirrorQueueFull(t *testing.T) {
+	mirror, err := newMirror("127.0.0.1:19140")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.conn.Close()
+
+	// Nothing sends the queued copies, so the queue fills up
+	for i := 0; i < mirrorQueueSize; i++ {
+		assert.True(t, mirror.send([]byte{1}))
+	}
+	assert.False(t, mirror.send([]byte{1}))
+}
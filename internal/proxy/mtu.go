@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// Packet sizes probed by AutoMTU, in increasing order. The largest fits a
+// jumbo frame once IP and UDP headers are taken off.
+var mtuProbeSizes = []int{maxMTU, 4068, 8972}
+
+// How long to wait for the server to answer each probe
+const mtuProbeTimeout = time.Second
+
+// Finds the largest packet the server answers by sending it unconnected pings
+// padded to increasing sizes, with the Don't Fragment bit set so that probes
+// over the path MTU are dropped rather than reassembled by the server. Falls
+// back to maxMTU if none get through or the bit can't be set.
+func probeMTU(dial clientmap.DialFunc, remote *net.UDPAddr) int {
+	conn, err := dial(remote)
+	if err != nil {
+		log.Warn().Msgf("MTU probe failed, using %d: %v", maxMTU, err)
+		return maxMTU
+	}
+	defer conn.Close()
+
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		log.Warn().Msgf("Can't probe the MTU over this network, using %d", maxMTU)
+		return maxMTU
+	}
+
+	if err := setDontFragment(sysConn, remote.IP.To4() == nil); err != nil {
+		log.Warn().Msgf("Can't probe the MTU without Don't Fragment, using %d: %v", maxMTU, err)
+		return maxMTU
+	}
+
+	mtu := maxMTU
+	for _, size := range mtuProbeSizes {
+		if err := sendProbe(conn, size, mtuProbeTimeout); err != nil {
+			log.Debug().Msgf("MTU probe of %d bytes failed: %v", size, err)
+			break
+		}
+
+		mtu = size
+	}
+
+	log.Info().Msgf("Using MTU of %d bytes to %s", mtu, remote)
+	return mtu
+}
+
+// Sends the server an unconnected ping padded to the given size and waits for
+// it to answer with a pong
+func sendProbe(conn net.Conn, size int, timeout time.Duration) error {
+	probe := make([]byte, size)
+	probe[0] = proto.UnconnectedPingID
+	copy(probe[pingTimeOffset+pingTimeLength:], proto.Magic)
+
+	if _, err := conn.Write(probe); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, maxMTU)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		read, err := conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+
+		if read > 0 && buffer[0] == proto.UnconnectedPongID {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeMTU(t *testing.T) {
+	server := startFakeServer(t)
+
+	remote, err := net.ResolveUDPAddr("udp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loopback carries even the largest probe
+	assert.Equal(t, mtuProbeSizes[len(mtuProbeSizes)-1], probeMTU(clientmap.DialUDP, remote))
+}
+
+func TestProbeMTUFallback(t *testing.T) {
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	assert.Equal(t, maxMTU, probeMTU(clientmap.DialUDP, closed.LocalAddr().(*net.UDPAddr)))
+}
+
+func TestProbeMTUWithoutSocket(t *testing.T) {
+	server := startFakeServer(t)
+
+	remote, err := net.ResolveUDPAddr("udp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A userspace network's connections have no socket to set Don't Fragment on
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		conn, err := clientmap.DialUDP(remote)
+		return struct{ net.Conn }{conn}, err
+	}
+
+	assert.Equal(t, maxMTU, probeMTU(dial, remote))
+}
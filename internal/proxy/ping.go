@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/rs/zerolog/log"
+)
+
+// How long to wait for the server to answer a forwarded ping
+const pingTimeout = 5 * time.Second
+
+// Default limit on the size of a ping reply to a client without a connection,
+// as a multiple of the size of its ping. Typical pongs are 3-6 times the size
+// of a 33 byte ping and ones with long MOTDs around 12, while a pong filling a
+// whole packet is over 40.
+const defaultPingAmplificationFactor = 20
+
+// Offset and length of the timestamp in unconnected ping and pong packets
+const pingTimeOffset = 1
+const pingTimeLength = 8
+
+// pingForwarder proxies unconnected pings from any number of clients through
+// a small pool of shared sockets to the server, rather than opening a
+// connection per pinging client. The timestamp of each forwarded ping is replaced with a
+// unique token, which the server echoes in its pong, so that every pong can
+// be routed back to the client that sent the ping, with the client's own
+// timestamp restored.
+type pingForwarder struct {
+	conns     []net.Conn
+	pending   map[uint64]pendingPing
+	nextToken uint64
+	// Clients with pending pings, ordered from most to least recent, limited
+	// to maxSources if it is positive
+	sources    map[string]*pingSource
+	order      *list.List
+	maxSources int
+	mutex      *sync.Mutex
+}
+
+type pendingPing struct {
+	client   net.Addr
+	pingTime []byte
+	size     int
+	sent     time.Time
+}
+
+// The pending pings of one client
+type pingSource struct {
+	key     string
+	tokens  map[uint64]bool
+	element *list.Element
+}
+
+func newPingForwarder(dial clientmap.DialFunc, remote *net.UDPAddr, poolSize int, maxSources int) (*pingForwarder, error) {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	log.Info().Msgf("Opening %d shared ping connections to %s", poolSize, remote)
+
+	conns := make([]net.Conn, 0, poolSize)
+	for i := 0; i < poolSize; i++ {
+		conn, err := dial(remote)
+		if err != nil {
+			for _, opened := range conns {
+				opened.Close()
+			}
+
+			return nil, err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	return &pingForwarder{
+		conns,
+		make(map[uint64]pendingPing),
+		0,
+		make(map[string]*pingSource),
+		list.New(),
+		maxSources,
+		&sync.Mutex{},
+	}, nil
+}
+
+// Sends a client's ping to the server, tagged with a token in place of the
+// client's timestamp. Pings are spread over the pool in turn.
+func (pings *pingForwarder) forward(data []byte, client net.Addr) error {
+	if len(data) < pingTimeOffset+pingTimeLength {
+		return fmt.Errorf("Ping too short: %d bytes", len(data))
+	}
+
+	packet := make([]byte, len(data))
+	copy(packet, data)
+
+	pingTime := make([]byte, pingTimeLength)
+	copy(pingTime, data[pingTimeOffset:])
+
+	pings.mutex.Lock()
+	pings.nextToken++
+	token := pings.nextToken
+	pings.pending[token] = pendingPing{client, pingTime, len(data), time.Now()}
+	pings.track(client, token)
+	pings.mutex.Unlock()
+
+	binary.BigEndian.PutUint64(packet[pingTimeOffset:], token)
+
+	conn := pings.conns[token%uint64(len(pings.conns))]
+
+	_, err := conn.Write(packet)
+	return err
+}
+
+// Finds the client whose ping the pong answers and the size of that ping, and
+// restores that client's timestamp in the pong, in place.
+func (pings *pingForwarder) match(data []byte) (net.Addr, int, bool) {
+	if len(data) < pingTimeOffset+pingTimeLength {
+		return nil, 0, false
+	}
+
+	token := binary.BigEndian.Uint64(data[pingTimeOffset:])
+
+	pings.mutex.Lock()
+	ping, ok := pings.pending[token]
+	if ok {
+		pings.forget(token, ping)
+	}
+	pings.mutex.Unlock()
+
+	if !ok {
+		return nil, 0, false
+	}
+
+	copy(data[pingTimeOffset:], ping.pingTime)
+
+	return ping.client, ping.size, true
+}
+
+// Forgets pings that have gone unanswered for longer than pingTimeout and
+// returns how many there were
+func (pings *pingForwarder) expire(now time.Time) int {
+	pings.mutex.Lock()
+	defer pings.mutex.Unlock()
+
+	expired := 0
+	for token, ping := range pings.pending {
+		if ping.sent.Add(pingTimeout).Before(now) {
+			pings.forget(token, ping)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// Records a pending ping under its client, making room for a new client by
+// dropping the pings of the least recent one if there are maxSources already.
+// Must be called with the mutex held.
+func (pings *pingForwarder) track(client net.Addr, token uint64) {
+	key := client.String()
+
+	source, ok := pings.sources[key]
+	if ok {
+		pings.order.MoveToFront(source.element)
+	} else {
+		if pings.maxSources > 0 && len(pings.sources) >= pings.maxSources {
+			oldest := pings.order.Back().Value.(*pingSource)
+			log.Debug().Msgf("Too many clients pinging, forgetting pings from %s", oldest.key)
+
+			for oldToken := range oldest.tokens {
+				delete(pings.pending, oldToken)
+			}
+			pings.removeSource(oldest)
+		}
+
+		source = &pingSource{key, make(map[uint64]bool), nil}
+		source.element = pings.order.PushFront(source)
+		pings.sources[key] = source
+	}
+
+	source.tokens[token] = true
+}
+
+// Forgets a pending ping. Must be called with the mutex held.
+func (pings *pingForwarder) forget(token uint64, ping pendingPing) {
+	delete(pings.pending, token)
+
+	if source, ok := pings.sources[ping.client.String()]; ok {
+		delete(source.tokens, token)
+		if len(source.tokens) == 0 {
+			pings.removeSource(source)
+		}
+	}
+}
+
+// Must be called with the mutex held
+func (pings *pingForwarder) removeSource(source *pingSource) {
+	delete(pings.sources, source.key)
+	pings.order.Remove(source.element)
+}
+
+// Returns the number of clients with pings awaiting a pong
+func (pings *pingForwarder) sourceCount() int {
+	pings.mutex.Lock()
+	defer pings.mutex.Unlock()
+
+	return len(pings.sources)
+}
+
+func (pings *pingForwarder) Close() error {
+	var firstErr error
+	for _, conn := range pings.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Answers a client's ping right away if the server is offline, then forwards
+// it to the server through the shared ping connection.
+func (proxy *ProxyServer) processPing(data []byte, client net.Addr) error {
+	log.Info().Msgf("Received LAN ping from client: %s", client.String())
+
+	ping, err := proto.ReadUnconnectedPing(data)
+	if err != nil {
+		return &ClientError{client, err}
+	}
+
+	// While every server is down, the server is shown as offline without
+	// asking the ping server
+	if proxy.rejectAllUnhealthy() {
+		reply := proto.OfflineReply
+		reply.PingTime = ping.PingTime
+		replyBytes := proxy.buildPong(reply, client)
+
+		if proxy.pingReplyAllowed(replyBytes, len(data), client) {
+			proxy.server.WriteTo(replyBytes, client)
+			log.Debug().Msgf("Sent server offline pong to client, every server is unhealthy: %v", client.String())
+		}
+
+		return nil
+	}
+
+	if proxy.serverOffline.IsSet() {
+		// Echo the client's own timestamp so it can work out its latency
+		if cached, ok := proxy.pongCache.load(proxy.prefs.PongCacheTTL); ok {
+			cached.PingTime = ping.PingTime
+			replyBytes := proxy.buildPong(cached, client)
+
+			if proxy.pingReplyAllowed(replyBytes, len(data), client) {
+				proxy.server.WriteTo(replyBytes, client)
+				log.Info().Msgf("Sent cached pong to client: %v", client.String())
+			}
+		} else {
+			reply := proto.OfflineReply
+			reply.PingTime = ping.PingTime
+			replyBytes := proxy.buildPong(reply, client)
+
+			if proxy.pingReplyAllowed(replyBytes, len(data), client) {
+				proxy.server.WriteTo(replyBytes, client)
+				log.Info().Msgf("Sent server offline pong to client: %v", client.String())
+			}
+		}
+	}
+
+	// Pass ping through to server even if it's offline
+	if proxy.faults.shouldDrop() {
+		log.Trace().Msgf("Fault injection: dropping packet from %s", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	if proxy.prefs.AddedLatency > 0 {
+		proxy.faults.delay(data, func(delayed []byte) {
+			if err := proxy.pings.forward(delayed, client); err != nil {
+				proxy.reportError(&ClientError{client, err})
+			}
+		})
+
+		return nil
+	}
+
+	if err := proxy.pings.forward(data, client); err != nil {
+		return &ClientError{client, err}
+	}
+
+	return nil
+}
+
+// Reads pongs from one of the shared ping connections and sends each one on to
+// the client whose ping it answers, until the ProxyServer has been closed or
+// the connection fails.
+func (proxy *ProxyServer) processPongsFromServer(conn net.Conn) {
+	buffer := make([]byte, proxy.mtu)
+
+	for !proxy.dead.IsSet() {
+		read, err := conn.Read(buffer)
+		if err != nil {
+			if proxy.dead.IsSet() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug().Msgf("Error reading from shared ping connection: %v", err)
+
+			// Timeouts and refusals from an offline server pass once it's
+			// back, but other errors would fail every read after them
+			if !offlineErrorRegex.MatchString(err.Error()) {
+				log.Warn().Msgf("Stopped reading pongs from %s: %v", conn.RemoteAddr(), err)
+				proxy.reportError(err)
+				return
+			}
+
+			proxy.markServerOffline()
+			continue
+		}
+
+		if read < 1 || buffer[0] != proto.UnconnectedPongID {
+			continue
+		}
+
+		proxy.counters().fromServer(read)
+		proxy.checkTruncated(read, buffer, conn.RemoteAddr())
+
+		data := buffer[:read]
+
+		client, pingSize, ok := proxy.pings.match(data)
+		if !ok {
+			log.Debug().Msgf("Dropping pong that doesn't match any pending ping")
+			continue
+		}
+
+		data = proxy.handleServerPacket(data, client)
+
+		if !proxy.pingReplyAllowed(data, pingSize, client) {
+			continue
+		}
+
+		if proxy.faults.shouldDrop() {
+			log.Trace().Msgf("Fault injection: dropping packet to %s", client.String())
+			proxy.counters().dropped()
+			continue
+		}
+
+		if !proxy.waitForEgress(len(data)) {
+			log.Trace().Msgf("Dropping pong to %s, over the egress limit", client.String())
+			continue
+		}
+
+		proxy.faults.delay(data, func(delayed []byte) {
+			proxy.server.WriteTo(delayed, client)
+		})
+	}
+}
+
+// Returns whether a reply to a ping may be sent to the client. Replies to
+// clients without a connection are limited to PingAmplificationFactor times
+// the size of their ping, so that phantom can't be used to amplify
+// reflection attacks on spoofed addresses.
+func (proxy *ProxyServer) pingReplyAllowed(reply []byte, pingSize int, client net.Addr) bool {
+	factor := proxy.prefs.PingAmplificationFactor
+	if factor == 0 {
+		factor = defaultPingAmplificationFactor
+	}
+
+	if factor < 0 || float64(len(reply)) <= factor*float64(pingSize) {
+		return true
+	}
+
+	if proxy.clientMap.Has(client) {
+		return true
+	}
+
+	log.Debug().Msgf("Dropping %d byte reply to %d byte ping from %s", len(reply), pingSize, client.String())
+	proxy.counters().dropped()
+	return false
+}
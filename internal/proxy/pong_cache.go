@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+)
+
+// pongCache remembers the most recent pong received from the backend so that
+// it can stand in for the backend while it is briefly unresponsive.
+type pongCache struct {
+	pong    *proto.UnconnectedReply
+	updated time.Time
+	mutex   *sync.RWMutex
+}
+
+func newPongCache() *pongCache {
+	return &pongCache{
+		nil,
+		time.Time{},
+		&sync.RWMutex{},
+	}
+}
+
+// Stores a copy of the pong as received from the backend along with the
+// current time
+func (cache *pongCache) store(pong proto.UnconnectedReply) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.pong = &pong
+	cache.updated = time.Now()
+}
+
+// Returns a copy of the cached pong if there is one no older than maxAge
+func (cache *pongCache) load(maxAge time.Duration) (proto.UnconnectedReply, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	if cache.pong == nil || time.Since(cache.updated) > maxAge {
+		return proto.UnconnectedReply{}, false
+	}
+
+	return *cache.pong, true
+}
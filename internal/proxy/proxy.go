@@ -1,27 +1,75 @@
 package proxy
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"net"
+	"net/http"
 	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jhead/phantom/internal/clientmap"
 	"github.com/jhead/phantom/internal/proto"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/tevino/abool"
+	"google.golang.org/grpc"
 
 	reuse "github.com/libp2p/go-reuseport"
 )
 
+// Policies for ProxyPrefs.OverflowPolicy
+const (
+	OverflowReject   = "reject"
+	OverflowEvictLRU = "evict_lru"
+)
+
+// Policies for ProxyPrefs.AllUnhealthyPolicy
+const (
+	AllUnhealthyLeastRecentlyFailed = "least_recently_failed"
+	AllUnhealthyReject              = "reject"
+)
+
+// Ways of telling clients apart for ProxyPrefs.ClientKey
+const (
+	ClientKeyAddr = "addr"
+	ClientKeyIP   = "ip"
+)
+
+// Largest packet handled unless AutoMTU finds a bigger one
 const maxMTU = 1472
 
+// Number of errors buffered for Errors() before new ones are dropped
+const errorBufferSize = 64
+
 var idleCheckInterval = 5 * time.Second
 
+// Number of times to retry opening a connection to the server, over about
+// 15ms, to ride out momentary shortages such as of ephemeral ports
+const backendDialRetries = 2
+
+// Message IDs exempt from RequireHandshake when HandshakeExemptIDs is nil
+var defaultHandshakeExemptIDs = []byte{proto.UnconnectedPingID, proto.UnconnectedPingOpenConnectionsID}
+
+// Pongs from clients dropped between warnings, to keep a flood of them from
+// flooding the logs too
+const reflectedWarnEvery = 1000
+
+const defaultMaintenanceMOTD = "phantom §eUnder maintenance"
+
 type ProxyServer struct {
+	// Accessed atomically; kept first for 64-bit alignment on 32-bit platforms
+	serverID            int64
 	bindAddress         *net.UDPAddr
-	boundPort           uint16
+	boundPort           uint32 // accessed atomically
 	remoteServerAddress *net.UDPAddr
 	pingServer          net.PacketConn
 	pingServerV6        net.PacketConn
@@ -29,135 +77,1349 @@ type ProxyServer struct {
 	clientMap           *clientmap.ClientMap
 	prefs               ProxyPrefs
 	dead                *abool.AtomicBool
-	serverOffline       bool
+	serverOffline       *abool.AtomicBool
+	errors              chan error
+	pongCache           *pongCache
+	maintenance         *abool.AtomicBool
+	loops               *sync.WaitGroup
+	stop                chan struct{}
+	done                chan struct{}
+	dropIDs             [256]bool
+	faults              *faultInjector
+	pings               *pingForwarder
+	admin               *http.Server
+	currentCounters     *atomic.Value
+	mtu                 int
+	allowedClients      ipList
+	blockedClients      ipList
+	allowedBackends     backendList
+	bans                *ttlCache
+	usage               *usageTracker
+	pingBindAddrs       []*net.UDPAddr
+	pingServers         []net.PacketConn
+	staticRoutes        staticRoutes
+	events              *eventStream
+	running             *abool.AtomicBool
+	egress              *tokenBucket
+	ptrs                *ttlCache
+	pingServerAddress   *net.UDPAddr
+	blocklist           *blocklist
+	breaker             *circuitBreaker
+	connLog             *connLog
+	backends            *backendSet
+	alerts              *alerter
+	handshakes          *handshakeLimiter
+	// Sockets bound to the client port besides server, for ReadWorkers
+	readServers []*net.UDPConn
+	throughput  *throughput
+	grpc        *grpc.Server
+	// Message IDs exempt from RequireHandshake
+	handshakeExempt [256]bool
+	mirror          *mirror
 }
 
 type ProxyPrefs struct {
-	BindAddress  string
-	BindPort     uint16
-	RemoteServer string
-	IdleTimeout  time.Duration
-	EnableIPv6   bool
-	RemovePorts  bool
-	NumWorkers   uint
+	BindAddress  string        `json:"bind_address"`
+	BindPort     uint16        `json:"bind_port"`
+	RemoteServer string        `json:"server"`
+	IdleTimeout  time.Duration `json:"idle_timeout"`
+	EnableIPv6   bool          `json:"ipv6"`
+	RemovePorts  bool          `json:"remove_ports"`
+	NumWorkers   uint          `json:"workers"`
+	// Number of sockets bound to the client port with SO_REUSEPORT, each read
+	// by NumWorkers goroutines, so that the kernel spreads clients over them
+	// instead of every reader contending for one socket. Each client's packets
+	// keep arriving on the same socket, in order. Only supported on Linux,
+	// and not with ListenConn. Defaults to 1.
+	ReadWorkers int `json:"read_workers"`
+	// Leave the ports in pongs as the server sent them instead of advertising
+	// phantom's port, for servers that clients can also reach directly.
+	// RemovePorts takes precedence.
+	PreservePorts bool `json:"preserve_ports"`
+	// Bind only IPv6 sockets, for hosts without IPv4. Implies EnableIPv6 and
+	// PreferIPv6Backend, and an unspecified IPv4 BindAddress binds all IPv6
+	// addresses instead.
+	IPv6Only bool `json:"ipv6_only"`
+	// Use unconnected backend sockets so that sessions survive the backend
+	// changing its reply port after the handshake
+	UnconnectedBackend bool `json:"unconnected_backend"`
+	// With UnconnectedBackend, accept unconnected pongs from any port of the
+	// server's IP, like other packets. By default they are dropped and counted
+	// unless they come from the server address the connection was opened to,
+	// so that an off-path attacker can't inject pongs.
+	AllowAnyPongSource bool `json:"allow_any_pong_source"`
+	// How often to generate a new server ID, forcing clients to re-add the
+	// server to their list. Zero keeps one ID for the lifetime of the process.
+	ServerIDRotateInterval time.Duration `json:"rotate_id_interval"`
+	// Generates the server ID advertised in pongs, such as one derived from
+	// the hostname so that it stays the same across restarts or a fleet. It
+	// is called once when the proxy is created and again on every rotation.
+	// Nil uses a random ID.
+	ServerIDFunc func() int64 `json:"-"`
+	// How long the last pong from the backend may be served to clients while
+	// the backend is not replying, before falling back to the offline pong.
+	// Zero disables the cache.
+	PongCacheTTL time.Duration `json:"pong_cache_ttl"`
+	// Read bursts of packets from the server and send them on to the client
+	// with a single syscall where the platform supports it (experimental)
+	BatchWrites bool `json:"batch_writes"`
+	// When BindPort is 0, let the OS pick any free port instead of choosing
+	// one from phantom's random range. See BoundPort() for the chosen port.
+	UseEphemeralPort bool `json:"use_ephemeral_port"`
+	// Fields replacing those of every pong sent to clients, including the
+	// server ID and ports
+	PongOverrides proto.PongOverrides `json:"pong_overrides"`
+	// Append a per-client token to the MOTD in every pong, so that scrapers
+	// can't easily fingerprint the server by its replies
+	ObfuscateMOTD bool `json:"obfuscate_motd"`
+	// MOTD advertised while in maintenance mode. See SetMaintenance().
+	MaintenanceMOTD string `json:"maintenance_motd"`
+	// Size of the OS receive buffer for the proxy and ping listeners. Zero
+	// keeps the OS default.
+	ListenerReadBufferBytes int `json:"read_buffer_bytes"`
+	// DSCP value (0-63) to mark packets sent to clients with, for networks
+	// that prioritize traffic by it, such as 46 (Expedited Forwarding). Zero
+	// leaves packets unmarked.
+	ClientDSCP int `json:"client_dscp"`
+	// RakNet message IDs (the first byte of a packet) to drop instead of
+	// forwarding to the server. Dropping IDs the game relies on will break
+	// the protocol, so use with care. Empty disables the filter.
+	DropMessageIDs []byte `json:"drop_message_ids"`
+	// Drops packets from clients without a connection unless they start the
+	// RakNet handshake (Open Connection Request 1 or 2) or their message ID is
+	// one of HandshakeExemptIDs, so that spoofed floods of game traffic can't
+	// open connections to the server
+	RequireHandshake bool `json:"require_handshake"`
+	// Message IDs that clients without a connection may send despite
+	// RequireHandshake, such as from monitoring tools. Nil exempts
+	// unconnected pings, so that server lists keep working. Empty exempts
+	// nothing.
+	HandshakeExemptIDs []byte `json:"handshake_exempt_ids"`
+	// Testing only: probability (0 to 1) of dropping each forwarded packet,
+	// in both directions, to simulate a lossy network
+	DropProbability float64 `json:"drop_probability"`
+	// Seed for the random drops, for reproducible tests. Zero seeds from the
+	// current time.
+	FaultSeed int64 `json:"fault_seed"`
+	// Testing only: delay added to every forwarded packet, in both
+	// directions, to simulate a high-latency network
+	AddedLatency time.Duration `json:"added_latency"`
+	// How long to wait for the server to reply to a new client before telling
+	// the client the connection failed, so that it shows an error right away
+	// instead of timing out. Zero keeps waiting silently.
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+	// Address (host:port) for the admin HTTP server, which serves details of
+	// active connections as JSON at /connections, stats at /stats and
+	// Prometheus metrics at /metrics. Empty disables it.
+	AdminAddr string `json:"admin_addr"`
+	// Bearer token required by admin HTTP requests and gRPC calls that change
+	// state, such as adding blocks. Empty only allows them from localhost.
+	AdminToken string `json:"admin_token"`
+	// Connect to the server over IPv6 when its hostname resolves to both IPv4
+	// and IPv6 addresses
+	PreferIPv6Backend bool `json:"prefer_ipv6_backend"`
+	// Fraction (0..1) of packets traced when trace logging is enabled, to keep
+	// busy proxies from flooding the logs. 0 or 1 traces every packet.
+	// Packets are picked with the FaultSeed source, so runs can be repeated.
+	TraceSampleRate float64 `json:"trace_sample_rate"`
+	// Already-bound sockets to use for the proxy and ping listeners instead of
+	// binding them, such as those passed in by systemd socket activation. Nil
+	// binds as usual. phantom closes them when it stops.
+	ListenConn     *net.UDPConn   `json:"-"`
+	PingListenConn net.PacketConn `json:"-"`
+	// Largest reply sent to a ping from a client without a connection, as a
+	// multiple of the size of the ping. Larger replies are dropped so that
+	// phantom can't amplify reflection attacks. Zero uses a default of 20,
+	// which fits pongs with long MOTDs, and a negative value disables the
+	// limit.
+	PingAmplificationFactor float64 `json:"ping_amplification_factor"`
+	// How many other random ports to try when the randomly picked bind port
+	// is taken. Zero uses a default of 3, and a negative value disables
+	// retries. Ignored when BindPort is set.
+	BindRetries int `json:"bind_retries"`
+	// Local addresses to bind ping listeners to instead of all addresses, so
+	// that phantom only shows up in server lists on those networks. Each is an
+	// IP, which listens on 19132 (IPv4) or 19133 (IPv6), or an IP and port.
+	// On Linux a listener bound to a unicast address doesn't receive LAN
+	// broadcasts, so list the network's broadcast address too.
+	PingBindAddrs []string `json:"ping_bind_addrs"`
+	// Ports to listen on for LAN discovery pings instead of 19132 (IPv4) and
+	// 19133 (IPv6), for networks whose clients broadcast to other ports. Each
+	// port is bound for IPv4, and for IPv6 too with EnableIPv6. Addresses in
+	// PingBindAddrs given without a port listen on each of these ports.
+	PingPorts []uint16 `json:"ping_ports"`
+	// Pins clients to servers, mapping client IP addresses or CIDR ranges to
+	// server addresses. The most specific match wins. Clients that don't match
+	// are left to BackendSelector or RemoteServer.
+	StaticRoutes map[string]string `json:"static_routes"`
+	// Address (host:port) of a server to forward pings to instead of
+	// RemoteServer, such as a status responder separate from the game server.
+	// Its pongs are rewritten as usual, and whether it answers decides
+	// whether the server is shown as offline.
+	PingBackend string `json:"ping_backend"`
+	// Addresses (host:port) of servers to move new clients to, in order, when
+	// connections to the current server time out or are refused. They are
+	// resolved at startup and every few minutes after, so failing over needs
+	// no DNS lookup. Pings still go to RemoteServer, or PingBackend if set.
+	FallbackServers []string `json:"fallback_servers"`
+	// How often to ping RemoteServer and each of the FallbackServers. New
+	// clients skip servers that failed HealthCheckFailures checks in a row
+	// until they answer again. Zero disables health checks.
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	// Number of failed health checks in a row after which a server is
+	// skipped. Defaults to 3.
+	HealthCheckFailures int `json:"health_check_failures"`
+	// What to do with new clients while every server is unhealthy: connect
+	// them to the server whose last failed health check was longest ago
+	// (AllUnhealthyLeastRecentlyFailed, the default), or refuse them and
+	// answer pings with an offline pong (AllUnhealthyReject)
+	AllUnhealthyPolicy string `json:"all_unhealthy_policy"`
+	// How long after DrainBackend the connections still on the drained server
+	// are closed, so that their players reconnect to another. Zero leaves
+	// them until they disconnect.
+	DrainGracePeriod time.Duration `json:"drain_grace_period"`
+	// Picks the server for each new client, overriding RemoteServer. Returning
+	// nil refuses the client. Pings are still answered by RemoteServer, or
+	// PingBackend if set.
+	BackendSelector func(client net.Addr) *net.UDPAddr `json:"-"`
+	// Opens every connection to servers, including the ping connections, in
+	// place of the OS network stack. This allows servers that are only
+	// reachable through a userspace network, such as wireguard-go's netstack,
+	// by wrapping its DialUDP. Can't be used with UnconnectedBackend.
+	BackendNetwork func(remote *net.UDPAddr) (net.Conn, error) `json:"-"`
+	// Number of shared sockets used in turn to forward pings to the server.
+	// Defaults to 1.
+	BackendPoolSize int `json:"backend_pool_size"`
+	// Maximum number of clients with pings awaiting a pong from the server,
+	// or 0 for no limit. When a new client pings at the limit, the pings of
+	// the least recent one are forgotten, so floods of pings from many
+	// addresses use bounded memory. Unlike MaxConnections, this doesn't
+	// affect connected players.
+	MaxPingSources int `json:"max_ping_sources"`
+	// Maximum number of client connections, or 0 for no limit
+	MaxConnections int `json:"max_connections"`
+	// Tell clients refused because MaxConnections is reached that the server
+	// is full, so that they show it right away instead of timing out
+	SendFullResponse bool `json:"send_full_response"`
+	// What to do with a new client when MaxConnections is reached: refuse it
+	// (OverflowReject, the default) or evict the least recently active
+	// connection to make room for it (OverflowEvictLRU)
+	OverflowPolicy string `json:"overflow_policy"`
+	// Maximum number of new connections waiting on the server's first reply
+	// at once, or 0 for no limit. Packets from further new clients are
+	// dropped until a slot frees up, and the clients retry, which smooths
+	// the storm of reconnects after a server restart.
+	MaxConcurrentHandshakes int `json:"max_concurrent_handshakes"`
+	// How clients are told apart: by IP address and port (ClientKeyAddr, the
+	// default), or by IP address alone (ClientKeyIP) for running behind a load
+	// balancer that doesn't preserve source ports. Keying by IP merges every
+	// client behind the same NAT into one connection, so only one of them can
+	// play at a time.
+	ClientKey string `json:"client_key"`
+	// Keep IPv4-mapped IPv6 client addresses (::ffff:1.2.3.4) as the listener
+	// reports them. By default they are converted to plain IPv4 addresses, so
+	// that a client on a dual-stack listener has one connection, and one
+	// entry in per-IP limits, however its address is reported.
+	KeepMappedAddrs bool `json:"keep_mapped_addrs"`
+	// IPv4 or IPv6 addresses and CIDR ranges of the only clients allowed to
+	// use the proxy. Empty allows every client.
+	AllowedClients []string `json:"allowed_clients"`
+	// IPv4 or IPv6 addresses and CIDR ranges of clients whose packets are
+	// dropped, even if they are also allowed
+	BlockedClients []string `json:"blocked_clients"`
+	// Path of a JSON file that IPs blocked with Block() are saved to every few
+	// seconds and restored from at startup, with their expiry times. Empty
+	// keeps them in memory only.
+	BlocklistStatePath string `json:"blocklist_state_path"`
+	// Number of consecutive failed connections to the server, where it timed
+	// out or refused them, after which new connections are refused for
+	// BreakerCooldown. Then one is let through to probe whether the server
+	// has recovered. Zero disables the circuit breaker.
+	BreakerThreshold int `json:"breaker_threshold"`
+	// How long new connections are refused once BreakerThreshold is reached.
+	// Defaults to 30 seconds.
+	BreakerCooldown time.Duration `json:"breaker_cooldown"`
+	// Ping the server in Start() and fail to start if it doesn't answer, to
+	// catch misconfiguration early. This delays startup by a few seconds when
+	// the server is down.
+	CheckBackendAtStart bool `json:"check_backend_at_start"`
+	// IP addresses, CIDR ranges or hostnames, each optionally with a port, of
+	// the only servers phantom may connect to. RemoteServer and every server
+	// picked by BackendSelector are checked against it. Empty allows any.
+	AllowedBackends []string `json:"allowed_backends"`
+	// How long to wait for the server to answer a client before closing the
+	// connection, counted from the client's latest packet. Zero uses
+	// IdleTimeout. Independently, a client that sends nothing for IdleTimeout
+	// is evicted by the idle sweep every few seconds, which also closes its
+	// connection, so a connection lasts until whichever of the two expires
+	// first. Set it below IdleTimeout to give up sooner on a server that has
+	// stopped answering.
+	BackendIdleTimeout time.Duration `json:"backend_idle_timeout"`
+	// Decides whether each connection is evicted when idle connections are
+	// swept, every few seconds, in place of the IdleTimeout check. It is
+	// called with the connection map locked, so it must be cheap and must not
+	// call back into the proxy. Nil evicts connections idle for IdleTimeout.
+	ShouldEvict func(info clientmap.ConnInfo) bool `json:"-"`
+	// Host and port players should connect to, shown at startup. They default
+	// to this host's address and the port the proxy listens on.
+	AdvertiseHost string `json:"advertise_host"`
+	AdvertisePort uint16 `json:"advertise_port"`
+	// Look up this host's public IP from an external service to show at
+	// startup, when AdvertiseHost is not set
+	DetectPublicIP bool `json:"detect_public_ip"`
+	// Consulted with the client's IP before opening a connection for a new
+	// client, to integrate with an external ban service. Returning true drops
+	// the client's packets. It is called in the background, and the client's
+	// packets are dropped until it returns. Nil disables it.
+	BanChecker func(ip net.IP) bool `json:"-"`
+	// How long BanChecker answers are cached for each IP. Defaults to a minute.
+	BanCacheTTL time.Duration `json:"ban_cache_ttl"`
+	// Window over which the bytes sent and received by each connected client
+	// IP are totalled across its connections, see Usage(). A total starts over
+	// once its window has passed. Zero disables usage tracking.
+	UsageWindow time.Duration `json:"usage_window"`
+	// Drop packets from client IPs whose usage exceeds this many bytes within
+	// their current UsageWindow. Zero disables the quota. Requires UsageWindow.
+	UsageQuotaBytes uint64 `json:"usage_quota_bytes"`
+	// Limit on the bytes per second sent to all clients together, to cap the
+	// cost of a metered uplink. Packets from the server are held back briefly
+	// when over the limit, and dropped if that isn't enough. Zero disables it.
+	TotalEgressBytesPerSec int `json:"total_egress_bytes_per_sec"`
+	// How long TotalEgressBytesPerSec takes to ramp up from a tenth to the
+	// full rate after startup, to smooth the storm of reconnects that follows
+	// a restart. Zero allows the full rate right away.
+	EgressRampUp time.Duration `json:"egress_ramp_up"`
+	// Drop packets from clients that don't look like RakNet, such as from port
+	// scanners, instead of opening a connection to the server for them. They
+	// are counted in Stats either way.
+	DropUnknownPackets bool `json:"drop_unknown_packets"`
+	// Forward zero-length datagrams from clients to the server, opening a
+	// connection for the client if needed, instead of dropping them. They are
+	// not RakNet, but some tools send them as keep-alives. Empty datagrams
+	// from the server are still dropped.
+	ForwardEmptyPackets bool `json:"forward_empty_packets"`
+	// Ping the server on sessions that have been quiet for a while, to keep
+	// NAT bindings between phantom and the server from expiring
+	KeepAlive bool `json:"keep_alive"`
+	// Look up the reverse DNS names of new clients in the background, to log
+	// them and show them in connection stats. Off by default, since lookups
+	// add load on the DNS server.
+	ResolveClientPTR bool `json:"resolve_client_ptr"`
+	// Max players advertised in pongs in place of the server's, when positive.
+	// The player count is left alone.
+	MaxPlayersOverride int `json:"max_players_override"`
+	// Path of a Unix socket to listen on for local programs that want a stream
+	// of connect and disconnect events, as newline-delimited JSON. Events are
+	// dropped for readers that fall behind.
+	EventSocketPath string `json:"event_socket_path"`
+	// Path of a file to append a line of JSON to for every completed
+	// connection, as an audit trail. See ConnRecord.
+	ConnLogPath string `json:"conn_log_path"`
+	// Size in bytes past which the connection log is rotated, keeping 5 old
+	// files as ConnLogPath.1 to .5. Zero never rotates it, leaving that to an
+	// external tool followed by ReopenConnLog().
+	ConnLogMaxBytes int64 `json:"conn_log_max_bytes"`
+	// Address (host:port) of a StatsD server to push the same stats as
+	// /metrics to over UDP, independently of the admin server. Empty disables
+	// it.
+	StatsdAddr string `json:"statsd_addr"`
+	// Address (host:port) to send a copy of every packet forwarded from
+	// clients to the server to over UDP, such as an IDS or packet analyzer.
+	// Copies are sent best-effort from a separate goroutine, and dropped if
+	// they can't keep up, so they never hold up the packets themselves.
+	// Empty disables it.
+	MirrorAddr string `json:"mirror_addr"`
+	// How often to push stats to StatsD and Metrics. Defaults to 10 seconds.
+	StatsdInterval time.Duration `json:"statsd_interval"`
+	// Receives the metrics, in addition to /metrics and StatsdAddr, for
+	// monitoring systems phantom doesn't support itself. Nil disables it.
+	Metrics MetricsSink `json:"-"`
+	// URL to POST an Alert to as JSON when the number of connections reaches
+	// AlertHighConnections or drops below AlertLowConnections, and when it
+	// returns between them. Alerts are at least a minute apart. Empty
+	// disables alerts.
+	AlertWebhook string `json:"alert_webhook"`
+	// Number of connections at which to alert that the proxy is busy, or 0
+	// for never
+	AlertHighConnections int `json:"alert_high_connections"`
+	// Number of connections below which to alert that the proxy is idle, or
+	// 0 for never
+	AlertLowConnections int `json:"alert_low_connections"`
+	// Name for this proxy in metrics, useful when running several in one
+	// process. Defaults to the port it listens on.
+	Label string `json:"label"`
+	// Probe the largest packet size the server answers at startup and size
+	// buffers to match, instead of assuming 1472 bytes. Only supported on
+	// Linux and Windows, and not with BackendNetwork.
+	AutoMTU bool `json:"auto_mtu"`
+	// Address (host:port) for a gRPC server exposing stats, connections,
+	// disconnects, maintenance mode and reloads to control planes, as defined
+	// in internal/adminpb/admin.proto. Empty disables it.
+	GRPCAddr string `json:"grpc_addr"`
 }
 
 var randSource = rand.NewSource(time.Now().UnixNano())
+var randMutex = &sync.Mutex{}
 var serverID = randSource.Int63()
 var offlineErrorRegex = regexp.MustCompile("(timeout)|(connection refused)")
 
+// How many other random ports Start tries when BindRetries is not set
+const defaultBindRetries = 3
+
+// Picks a port from phantom's random range
+func randomPort() uint16 {
+	randMutex.Lock()
+	defer randMutex.Unlock()
+
+	return (uint16(randSource.Int63()) % 14000) + 50000
+}
+
 func New(prefs ProxyPrefs) (*ProxyServer, error) {
+	if prefs.IPv6Only {
+		prefs.EnableIPv6 = true
+		prefs.PreferIPv6Backend = true
+	}
+
 	bindPort := prefs.BindPort
 
 	// Randomize port if not provided
-	if bindPort == 0 {
-		bindPort = (uint16(randSource.Int63()) % 14000) + 50000
+	if bindPort == 0 && !prefs.UseEphemeralPort {
+		bindPort = randomPort()
 	}
 
 	// Format full bind address with port
-	prefs.BindAddress = fmt.Sprintf("%s:%d", prefs.BindAddress, bindPort)
+	prefs.BindAddress = net.JoinHostPort(strings.Trim(prefs.BindAddress, "[]"), fmt.Sprintf("%d", bindPort))
 
 	bindAddress, err := net.ResolveUDPAddr("udp", prefs.BindAddress)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid bind address: %s", err)
 	}
 
-	remoteServerAddress, err := net.ResolveUDPAddr("udp", prefs.RemoteServer)
+	if prefs.IPv6Only && bindAddress.IP.To4() != nil {
+		if !bindAddress.IP.IsUnspecified() {
+			return nil, fmt.Errorf("Invalid bind address: %s is not an IPv6 address", bindAddress.IP)
+		}
+
+		bindAddress.IP = net.IPv6unspecified
+	}
+
+	remoteServerAddress, err := resolveServerAddress(prefs.RemoteServer, prefs.PreferIPv6Backend)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid server address: %s", err)
 	}
 
+	allowedBackends, err := parseBackendList(prefs.AllowedBackends)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid allowed backends: %s", err)
+	}
+
+	if !allowedBackends.allows(remoteServerAddress) {
+		return nil, fmt.Errorf("Server %s is not an allowed backend", remoteServerAddress)
+	}
+
+	pingServerAddress := remoteServerAddress
+	if prefs.PingBackend != "" {
+		pingServerAddress, err = resolveServerAddress(prefs.PingBackend, prefs.PreferIPv6Backend)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ping server address: %s", err)
+		}
+
+		if !allowedBackends.allows(pingServerAddress) {
+			return nil, fmt.Errorf("Ping server %s is not an allowed backend", pingServerAddress)
+		}
+	}
+
+	for _, port := range prefs.PingPorts {
+		if port == 0 {
+			return nil, fmt.Errorf("Ping ports must not be 0")
+		}
+	}
+
+	pingBindAddrs, err := parsePingBindAddrs(prefs.PingBindAddrs, prefs.PingPorts)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ping bind address: %s", err)
+	}
+
+	staticRoutes, err := parseStaticRoutes(prefs.StaticRoutes, prefs.PreferIPv6Backend)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid static route: %s", err)
+	}
+
+	for _, route := range staticRoutes {
+		if !allowedBackends.allows(route.backend) {
+			return nil, fmt.Errorf("Server %s routed to from %s is not an allowed backend", route.backend, route.network)
+		}
+	}
+
+	backends, err := newBackendSet(prefs.RemoteServer, remoteServerAddress, prefs.FallbackServers, prefs.PreferIPv6Backend, prefs.HealthCheckFailures)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fallback server address: %s", err)
+	}
+
+	for _, fallback := range backends.all()[1:] {
+		if !allowedBackends.allows(fallback) {
+			return nil, fmt.Errorf("Fallback server %s is not an allowed backend", fallback)
+		}
+	}
+
+	// Refuse servers that are phantom itself
+	listeners := listenAddrs(prefs, bindAddress, pingBindAddrs)
+	for _, backend := range backends.all() {
+		if err := checkLoop(backend, listeners); err != nil {
+			return nil, fmt.Errorf("Invalid server address: %s", err)
+		}
+	}
+
+	if err := checkLoop(pingServerAddress, listeners); err != nil {
+		return nil, fmt.Errorf("Invalid ping server address: %s", err)
+	}
+
+	for _, route := range staticRoutes {
+		if err := checkLoop(route.backend, listeners); err != nil {
+			return nil, fmt.Errorf("Invalid static route: %s", err)
+		}
+	}
+
+	var egress *tokenBucket
+	if prefs.TotalEgressBytesPerSec > 0 {
+		egress = newTokenBucket(prefs.TotalEgressBytesPerSec, prefs.EgressRampUp)
+	}
+
+	var ptrs *ttlCache
+	if prefs.ResolveClientPTR {
+		ptrs = newPTRCache(net.DefaultResolver.LookupAddr)
+	}
+
+	var bans *ttlCache
+	if prefs.BanChecker != nil {
+		bans = newBanCache(prefs.BanChecker, prefs.BanCacheTTL)
+	}
+
+	var usage *usageTracker
+	if prefs.UsageWindow > 0 {
+		usage = newUsageTracker(prefs.UsageWindow)
+	}
+
+	exemptIDs := prefs.HandshakeExemptIDs
+	if exemptIDs == nil {
+		exemptIDs = defaultHandshakeExemptIDs
+	}
+
+	var handshakeExempt [256]bool
+	for _, id := range exemptIDs {
+		handshakeExempt[id] = true
+	}
+
+	var dropIDs [256]bool
+	for _, id := range prefs.DropMessageIDs {
+		dropIDs[id] = true
+	}
+
+	currentCounters := &atomic.Value{}
+	currentCounters.Store(&counters{})
+
+	allowedClients, err := parseIPList(prefs.AllowedClients)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid allowed clients: %s", err)
+	}
+
+	blockedClients, err := parseIPList(prefs.BlockedClients)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blocked clients: %s", err)
+	}
+
+	blocklist, err := newBlocklist(prefs.BlocklistStatePath)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blocklist state: %s", err)
+	}
+
+	if prefs.BackendNetwork != nil && prefs.UnconnectedBackend {
+		return nil, fmt.Errorf("UnconnectedBackend can't be used with BackendNetwork")
+	}
+
+	if prefs.ClientDSCP < 0 || prefs.ClientDSCP > 63 {
+		return nil, fmt.Errorf("Invalid client DSCP %d, must be between 0 and 63", prefs.ClientDSCP)
+	}
+
+	if prefs.OverflowPolicy != "" && prefs.OverflowPolicy != OverflowReject && prefs.OverflowPolicy != OverflowEvictLRU {
+		return nil, fmt.Errorf("Invalid overflow policy: %s", prefs.OverflowPolicy)
+	}
+
+	if prefs.AllUnhealthyPolicy != "" && prefs.AllUnhealthyPolicy != AllUnhealthyLeastRecentlyFailed && prefs.AllUnhealthyPolicy != AllUnhealthyReject {
+		return nil, fmt.Errorf("Invalid all unhealthy policy: %s", prefs.AllUnhealthyPolicy)
+	}
+
+	if prefs.ClientKey != "" && prefs.ClientKey != ClientKeyAddr && prefs.ClientKey != ClientKeyIP {
+		return nil, fmt.Errorf("Invalid client key: %s", prefs.ClientKey)
+	}
+
+	clientMap := clientmap.New(prefs.IdleTimeout, idleCheckInterval)
+	clientMap.UnconnectedBackend = prefs.UnconnectedBackend
+	clientMap.VerifyPongSource = !prefs.AllowAnyPongSource
+	clientMap.OnUnexpectedReply = func(from net.Addr) {
+		currentCounters.Load().(*counters).dropped()
+	}
+	clientMap.Dial = prefs.BackendNetwork
+	clientMap.DialRetries = backendDialRetries
+	clientMap.OnDialRetry = func(remote *net.UDPAddr, err error) {
+		currentCounters.Load().(*counters).dialRetried()
+	}
+	clientMap.MaxClients = prefs.MaxConnections
+	clientMap.EvictLRU = prefs.OverflowPolicy == OverflowEvictLRU
+	clientMap.ShouldEvict = prefs.ShouldEvict
+	clientMap.KeyByIP = prefs.ClientKey == ClientKeyIP
+
+	id := serverID
+	if prefs.ServerIDFunc != nil {
+		id = prefs.ServerIDFunc()
+	}
+
 	return &ProxyServer{
+		id,
 		bindAddress,
-		bindPort,
+		uint32(bindPort),
 		remoteServerAddress,
 		nil,
 		nil,
 		nil,
-		clientmap.New(prefs.IdleTimeout, idleCheckInterval),
+		clientMap,
 		prefs,
 		abool.New(),
-		false,
+		abool.New(),
+		make(chan error, errorBufferSize),
+		newPongCache(),
+		abool.New(),
+		&sync.WaitGroup{},
+		make(chan struct{}),
+		make(chan struct{}),
+		dropIDs,
+		newFaultInjector(prefs),
+		nil,
+		nil,
+		currentCounters,
+		maxMTU,
+		allowedClients,
+		blockedClients,
+		allowedBackends,
+		bans,
+		usage,
+		pingBindAddrs,
+		nil,
+		staticRoutes,
+		nil,
+		abool.New(),
+		egress,
+		ptrs,
+		pingServerAddress,
+		blocklist,
+		newCircuitBreaker(prefs.BreakerThreshold, prefs.BreakerCooldown),
+		nil,
+		backends,
+		newAlerter(prefs.AlertHighConnections, prefs.AlertLowConnections),
+		newHandshakeLimiter(prefs.MaxConcurrentHandshakes),
+		nil,
+		newThroughput(currentCounters.Load().(*counters), time.Now()),
+		nil,
+		handshakeExempt,
+		nil,
 	}, nil
 }
 
+// Parses ping bind addresses. Addresses without a port listen on each of the
+// ports, or if there are none the port Minecraft broadcasts pings to for the
+// address family.
+func parsePingBindAddrs(addrs []string, ports []uint16) ([]*net.UDPAddr, error) {
+	parsed := make([]*net.UDPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(addr); ip != nil {
+			for _, port := range ports {
+				parsed = append(parsed, &net.UDPAddr{IP: ip, Port: int(port)})
+			}
+
+			if len(ports) > 0 {
+				continue
+			}
+
+			port := 19132
+			if ip.To4() == nil {
+				port = 19133
+			}
+
+			parsed = append(parsed, &net.UDPAddr{IP: ip, Port: port})
+			continue
+		}
+
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if udpAddr.IP == nil {
+			return nil, fmt.Errorf("%s has no IP address", addr)
+		}
+
+		parsed = append(parsed, udpAddr)
+	}
+
+	return parsed, nil
+}
+
+// Binds ping listeners to the port on all addresses, for IPv4 unless
+// IPv6Only is set and for IPv6 if it is enabled
+func (proxy *ProxyServer) bindPingPort(port uint16) error {
+	addr := fmt.Sprintf(":%d", port)
+
+	if !proxy.prefs.IPv6Only {
+		log.Info().Msgf("Binding ping server to port %d", port)
+		pingServer, err := reuse.ListenPacket("udp4", addr)
+		if err != nil {
+			return wrapBindError(err, int(port))
+		}
+
+		proxy.pingServers = append(proxy.pingServers, pingServer)
+	}
+
+	if proxy.prefs.EnableIPv6 {
+		log.Info().Msgf("Binding IPv6 ping server to port %d", port)
+		if pingServerV6, err := reuse.ListenPacket("udp6", addr); err == nil {
+			proxy.pingServers = append(proxy.pingServers, pingServerV6)
+		} else {
+			log.Warn().Msgf("Failed to bind IPv6 ping listener on port %d: %v", port, err)
+		}
+	}
+
+	return nil
+}
+
+// Start binds the proxy's sockets and serves clients until Close is called.
+// If it fails partway, whatever it started is closed again, so Done() is
+// closed either way.
 func (proxy *ProxyServer) Start() error {
+	if err := proxy.start(); err != nil {
+		proxy.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (proxy *ProxyServer) start() error {
+	if proxy.prefs.CheckBackendAtStart {
+		if err := checkBackend(proxy.dialBackend, proxy.remoteServerAddress); err != nil {
+			return err
+		}
+	}
+
+	// Set up before any listener, since all of them forward packets
+	if proxy.prefs.MirrorAddr != "" {
+		log.Info().Msgf("Mirroring packets from clients to: %s", proxy.prefs.MirrorAddr)
+		mirror, err := newMirror(proxy.prefs.MirrorAddr)
+		if err != nil {
+			return err
+		}
+
+		proxy.mirror = mirror
+		proxy.goLoop(func() { proxy.mirrorLoop(mirror) })
+	}
+
+	if proxy.prefs.AutoMTU {
+		proxy.mtu = probeMTU(proxy.dialBackend, proxy.remoteServerAddress)
+	}
+
+	// Pings from all clients share a pool of connections to the server
+	if pings, err := newPingForwarder(proxy.dialBackend, proxy.pingServerAddress, proxy.prefs.BackendPoolSize, proxy.prefs.MaxPingSources); err == nil {
+		proxy.pings = pings
+
+		for _, conn := range pings.conns {
+			conn := conn
+			proxy.goLoop(func() { proxy.processPongsFromServer(conn) })
+		}
+	} else {
+		return err
+	}
+
 	// Bind to 19132 on all addresses to receive broadcasted pings
 	// Sets SO_REUSEADDR et al to support multiple instances of phantom
-	log.Info().Msgf("Binding ping server to port 19132")
-	if pingServer, err := reuse.ListenPacket("udp4", ":19132"); err == nil {
+	if proxy.prefs.PingListenConn != nil {
+		log.Info().Msgf("Using provided ping server on %v", proxy.prefs.PingListenConn.LocalAddr())
+		proxy.pingServer = proxy.prefs.PingListenConn
+	} else if len(proxy.pingBindAddrs) > 0 {
+		for _, addr := range proxy.pingBindAddrs {
+			network := "udp4"
+			if addr.IP.To4() == nil {
+				network = "udp6"
+			}
+
+			log.Info().Msgf("Binding ping server to: %v", addr)
+			pingServer, err := reuse.ListenPacket(network, addr.String())
+			if err != nil {
+				return wrapBindError(err, addr.Port)
+			}
+
+			proxy.pingServers = append(proxy.pingServers, pingServer)
+		}
+	} else if len(proxy.prefs.PingPorts) > 0 {
+		for _, port := range proxy.prefs.PingPorts {
+			if err := proxy.bindPingPort(port); err != nil {
+				return err
+			}
+		}
+	} else if proxy.prefs.IPv6Only {
+		log.Info().Msgf("Not binding IPv4 ping server to port 19132, only using IPv6")
+	} else {
+		log.Info().Msgf("Binding ping server to port 19132")
+		pingServer, err := reuse.ListenPacket("udp4", ":19132")
+		if err != nil {
+			// Bind failed
+			return wrapBindError(err, 19132)
+		}
+
 		proxy.pingServer = pingServer
+	}
+
+	// Start proxying ping packets from the broadcast listeners
+	if proxy.pingServer != nil {
+		proxy.goLoop(func() { proxy.readLoop(proxy.pingServer) })
+	}
 
-		// Start proxying ping packets from the broadcast listener
-		go proxy.readLoop(proxy.pingServer)
+	for _, pingServer := range proxy.pingServers {
+		pingServer := pingServer
+		proxy.goLoop(func() { proxy.readLoop(pingServer) })
+	}
+
+	// Minecraft automatically broadcasts on port 19133 to the local IPv6 network
+	if proxy.prefs.EnableIPv6 && len(proxy.pingBindAddrs) == 0 && len(proxy.prefs.PingPorts) == 0 {
+		log.Info().Msgf("Binding IPv6 ping server to port 19133")
+		if pingServerV6, err := reuse.ListenPacket("udp6", ":19133"); err == nil {
+			proxy.pingServerV6 = pingServerV6
+
+			// Start proxying ping packets from the broadcast listener
+			proxy.goLoop(func() { proxy.readLoop(proxy.pingServerV6) })
+		} else {
+			// IPv6 Bind failed
+			log.Warn().Msgf("Failed to bind IPv6 ping listener: %v", err)
+		}
+	}
+
+	network := "udp4"
+	if proxy.prefs.IPv6Only {
+		network = "udp6"
+	} else if proxy.prefs.EnableIPv6 {
+		network = "udp"
+	}
+
+	// Bind to specified UDP addr and port to receive data from Minecraft clients
+	if proxy.prefs.ListenConn != nil {
+		log.Info().Msgf("Using provided proxy server on %v", proxy.prefs.ListenConn.LocalAddr())
+		proxy.server = proxy.prefs.ListenConn
+
+		// The port is learned from the socket below
+		atomic.StoreUint32(&proxy.boundPort, 0)
 	} else {
-		// Bind failed
-		return err
+		log.Info().Msgf("Binding proxy server to: %v", proxy.bindAddress)
+		server, err := proxy.listenBindAddress(network)
+
+		// A random port may be taken by something else, so try a few others
+		for retry := 0; err != nil && proxy.randomBindPort() && retry < proxy.bindRetries(); retry++ {
+			port := randomPort()
+			log.Debug().Msgf("Failed to bind port %d, retrying with port %d: %v", proxy.bindAddress.Port, port, err)
+
+			proxy.bindAddress.Port = int(port)
+			atomic.StoreUint32(&proxy.boundPort, uint32(port))
+			server, err = proxy.listenBindAddress(network)
+		}
+
+		if err != nil {
+			return wrapBindError(err, proxy.bindAddress.Port)
+		}
+
+		// a safe cast, I promise
+		proxy.server = server.(*net.UDPConn)
+
+		if err := proxy.bindReadWorkers(network); err != nil {
+			return err
+		}
+	}
+
+	if proxy.prefs.ListenerReadBufferBytes > 0 {
+		listeners := append([]net.PacketConn{proxy.server, proxy.pingServer, proxy.pingServerV6}, proxy.pingServers...)
+		for _, server := range proxy.readServers {
+			listeners = append(listeners, server)
+		}
+
+		for _, listener := range listeners {
+			if listener != nil {
+				proxy.setReadBuffer(listener, proxy.prefs.ListenerReadBufferBytes)
+			}
+		}
+	}
+
+	if proxy.prefs.ClientDSCP > 0 {
+		setDSCP(proxy.server, proxy.prefs.ClientDSCP)
+
+		for _, server := range proxy.readServers {
+			setDSCP(server, proxy.prefs.ClientDSCP)
+		}
+	}
+
+	// Learn the port the OS picked for us
+	if proxy.BoundPort() == 0 {
+		port := proxy.server.LocalAddr().(*net.UDPAddr).Port
+		atomic.StoreUint32(&proxy.boundPort, uint32(port))
+		log.Info().Msgf("Proxy server bound to port %d", port)
+	}
+
+	if proxy.prefs.AdminAddr != "" {
+		if err := proxy.startAdminServer(proxy.prefs.AdminAddr); err != nil {
+			return err
+		}
 	}
 
-	// Minecraft automatically broadcasts on port 19133 to the local IPv6 network
-	if proxy.prefs.EnableIPv6 {
-		log.Info().Msgf("Binding IPv6 ping server to port 19133")
-		if pingServerV6, err := reuse.ListenPacket("udp6", ":19133"); err == nil {
-			proxy.pingServerV6 = pingServerV6
+	if proxy.prefs.GRPCAddr != "" {
+		if err := proxy.startGRPCServer(proxy.prefs.GRPCAddr); err != nil {
+			return err
+		}
+	}
+
+	if proxy.prefs.StatsdAddr != "" {
+		log.Info().Msgf("Sending stats to StatsD at: %s", proxy.prefs.StatsdAddr)
+		conn, err := net.Dial("udp", proxy.prefs.StatsdAddr)
+		if err != nil {
+			return err
+		}
+
+		proxy.goLoop(func() { proxy.statsdLoop(conn) })
+	}
+
+	if proxy.prefs.Metrics != nil {
+		proxy.goLoop(func() { proxy.metricsLoop(proxy.prefs.Metrics, nil) })
+	}
+
+	if proxy.prefs.EventSocketPath != "" {
+		log.Info().Msgf("Streaming connection events to: %s", proxy.prefs.EventSocketPath)
+		events, err := newEventStream(proxy.prefs.EventSocketPath)
+		if err != nil {
+			return err
+		}
+
+		proxy.events = events
+		proxy.goLoop(events.serve)
+	}
+
+	if proxy.prefs.ConnLogPath != "" {
+		log.Info().Msgf("Logging connections to: %s", proxy.prefs.ConnLogPath)
+		connLog, err := newConnLog(proxy.prefs.ConnLogPath, proxy.prefs.ConnLogMaxBytes)
+		if err != nil {
+			return err
+		}
+
+		proxy.connLog = connLog
+	}
+
+	proxy.goLoop(proxy.housekeepingLoop)
+
+	if len(proxy.backends.names) > 1 {
+		proxy.goLoop(func() { proxy.refreshBackendsLoop(backendRefreshInterval) })
+	}
+
+	if proxy.prefs.HealthCheckInterval > 0 {
+		proxy.goLoop(func() { proxy.healthCheckLoop(proxy.prefs.HealthCheckInterval) })
+	}
+
+	if proxy.prefs.ServerIDRotateInterval > 0 {
+		proxy.goLoop(func() { proxy.rotateServerIDLoop(proxy.prefs.ServerIDRotateInterval) })
+	}
+
+	proxy.running.Set()
+
+	log.Info().Msgf("Proxy server listening!")
+	log.Info().Msgf("Players can connect directly to: %s", proxy.advertisedAddress())
+	log.Info().Msgf("Once your console pings phantom, you should see replies below.")
+
+	// Start processing everything else using the proxy listener
+	proxy.startWorkers(proxy.server)
+
+	return nil
+}
+
+func (proxy *ProxyServer) Close() {
+	log.Info().Msgf("Stopping proxy server")
+
+	// Stop UDP listeners
+	if proxy.server != nil {
+		proxy.server.Close()
+	}
+
+	for _, server := range proxy.readServers {
+		server.Close()
+	}
+
+	if proxy.pingServer != nil {
+		proxy.pingServer.Close()
+	}
+
+	if proxy.pingServerV6 != nil {
+		proxy.pingServerV6.Close()
+	}
+
+	for _, pingServer := range proxy.pingServers {
+		pingServer.Close()
+	}
+
+	// Close all connections
+	proxy.clientMap.Close()
+
+	if proxy.pings != nil {
+		proxy.pings.Close()
+	}
+
+	if proxy.admin != nil {
+		proxy.admin.Close()
+	}
+
+	if proxy.grpc != nil {
+		proxy.grpc.Stop()
+	}
+
+	if proxy.events != nil {
+		proxy.events.Close()
+	}
+
+	proxy.saveBlocklist()
+
+	// Stop loops
+	if proxy.dead.SetToIf(false, true) {
+		close(proxy.stop)
+
+		// Signal Done() once everything has wound down, closing the
+		// connection log once the last connection has been logged
+		go func() {
+			proxy.loops.Wait()
+
+			if proxy.connLog != nil {
+				proxy.connLog.Close()
+			}
+
+			close(proxy.done)
+		}()
+	}
+}
+
+// Done returns a channel that is closed once the proxy has been closed and
+// all of its loops have exited.
+func (proxy *ProxyServer) Done() <-chan struct{} {
+	return proxy.done
+}
+
+// Runs a loop in a new goroutine, tracked so that Done() waits for it
+func (proxy *ProxyServer) goLoop(loop func()) {
+	proxy.loops.Add(1)
+
+	go func() {
+		defer proxy.loops.Done()
+		loop()
+	}()
+}
+
+// IsRunning returns whether the proxy has bound its listeners and has not
+// been closed since.
+func (proxy *ProxyServer) IsRunning() bool {
+	return proxy.running.IsSet() && !proxy.dead.IsSet()
+}
+
+// ConnectionCount returns the number of clients currently connected
+func (proxy *ProxyServer) ConnectionCount() int {
+	return proxy.clientMap.Len()
+}
+
+// Range calls the function with each current connection until it returns
+// false. Unlike the /connections admin route, it doesn't copy the whole list.
+// Connections can't be added or removed meanwhile, so the function should be
+// quick and must not call back into the proxy.
+func (proxy *ProxyServer) Range(fn func(clientmap.ConnInfo) bool) {
+	proxy.clientMap.Range(func(conn *clientmap.ServerConn) bool {
+		return fn(conn.Info())
+	})
+}
+
+// BoundPort returns the port the proxy server listens on. When binding to an
+// OS-chosen port, it is only known once Start() has bound the listener.
+func (proxy *ProxyServer) BoundPort() uint16 {
+	return uint16(atomic.LoadUint32(&proxy.boundPort))
+}
+
+// RemoteAddr returns the address RemoteServer resolved to, or the fallback
+// server failed over to, which new clients are connected to unless a
+// BackendSelector picks another server.
+func (proxy *ProxyServer) RemoteAddr() *net.UDPAddr {
+	return proxy.backends.current()
+}
+
+// EffectivePrefs returns a copy of the prefs the proxy is running with, with
+// the values it worked out filled in: the bind IP and port it picked, the
+// addresses the servers resolved to, and the defaults used for zero values.
+// Changing the copy has no effect on the proxy.
+func (proxy *ProxyServer) EffectivePrefs() ProxyPrefs {
+	prefs := proxy.prefs
+
+	prefs.BindAddress = proxy.bindAddress.IP.String()
+	prefs.BindPort = proxy.BoundPort()
+	prefs.RemoteServer = proxy.RemoteAddr().String()
+	prefs.PingBackend = proxy.pingServerAddress.String()
+
+	prefs.FallbackServers = nil
+	for _, fallback := range proxy.backends.all()[1:] {
+		prefs.FallbackServers = append(prefs.FallbackServers, fallback.String())
+	}
+
+	prefs.BackendIdleTimeout = proxy.backendIdleTimeout()
+	prefs.BindRetries = proxy.bindRetries()
+	prefs.BreakerCooldown = proxy.breaker.cooldown
+	prefs.HealthCheckFailures = proxy.backends.unhealthyAfter
+
+	if prefs.BanChecker != nil && prefs.BanCacheTTL <= 0 {
+		prefs.BanCacheTTL = defaultBanCacheTTL
+	}
+	if (prefs.StatsdAddr != "" || prefs.Metrics != nil) && prefs.StatsdInterval <= 0 {
+		prefs.StatsdInterval = defaultStatsdInterval
+	}
+	if prefs.PingAmplificationFactor == 0 {
+		prefs.PingAmplificationFactor = defaultPingAmplificationFactor
+	}
+	if prefs.MaintenanceMOTD == "" {
+		prefs.MaintenanceMOTD = defaultMaintenanceMOTD
+	}
+	if prefs.OverflowPolicy == "" {
+		prefs.OverflowPolicy = OverflowReject
+	}
+	if prefs.ClientKey == "" {
+		prefs.ClientKey = ClientKeyAddr
+	}
+	if prefs.AllUnhealthyPolicy == "" {
+		prefs.AllUnhealthyPolicy = AllUnhealthyLeastRecentlyFailed
+	}
+	if prefs.ReadWorkers < 1 {
+		prefs.ReadWorkers = 1
+	}
+	if prefs.HandshakeExemptIDs == nil {
+		prefs.HandshakeExemptIDs = defaultHandshakeExemptIDs
+	}
+	prefs.Label = proxy.Label()
+
+	// Don't share the slices and maps of the running proxy's prefs
+	prefs.DropMessageIDs = append([]byte(nil), prefs.DropMessageIDs...)
+	prefs.HandshakeExemptIDs = append([]byte{}, prefs.HandshakeExemptIDs...)
+	prefs.PingBindAddrs = append([]string(nil), prefs.PingBindAddrs...)
+	prefs.PingPorts = append([]uint16(nil), prefs.PingPorts...)
+	prefs.AllowedClients = append([]string(nil), prefs.AllowedClients...)
+	prefs.BlockedClients = append([]string(nil), prefs.BlockedClients...)
+	prefs.AllowedBackends = append([]string(nil), prefs.AllowedBackends...)
+
+	if prefs.StaticRoutes != nil {
+		routes := make(map[string]string, len(prefs.StaticRoutes))
+		for network, server := range prefs.StaticRoutes {
+			routes[network] = server
+		}
+		prefs.StaticRoutes = routes
+	}
+
+	return prefs
+}
+
+// SetMaintenance turns maintenance mode on or off. While on, pings are still
+// answered, but with the maintenance MOTD, and new game connections are
+// refused. Existing sessions are unaffected.
+func (proxy *ProxyServer) SetMaintenance(on bool) {
+	if proxy.maintenance.SetToIf(!on, on) {
+		log.Info().Msgf("Maintenance mode: %v", on)
+	}
+}
+
+// SweepIdle immediately closes every connection that has been idle for longer
+// than IdleTimeout, as the periodic sweep does, and returns how many it closed.
+func (proxy *ProxyServer) SweepIdle() int {
+	swept := proxy.clientMap.SweepIdle(time.Now())
+	log.Info().Msgf("Swept %d idle connections", swept)
+
+	return swept
+}
+
+// Disconnect closes the connection of a client, given by address or by
+// connection ID, and returns whether there was one
+func (proxy *ProxyServer) Disconnect(client string) bool {
+	var addr net.Addr
+	proxy.clientMap.Range(func(conn *clientmap.ServerConn) bool {
+		if info := conn.Info(); info.Client.String() == client || info.ID == client {
+			addr = info.Client
+			return false
+		}
+
+		return true
+	})
+
+	if addr == nil {
+		return false
+	}
+
+	log.Info().Msgf("Disconnecting %s", addr)
+	proxy.clientMap.Delete(addr)
+	return true
+}
+
+// Errors returns a channel delivering non-fatal errors encountered while
+// reading from listeners or backend connections. Errors tied to a specific
+// client are delivered as *ClientError. The channel is buffered and errors
+// are dropped when it is full, so a slow reader never blocks proxying.
+func (proxy *ProxyServer) Errors() <-chan error {
+	return proxy.errors
+}
+
+// Delivers an error to the Errors() channel without blocking
+func (proxy *ProxyServer) reportError(err error) {
+	select {
+	case proxy.errors <- err:
+	default:
+		log.Debug().Msgf("Error channel full, dropping error: %v", err)
+	}
+}
+
+// Sets the OS receive buffer size for a listener and logs the size actually
+// applied, since the OS may clamp it
+func (proxy *ProxyServer) setReadBuffer(listener net.PacketConn, size int) {
+	conn, ok := listener.(*net.UDPConn)
+	if !ok {
+		return
+	}
+
+	if err := conn.SetReadBuffer(size); err != nil {
+		log.Warn().Msgf("Failed to set read buffer for %s: %v", listener.LocalAddr(), err)
+		return
+	}
+
+	if applied, err := readBufferSize(conn); err == nil {
+		log.Info().Msgf("Read buffer for %s: requested %d bytes, applied %d bytes", listener.LocalAddr(), size, applied)
+	} else {
+		log.Info().Msgf("Read buffer for %s: requested %d bytes", listener.LocalAddr(), size)
+	}
+}
+
+// Performs periodic cleanup until the ProxyServer has been closed
+func (proxy *ProxyServer) housekeepingLoop() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case now := <-ticker.C:
+			proxy.throughput.sample(proxy.counters(), now)
+
+			if expired := proxy.pings.expire(now); expired > 0 {
+				log.Debug().Msgf("%d pings went unanswered by the server", expired)
+				proxy.markServerOffline()
+			}
+
+			if proxy.bans != nil {
+				proxy.bans.expire(now)
+			}
+
+			if proxy.usage != nil {
+				proxy.usage.expire(now)
+			}
+
+			if proxy.ptrs != nil {
+				proxy.ptrs.expire(now)
+			}
+
+			proxy.blocklist.expire(now)
+			proxy.saveBlocklist()
+
+			if proxy.prefs.KeepAlive {
+				proxy.sendKeepAlives(now)
+			}
+
+			if proxy.prefs.AlertWebhook != "" {
+				proxy.checkAlerts(now)
+			}
+		}
+	}
+}
+
+// Periodically replaces the advertised server ID with a new one from
+// ServerIDFunc, or a random one, until the ProxyServer has been closed.
+func (proxy *ProxyServer) rotateServerIDLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-			// Start proxying ping packets from the broadcast listener
-			go proxy.readLoop(proxy.pingServerV6)
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var newID int64
+		if proxy.prefs.ServerIDFunc != nil {
+			newID = proxy.prefs.ServerIDFunc()
 		} else {
-			// IPv6 Bind failed
-			log.Warn().Msgf("Failed to bind IPv6 ping listener: %v", err)
+			newID = rand.Int63()
 		}
-	}
 
-	network := "udp4"
-	if proxy.prefs.EnableIPv6 {
-		network = "udp"
+		atomic.StoreInt64(&proxy.serverID, newID)
+		log.Info().Msgf("Rotated server ID to %d", newID)
 	}
+}
 
-	// Bind to specified UDP addr and port to receive data from Minecraft clients
-	log.Info().Msgf("Binding proxy server to: %v", proxy.bindAddress)
-	if server, err := reuse.ListenPacket(network, proxy.bindAddress.String()); err == nil {
-		// a safe cast, I promise
-		proxy.server = server.(*net.UDPConn)
-	} else {
-		return err
+// Binds the extra sockets for ReadWorkers to the port of the proxy server
+func (proxy *ProxyServer) bindReadWorkers(network string) error {
+	if proxy.prefs.ReadWorkers < 2 {
+		return nil
 	}
 
-	log.Info().Msgf("Proxy server listening!")
-	log.Info().Msgf("Once your console pings phantom, you should see replies below.")
-
-	// Start processing everything else using the proxy listener
-	proxy.startWorkers(proxy.server)
-
-	return nil
-}
+	// Elsewhere, the sockets share the port but not the packets
+	if runtime.GOOS != "linux" {
+		log.Warn().Msgf("Read workers are only supported on Linux, using one socket")
+		return nil
+	}
 
-func (proxy *ProxyServer) Close() {
-	log.Info().Msgf("Stopping proxy server")
+	addr := &net.UDPAddr{IP: proxy.bindAddress.IP, Port: proxy.server.LocalAddr().(*net.UDPAddr).Port, Zone: proxy.bindAddress.Zone}
+	log.Info().Msgf("Binding %d more sockets to %v for read workers", proxy.prefs.ReadWorkers-1, addr)
 
-	// Stop UDP listeners
-	proxy.server.Close()
-	proxy.pingServer.Close()
+	for i := 1; i < proxy.prefs.ReadWorkers; i++ {
+		server, err := reuse.ListenPacket(network, addr.String())
+		if err != nil {
+			return wrapBindError(err, addr.Port)
+		}
 
-	if proxy.pingServerV6 != nil {
-		proxy.pingServerV6.Close()
+		proxy.readServers = append(proxy.readServers, server.(*net.UDPConn))
 	}
 
-	// Close all connections
-	proxy.clientMap.Close()
-
-	// Stop loops
-	proxy.dead.Set()
+	return nil
 }
 
 func (proxy *ProxyServer) startWorkers(listener net.PacketConn) {
 	log.Info().Msgf("Starting %d workers", proxy.prefs.NumWorkers)
 
+	for _, server := range proxy.readServers {
+		server := server
+		for i := uint(0); i < proxy.prefs.NumWorkers; i++ {
+			proxy.goLoop(func() { proxy.readLoop(server) })
+		}
+	}
+
 	for i := uint(0); i < proxy.prefs.NumWorkers; i++ {
 		if i < proxy.prefs.NumWorkers-1 {
-			go proxy.readLoop(listener)
+			proxy.goLoop(func() { proxy.readLoop(listener) })
 		} else {
+			proxy.loops.Add(1)
 			proxy.readLoop(listener)
+			proxy.loops.Done()
 		}
 	}
 }
@@ -167,12 +1429,19 @@ func (proxy *ProxyServer) startWorkers(listener net.PacketConn) {
 func (proxy *ProxyServer) readLoop(listener net.PacketConn) {
 	log.Info().Msgf("Listener starting up: %s", listener.LocalAddr())
 
-	packetBuffer := make([]byte, maxMTU)
+	packetBuffer := make([]byte, proxy.mtu)
 
 	for !proxy.dead.IsSet() {
 		err := proxy.processDataFromClients(listener, packetBuffer)
+
+		// The listener was closed, usually by Close
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+
 		if err != nil {
 			log.Warn().Msgf("Error while processing client data: %s", err)
+			proxy.reportError(err)
 		}
 	}
 
@@ -187,76 +1456,274 @@ func (proxy *ProxyServer) readLoop(listener net.PacketConn) {
 // data from the server and send it back to the client.
 func (proxy *ProxyServer) processDataFromClients(listener net.PacketConn, packetBuffer []byte) error {
 	// Read the next packet from the client
-	read, client, _ := listener.ReadFrom(packetBuffer)
-	if read <= 0 {
+	read, client, err := listener.ReadFrom(packetBuffer)
+	if err != nil && read <= 0 {
+		return err
+	}
+
+	if read <= 0 && !proxy.prefs.ForwardEmptyPackets {
 		return nil
 	}
 
+	if !proxy.prefs.KeepMappedAddrs {
+		client = canonicalAddr(client)
+	}
+
+	// Empty datagrams have no message ID, so they skip the checks on it
+	empty := read == 0
+	packetType, known := proto.ClassifyPacket(packetBuffer[:read])
+
 	data := packetBuffer[:read]
-	log.Trace().Msgf("client recv: %v", data)
+	if proxy.sampleTrace() {
+		log.Trace().Msgf("client recv: %v", data)
+	}
+	proxy.counters().fromClient(read)
+	proxy.checkTruncated(read, packetBuffer, client)
+
+	if !proxy.clientAllowed(client) {
+		log.Trace().Msgf("Dropping packet from disallowed client %s", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	if proxy.overQuota(client) {
+		log.Trace().Msgf("Dropping packet from %s, which is over its usage quota", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	// Only servers send pongs, so one from a client is reflected traffic or a
+	// loop, such as a misconfiguration pointing phantom at itself. Forwarding
+	// it would let the server's reply come back around again.
+	if packetType == proto.PacketUnconnectedReply {
+		proxy.counters().dropped()
+		if reflected := proxy.counters().reflected(); reflected == 1 || reflected%reflectedWarnEvery == 0 {
+			log.Warn().Msgf("Dropping Unconnected Pong from client %s, which only servers send (%d so far)", client.String(), reflected)
+		} else {
+			log.Debug().Msgf("Dropping Unconnected Pong from client %s", client.String())
+		}
+		return nil
+	}
+
+	if !empty && !known {
+		proxy.counters().unknown()
+
+		if proxy.prefs.DropUnknownPackets {
+			log.Debug().Msgf("Dropping unknown packet %#x from %s", data[0], client.String())
+			proxy.counters().dropped()
+			return nil
+		}
+
+		log.Debug().Msgf("Received unknown packet %#x from %s", data[0], client.String())
+	}
+
+	if !empty && proxy.dropIDs[data[0]] {
+		log.Trace().Msgf("Dropping message ID %#x from %s", data[0], client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	// Only handshakes and exempt packets may come from new clients
+	if proxy.prefs.RequireHandshake && !isConnectionRequest(packetType) && (empty || !proxy.handshakeExempt[data[0]]) && !proxy.clientMap.Has(client) {
+		log.Debug().Msgf("Dropping packet from %s, which has not started a handshake", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	// Refuse new connections during maintenance
+	if proxy.maintenance.IsSet() && isConnectionRequest(packetType) {
+		log.Debug().Msgf("Dropping connection request from %s during maintenance", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	// Pings go through the shared ping connection
+	if packetType == proto.PacketUnconnectedPing {
+		return proxy.processPing(data, client)
+	}
+
+	// Refuse new connections while the server is failing
+	if !proxy.clientMap.Has(client) && !proxy.breaker.allow(time.Now()) {
+		log.Debug().Msgf("Dropping packet from %s, circuit breaker is open", client.String())
+		proxy.counters().dropped()
+		return nil
+	}
+
+	// Ask the ban service about new clients, dropping their packets until it
+	// answers. Clients resend their connection requests meanwhile.
+	if proxy.bans != nil && !proxy.clientMap.Has(client) {
+		if ip := addrIP(client); ip != nil {
+			if banned, checked := proxy.checkBan(ip); !checked {
+				log.Debug().Msgf("Dropping packet from %s until the ban service answers", client.String())
+				proxy.counters().dropped()
+				return nil
+			} else if banned {
+				log.Debug().Msgf("Dropping packet from banned client %s", client.String())
+				proxy.counters().dropped()
+				return nil
+			}
+		}
+	}
+
+	// Limit how many new connections wait on the server at once
+	handshake := false
+	if !proxy.clientMap.Has(client) {
+		if !proxy.handshakes.acquire() {
+			log.Debug().Msgf("Dropping packet from %s, too many connections in handshake", client.String())
+			proxy.counters().dropped()
+			return nil
+		}
+		handshake = true
+	}
 
 	// Handler triggered when a new client connects and we create a new connetion to the remote server
-	onNewConnection := func(newServerConn *net.UDPConn) {
-		log.Info().Msgf("New connection from client %s -> %s", client.String(), listener.LocalAddr())
-		proxy.processDataFromServer(newServerConn, client)
+	var readerStarted chan struct{}
+	onNewConnection := func(newServerConn *clientmap.ServerConn) {
+		// The slot is released by the connection's reader from now on
+		handshake = false
+
+		newServerConn.Logger().Info().Msgf("New connection from client %s -> %s", client.String(), listener.LocalAddr())
+		proxy.publishEvent(EventConnect, newServerConn)
+		proxy.resolveClientName(newServerConn, client)
+
+		readerStarted = make(chan struct{})
+		proxy.goLoop(func() {
+			close(readerStarted)
+			proxy.processDataFromServer(newServerConn, client)
+			duration := time.Since(newServerConn.Info().ConnectedAt)
+			proxy.counters().connectionClosed(duration)
+			proxy.observeConnection(duration)
+			proxy.publishEvent(EventDisconnect, newServerConn)
+			proxy.logConnection(newServerConn)
+		})
 	}
 
 	serverConn, err := proxy.clientMap.Get(
 		client,
-		proxy.remoteServerAddress,
+		proxy.selectBackend,
 		onNewConnection,
 	)
 
-	if err != nil {
-		return err
+	// Another worker opened the connection first, or none was opened
+	if handshake {
+		proxy.handshakes.release()
 	}
 
-	// Wait 5 seconds for the server to respond to whatever we sent, or else timeout
-	_ = serverConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if err == clientmap.ErrNoRemote {
+		log.Debug().Msgf("Dropping packet from %s, no server selected", client.String())
+		proxy.counters().dropped()
+		return nil
+	} else if err == clientmap.ErrFull {
+		log.Debug().Msgf("Dropping packet from %s, too many connections", client.String())
+		proxy.counters().dropped()
 
-	if packetID := data[0]; packetID == proto.UnconnectedPingID {
-		log.Info().Msgf("Received LAN ping from client: %s", client.String())
+		// Only connection requests are answered, so that other stray packets
+		// don't each get a reply
+		if proxy.prefs.SendFullResponse && isConnectionRequest(packetType) {
+			reply := proto.BuildNoFreeIncomingConnections(atomic.LoadInt64(&proxy.serverID))
+			listener.WriteTo(reply, client)
+		}
 
-		if proxy.serverOffline {
-			replyBuffer := proto.OfflinePong
-			replyBytes := proxy.rewriteUnconnectedPong(replyBuffer.Bytes())
+		return nil
+	} else if err != nil {
+		proxy.counters().dialFailed()
+		return &ClientError{client, err}
+	}
 
-			proxy.server.WriteTo(replyBytes, client)
-			log.Info().Msgf("Sent server offline pong to client: %v", client.String())
-		}
+	// With several workers, the client's next packets may be read by other
+	// workers while this one is still opening the connection. They wait until
+	// the packet that opened it, which starts the handshake, has been sent or
+	// dropped, so every path below marks the connection ready. Marking it
+	// again for later packets does nothing.
+	if readerStarted != nil {
+		<-readerStarted
+	} else {
+		serverConn.WaitReady()
+	}
+
+	// Wait for the server to respond to whatever we sent, or else timeout
+	_ = serverConn.SetReadDeadline(time.Now().Add(proxy.backendIdleTimeout()))
 
-		// Pass ping through to server even if it's offline
+	if proxy.faults.shouldDrop() {
+		serverConn.Logger().Trace().Msgf("Fault injection: dropping packet from %s", client.String())
+		proxy.counters().dropped()
+		serverConn.MarkReady()
+		return nil
 	}
 
+	serverConn.CountFromClient(data)
+	proxy.recordUsage(client, read)
+
 	// Write packet from client to server
-	_, err = serverConn.Write(data)
+	if proxy.prefs.AddedLatency > 0 {
+		proxy.faults.delay(data, func(delayed []byte) {
+			err := proxy.writeToServer(serverConn, delayed, client)
+			serverConn.MarkReady()
+
+			if err != nil {
+				proxy.reportError(err)
+			}
+		})
+
+		return nil
+	}
+
+	err = proxy.writeToServer(serverConn, data, client)
+	serverConn.MarkReady()
+
 	return err
 }
 
+// Returns whether the packet type opens a RakNet connection
+func isConnectionRequest(packetType proto.PacketType) bool {
+	return packetType == proto.PacketOpenConnectionRequest1 || packetType == proto.PacketOpenConnectionRequest2
+}
+
+// Writes a client's packet to the server, counting a short write as a drop
+// since the server can't use a truncated datagram
+func (proxy *ProxyServer) writeToServer(serverConn *clientmap.ServerConn, data []byte, client net.Addr) error {
+	written, err := serverConn.Write(data)
+	if err != nil {
+		return &ClientError{client, err}
+	}
+
+	if written < len(data) {
+		serverConn.Logger().Warn().Msgf("Short write to server for %s: %d of %d bytes", client.String(), written, len(data))
+		proxy.counters().shortWrite()
+	}
+
+	proxy.mirrorPacket(data)
+	return nil
+}
+
 // Proxies packets sent by the server to us for a specific Minecraft client back to
 // that client's UDP connection.
-func (proxy *ProxyServer) processDataFromServer(remoteConn *net.UDPConn, client net.Addr) {
-	buffer := make([]byte, maxMTU)
+func (proxy *ProxyServer) processDataFromServer(remoteConn *clientmap.ServerConn, client net.Addr) {
+	if _, ok := remoteConn.Conn.(*net.UDPConn); ok && proxy.prefs.BatchWrites {
+		proxy.processBatchesFromServer(remoteConn, client)
+		return
+	}
+
+	logger := remoteConn.Logger()
+
+	stopConnectTimer := proxy.startConnectTimer(client, logger)
+	defer stopConnectTimer()
+
+	endHandshake := proxy.handshakes.releaser()
+	defer endHandshake()
+
+	buffer := make([]byte, proxy.mtu)
 
 	for !proxy.dead.IsSet() {
 		// Read the next packet from the server
-		read, _, err := remoteConn.ReadFrom(buffer)
+		read, err := remoteConn.Read(buffer)
 
 		// Remove read timeout, server responded
 		_ = remoteConn.SetReadDeadline(time.Time{})
 
 		// Read error
 		if err != nil {
-			log.Warn().Msgf("%v", err)
-
-			offlineError := offlineErrorRegex.MatchString(err.Error())
-
-			if offlineError && !proxy.serverOffline {
-				log.Warn().Msgf("Server seems to be offline :(")
-				log.Warn().Msgf("We'll keep trying to connect...")
-				proxy.serverOffline = true
-			}
-
+			proxy.handleServerReadError(err, client, remoteConn, logger)
 			break
 		}
 
@@ -265,50 +1732,346 @@ func (proxy *ProxyServer) processDataFromServer(remoteConn *net.UDPConn, client
 			continue
 		}
 
-		if proxy.serverOffline {
-			log.Info().Msgf("Server is back online!")
-			proxy.serverOffline = false
+		stopConnectTimer()
+		endHandshake()
+		proxy.breaker.success()
+
+		if isKeepAlivePong(buffer[:read]) {
+			continue
 		}
 
+		remoteConn.CountFromServer(buffer[:read])
+		proxy.counters().fromServer(read)
+		proxy.recordUsage(client, read)
+		proxy.checkTruncated(read, buffer, remoteConn.RemoteAddr())
+
 		// Resize data to byte count from 'read'
-		data := buffer[:read]
-		log.Trace().Msgf("server recv: %v", data)
+		data := proxy.handleServerPacket(buffer[:read], client)
+
+		if proxy.faults.shouldDrop() {
+			logger.Trace().Msgf("Fault injection: dropping packet to %s", client.String())
+			proxy.counters().dropped()
+			continue
+		}
 
-		// Rewrite Unconnected Pong packets
-		if packetID := data[0]; packetID == proto.UnconnectedPongID {
-			data = proxy.rewriteUnconnectedPong(data)
-			log.Info().Msgf("Sent LAN pong to client: %v", client.String())
+		if !proxy.waitForEgress(len(data)) {
+			logger.Trace().Msgf("Dropping packet to %s, over the egress limit", client.String())
+			continue
 		}
 
-		proxy.server.WriteTo(data, client)
+		proxy.faults.delay(data, func(delayed []byte) {
+			proxy.server.WriteTo(delayed, client)
+		})
+	}
+
+	proxy.clientMap.DeleteIf(client, remoteConn)
+}
+
+// Starts a timer that tells the client its connection failed if the server
+// doesn't reply within the connect timeout, returning a function that stops
+// it. The caller stops the timer as soon as the server replies.
+func (proxy *ProxyServer) startConnectTimer(client net.Addr, logger *zerolog.Logger) func() {
+	timeout := proxy.prefs.ConnectTimeout
+	if timeout <= 0 {
+		return func() {}
 	}
 
-	proxy.clientMap.Delete(client)
+	timer := time.AfterFunc(timeout, func() {
+		logger.Warn().Msgf("Server did not respond to %s within %v, closing client connection", client.String(), timeout)
+
+		reply := proto.BuildIncompatibleProtocol(proto.RakNetProtocolVersion, atomic.LoadInt64(&proxy.serverID))
+		proxy.server.WriteTo(reply, client)
+	})
+
+	return func() { timer.Stop() }
 }
 
-func (proxy *ProxyServer) rewriteUnconnectedPong(data []byte) []byte {
-	log.Debug().Msgf("Received Unconnected Pong from server: %v", data)
+// Logs and reports an error reading from the server, marking the server
+// offline if the error suggests it is unreachable.
+func (proxy *ProxyServer) handleServerReadError(err error, client net.Addr, remoteConn *clientmap.ServerConn, logger *zerolog.Logger) {
+	logger.Warn().Msgf("%v", err)
+	proxy.reportError(&ClientError{client, err})
 
-	if packet, err := proto.ReadUnconnectedPing(data); err == nil {
-		// Overwrite the server ID with one unique to this phantom instance.
-		// If we don't do this, the client will get confused if you restart phantom.
-		packet.Pong.ServerID = fmt.Sprintf("%d", serverID)
+	if offlineErrorRegex.MatchString(err.Error()) {
+		proxy.markServerOffline()
 
-		// Overwrite port numbers sent back from server (if any)
-		if packet.Pong.Port4 != "" && !proxy.prefs.RemovePorts {
-			packet.Pong.Port4 = fmt.Sprintf("%d", proxy.boundPort)
-			packet.Pong.Port6 = packet.Pong.Port4
-		} else if proxy.prefs.RemovePorts {
-			packet.Pong.Port4 = ""
-			packet.Pong.Port6 = ""
+		if serverFailed(err, remoteConn) {
+			proxy.breaker.failure(time.Now())
+			proxy.backends.failover(remoteConn.RemoteAddr())
 		}
+	}
+}
 
-		packetBuffer := packet.Build()
-		log.Debug().Msgf("Unconnected Pong: %v", packet)
-		return packetBuffer.Bytes()
-	} else {
-		log.Warn().Msgf("Failed to rewrite pong: %v", err)
+// Returns whether a read error means the server is down: it refused the
+// connection, or never replied before timing out. A session that merely went
+// quiet also times out, after the server has replied.
+func serverFailed(err error, remoteConn *clientmap.ServerConn) bool {
+	return strings.Contains(err.Error(), "connection refused") || remoteConn.Info().BytesFromServer == 0
+}
+
+// Opens a connection to a server through BackendNetwork, or else the OS
+func (proxy *ProxyServer) dialBackend(remote *net.UDPAddr) (net.Conn, error) {
+	if proxy.prefs.BackendNetwork != nil {
+		return proxy.prefs.BackendNetwork(remote)
+	}
+
+	return clientmap.DialUDP(remote)
+}
+
+// Binds the proxy server socket with SO_REUSEPORT, so that read workers can
+// share its port. Such binds succeed while another SO_REUSEPORT socket, like
+// another phantom, holds the port, so a random port is first probed with a
+// plain bind, which fails if anything holds it.
+func (proxy *ProxyServer) listenBindAddress(network string) (net.PacketConn, error) {
+	addr := proxy.bindAddress.String()
+
+	if proxy.randomBindPort() {
+		probe, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		probe.Close()
+	}
+
+	return reuse.ListenPacket(network, addr)
+}
+
+// Returns whether the bind port was picked at random
+func (proxy *ProxyServer) randomBindPort() bool {
+	return proxy.prefs.BindPort == 0 && !proxy.prefs.UseEphemeralPort
+}
+
+func (proxy *ProxyServer) bindRetries() int {
+	if proxy.prefs.BindRetries == 0 {
+		return defaultBindRetries
+	}
+
+	return proxy.prefs.BindRetries
+}
+
+// Returns whether to trace the current packet, according to TraceSampleRate.
+// Sampling uses the fault injector's seeded source rather than the global one,
+// so that packets aren't serialized on the global source's lock.
+func (proxy *ProxyServer) sampleTrace() bool {
+	if log.Logger.GetLevel() > zerolog.TraceLevel || zerolog.GlobalLevel() > zerolog.TraceLevel {
+		return false
+	}
+
+	rate := proxy.prefs.TraceSampleRate
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+
+	return proxy.faults.float64() < rate
+}
+
+// Returns whether the allow and block lists let the client use the proxy
+func (proxy *ProxyServer) clientAllowed(client net.Addr) bool {
+	if len(proxy.allowedClients) > 0 && !proxy.allowedClients.contains(client) {
+		return false
+	}
+
+	return !proxy.blockedClients.contains(client) && !proxy.blocklist.blocked(addrIP(client))
+}
+
+// Counts a packet that filled its read buffer, as it was likely truncated
+func (proxy *ProxyServer) checkTruncated(read int, buffer []byte, from net.Addr) {
+	if read < len(buffer) {
+		return
+	}
+
+	log.Debug().Msgf("Packet from %s filled the %d byte buffer and was likely truncated", from, len(buffer))
+	proxy.counters().truncated()
+}
+
+// Returns how long to wait for the server to answer a client, IdleTimeout
+// unless BackendIdleTimeout is set
+func (proxy *ProxyServer) backendIdleTimeout() time.Duration {
+	if proxy.prefs.BackendIdleTimeout > 0 {
+		return proxy.prefs.BackendIdleTimeout
+	}
+
+	return proxy.prefs.IdleTimeout
+}
+
+// Picks the server for a new client: its static route if it has one,
+// otherwise the BackendSelector's choice or the RemoteServer
+func (proxy *ProxyServer) selectBackend(client net.Addr) *net.UDPAddr {
+	if remote := proxy.staticRoutes.route(client); remote != nil {
+		return remote
+	}
+
+	if proxy.prefs.BackendSelector == nil {
+		if proxy.rejectAllUnhealthy() {
+			log.Debug().Msgf("Refusing %s, every server is unhealthy", client.String())
+			return nil
+		}
+
+		return proxy.backends.current()
+	}
+
+	remote := proxy.prefs.BackendSelector(client)
+	if remote != nil && !proxy.allowedBackends.allows(remote) {
+		log.Warn().Msgf("Refusing to connect %s to %s, which is not an allowed backend", client.String(), remote)
+		return nil
+	}
+
+	return remote
+}
+
+// Returns whether new clients are refused because every server is unhealthy
+func (proxy *ProxyServer) rejectAllUnhealthy() bool {
+	return proxy.prefs.AllUnhealthyPolicy == AllUnhealthyReject && proxy.backends.allUnhealthy()
+}
+
+func (proxy *ProxyServer) markServerOffline() {
+	if proxy.serverOffline.SetToIf(false, true) {
+		log.Warn().Msgf("Server seems to be offline :(")
+		log.Warn().Msgf("We'll keep trying to connect...")
+	}
+}
+
+// Processes a non-empty packet received from the server for the given client
+// and returns the data that should be sent on to that client.
+func (proxy *ProxyServer) handleServerPacket(data []byte, client net.Addr) []byte {
+	if proxy.serverOffline.SetToIf(true, false) {
+		log.Info().Msgf("Server is back online!")
+	}
+
+	if proxy.sampleTrace() {
+		log.Trace().Msgf("server recv: %v", data)
+	}
+
+	// Rewrite Unconnected Pong packets
+	if packetType, _ := proto.ClassifyPacket(data); packetType == proto.PacketUnconnectedReply {
+		log.Debug().Msgf("Received Unconnected Pong from server: %v", data)
+
+		if packet, err := proto.ReadUnconnectedReply(data); err == nil {
+			if proxy.prefs.PongCacheTTL > 0 {
+				proxy.pongCache.store(*packet)
+			}
+
+			data = proxy.rewritePongPacket(data, *packet, client)
+		} else {
+			log.Warn().Msgf("Failed to rewrite pong: %v", err)
+		}
+
+		log.Info().Msgf("Sent LAN pong to client: %v", client.String())
 	}
 
 	return data
 }
+
+// Like buildPong, but forwards the original bytes of the parsed packet when
+// none of phantom's changes apply, which avoids rebuilding it.
+func (proxy *ProxyServer) rewritePongPacket(data []byte, packet proto.UnconnectedReply, client net.Addr) []byte {
+	if proxy.rewritePong(packet.Pong, client) == packet.Pong {
+		log.Debug().Msgf("Forwarding unchanged Unconnected Pong: %v", packet)
+		return data
+	}
+
+	return proxy.buildPong(packet, client)
+}
+
+// Rewrites a pong received from the server for the given client and returns
+// the bytes to send to that client.
+func (proxy *ProxyServer) buildPong(packet proto.UnconnectedReply, client net.Addr) []byte {
+	packet.Pong = proxy.rewritePong(packet.Pong, client)
+
+	packetBuffer := packet.Build()
+
+	// A long MOTD override can push the pong past what fits in a datagram,
+	// so shorten the MOTD, keeping any obfuscation token on the end
+	if excess := packetBuffer.Len() - maxMTU; excess > 0 {
+		token := ""
+		if proxy.prefs.ObfuscateMOTD {
+			token = proxy.clientToken(client)
+		}
+
+		motd := strings.TrimSuffix(packet.Pong.MOTD, token)
+		if excess > len(motd) {
+			log.Error().Msgf("Pong is %d bytes, over the %d byte limit even without a MOTD; check the pong overrides", packetBuffer.Len(), maxMTU)
+		} else {
+			log.Warn().Msgf("Pong is %d bytes, over the %d byte limit, truncating MOTD", packetBuffer.Len(), maxMTU)
+			packet.Pong.MOTD = truncateMOTD(motd, len(motd)-excess) + token
+			packetBuffer = packet.Build()
+		}
+	}
+
+	log.Debug().Msgf("Unconnected Pong: %v", packet)
+	return packetBuffer.Bytes()
+}
+
+// Cuts the MOTD to at most size bytes, without splitting a character or
+// leaving a § with the formatting code after it cut off
+func truncateMOTD(motd string, size int) string {
+	if size >= len(motd) {
+		return motd
+	}
+
+	for size > 0 && !utf8.RuneStart(motd[size]) {
+		size--
+	}
+
+	return strings.TrimSuffix(motd[:size], "§")
+}
+
+// Applies phantom's changes to the server info advertised to a client
+func (proxy *ProxyServer) rewritePong(pong proto.Pong, client net.Addr) proto.Pong {
+	// Overwrite the server ID with one unique to this phantom instance.
+	// If we don't do this, the client will get confused if you restart phantom.
+	pong.ServerID = fmt.Sprintf("%d", atomic.LoadInt64(&proxy.serverID))
+
+	// Advertise phantom's port in place of the server's, even when the server
+	// sent none, so that clients always connect to phantom, unless the
+	// server's ports are to be preserved
+	if proxy.prefs.RemovePorts {
+		pong.Port4 = ""
+		pong.Port6 = ""
+	} else if !proxy.prefs.PreservePorts {
+		pong.Port4 = fmt.Sprintf("%d", proxy.BoundPort())
+		pong.Port6 = pong.Port4
+	}
+
+	pong = pong.Override(proxy.prefs.PongOverrides)
+
+	if proxy.prefs.MaxPlayersOverride > 0 {
+		pong.MaxPlayers = fmt.Sprintf("%d", proxy.prefs.MaxPlayersOverride)
+	}
+
+	if proxy.maintenance.IsSet() {
+		pong.MOTD = proxy.prefs.MaintenanceMOTD
+		if pong.MOTD == "" {
+			pong.MOTD = defaultMaintenanceMOTD
+		}
+	}
+
+	if proxy.prefs.ObfuscateMOTD {
+		pong.MOTD += proxy.clientToken(client)
+	}
+
+	return pong
+}
+
+// Derives a short token from the client's IP and the current server ID. It
+// is encoded as a run of formatting codes, so it changes the MOTD on the wire
+// without changing what players see.
+func (proxy *ProxyServer) clientToken(client net.Addr) string {
+	host, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		host = client.String()
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	binary.Write(hash, binary.BigEndian, atomic.LoadInt64(&proxy.serverID))
+
+	var token strings.Builder
+	for _, digit := range fmt.Sprintf("%04x", hash.Sum32()&0xffff) {
+		token.WriteString("§")
+		token.WriteRune(digit)
+	}
+	token.WriteString("§r")
+
+	return token.String()
+}
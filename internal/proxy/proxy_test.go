@@ -0,0 +1,2285 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/jhead/phantom/internal/proto"
+	reuse "github.com/libp2p/go-reuseport"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/tevino/abool"
+)
+
+// fakeServer is a minimal Bedrock server that answers unconnected pings with
+// a pong echoing the ping's timestamp and records where packets came from
+// and how many arrived.
+type fakeServer struct {
+	conn    *net.UDPConn
+	sources map[string]bool
+	packets int
+	pongs   int
+	mutex   *sync.Mutex
+}
+
+func startFakeServer(t testing.TB) *fakeServer {
+	pong := proto.OfflinePong
+	return startFakeServerWithPong(t, pong.Bytes())
+}
+
+// Starts a fake server that answers pings with the given pong
+func startFakeServerWithPong(t testing.TB, pong []byte) *fakeServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeServer{conn, make(map[string]bool), 0, 0, &sync.Mutex{}}
+
+	go func() {
+		buffer := make([]byte, maxMTU)
+		for {
+			read, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			isPing := read >= 9 && (buffer[0] == proto.UnconnectedPingID || buffer[0] == proto.UnconnectedPingOpenConnectionsID)
+
+			server.mutex.Lock()
+			server.sources[addr.String()] = true
+			server.packets++
+			if isPing {
+				server.pongs++
+			}
+			server.mutex.Unlock()
+
+			if isPing {
+				reply := append([]byte(nil), pong...)
+				copy(reply[1:9], buffer[1:9])
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	t.Cleanup(func() { conn.Close() })
+
+	return server
+}
+
+func (server *fakeServer) addr() string {
+	return server.conn.LocalAddr().String()
+}
+
+func (server *fakeServer) sourceCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return len(server.sources)
+}
+
+func (server *fakeServer) packetCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.packets
+}
+
+func (server *fakeServer) pongCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.pongs
+}
+
+// Starts a proxy in front of the given server and waits for it to bind
+func startTestProxy(t testing.TB, prefs ProxyPrefs) *ProxyServer {
+	prefs.BindAddress = "127.0.0.1"
+	prefs.UseEphemeralPort = true
+	if prefs.NumWorkers == 0 {
+		prefs.NumWorkers = 1
+	}
+	if prefs.IdleTimeout == 0 {
+		prefs.IdleTimeout = time.Minute
+	}
+
+	proxyServer, err := New(prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go proxyServer.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for proxyServer.BoundPort() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		proxyServer.Close()
+		<-proxyServer.Done()
+	})
+
+	return proxyServer
+}
+
+// Opens a client socket connected to the proxy
+func dialProxy(t testing.TB, proxyServer *ProxyServer) *net.UDPConn {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: int(proxyServer.BoundPort()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func buildPing(pingTime byte) []byte {
+	ping := make([]byte, 33)
+	ping[0] = proto.UnconnectedPingID
+	ping[8] = pingTime
+	return ping
+}
+
+func readPong(t *testing.T, conn *net.UDPConn) *proto.UnconnectedReply {
+	buffer := make([]byte, maxMTU)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	read, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pong, err := proto.ReadUnconnectedReply(buffer[:read])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pong
+}
+
+func TestIsRunning(t *testing.T) {
+	server := startFakeServer(t)
+
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:      "127.0.0.1",
+		UseEphemeralPort: true,
+		RemoteServer:     server.addr(),
+		IdleTimeout:      time.Minute,
+		NumWorkers:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, proxyServer.IsRunning())
+
+	go proxyServer.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !proxyServer.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NotZero(t, proxyServer.BoundPort())
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+
+	proxyServer.Close()
+	assert.False(t, proxyServer.IsRunning())
+	<-proxyServer.Done()
+}
+
+func TestHandshakeBurstStaysInOrder(t *testing.T) {
+	t.Run("direct", func(t *testing.T) {
+		testHandshakeBurst(t, 0)
+	})
+
+	// The packet that opens a connection is written later, and the ones
+	// behind it must still wait for it
+	t.Run("added_latency", func(t *testing.T) {
+		testHandshakeBurst(t, 20*time.Millisecond)
+	})
+}
+
+func testHandshakeBurst(t *testing.T, latency time.Duration) {
+	// Records the first packet the server receives from each connection
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	firsts := make(chan byte, 1000)
+	go func() {
+		seen := make(map[string]bool)
+		buffer := make([]byte, maxMTU)
+		for {
+			read, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			if read > 0 && !seen[addr.String()] {
+				seen[addr.String()] = true
+				firsts <- buffer[0]
+			}
+		}
+	}()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: conn.LocalAddr().String(),
+		NumWorkers:   8,
+		AddedLatency: latency,
+	})
+
+	// Each client sends its connection request followed right away by more
+	const clients = 50
+	for i := 0; i < clients; i++ {
+		client := dialProxy(t, proxyServer)
+
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+
+		for j := 0; j < 5; j++ {
+			_, err := client.Write([]byte{0x84, 1, 2, 3})
+			assert.Nil(t, err)
+		}
+
+		// Keep the listener's receive buffer from overflowing while workers
+		// hold packets back
+		time.Sleep(2*time.Millisecond + latency)
+	}
+
+	for i := 0; i < clients; i++ {
+		select {
+		case first := <-firsts:
+			assert.Equal(t, byte(proto.OpenConnectionRequest1ID), first)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of %d connections reached the server", i, clients)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	clients := []*net.UDPConn{dialProxy(t, proxyServer), dialProxy(t, proxyServer)}
+	for _, client := range clients {
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+	}
+	waitForConnections(t, proxyServer, 2)
+
+	// Packets are counted before they reach the server
+	deadline := time.Now().Add(2 * time.Second)
+	for server.sourceCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("packets did not reach the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	seen := make(map[string]bool)
+	proxyServer.Range(func(info clientmap.ConnInfo) bool {
+		seen[info.Client.String()] = true
+		assert.Equal(t, server.addr(), info.Server.String())
+		assert.Equal(t, uint64(4), info.BytesFromClient)
+		assert.False(t, info.LastActivity.Before(info.ConnectedAt))
+		return true
+	})
+	assert.Len(t, seen, 2)
+	assert.True(t, seen[clients[0].LocalAddr().String()])
+
+	// Returning false stops early
+	calls := 0
+	proxyServer.Range(func(info clientmap.ConnInfo) bool {
+		calls++
+		return false
+	})
+	assert.Equal(t, 1, calls)
+}
+
+func TestPingsShareServerConnection(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	clients := []*net.UDPConn{dialProxy(t, proxyServer), dialProxy(t, proxyServer)}
+
+	for i, client := range clients {
+		_, err := client.Write(buildPing(byte(i + 1)))
+		assert.Nil(t, err)
+	}
+
+	for i, client := range clients {
+		pong := readPong(t, client)
+		assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, byte(i + 1)}, pong.PingTime)
+	}
+
+	// Both pings arrived through the one shared connection, and neither
+	// client got a connection of its own
+	assert.Equal(t, 1, server.sourceCount())
+	assert.Equal(t, 0, proxyServer.Stats().Connections)
+}
+
+func TestPingsSpreadOverPool(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr(), BackendPoolSize: 2})
+
+	clients := []*net.UDPConn{}
+	for i := 0; i < 4; i++ {
+		clients = append(clients, dialProxy(t, proxyServer))
+	}
+
+	for i, client := range clients {
+		_, err := client.Write(buildPing(byte(i + 1)))
+		assert.Nil(t, err)
+	}
+
+	for i, client := range clients {
+		pong := readPong(t, client)
+		assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, byte(i + 1)}, pong.PingTime)
+	}
+
+	assert.Equal(t, 2, server.sourceCount())
+}
+
+func TestMaxPingSources(t *testing.T) {
+	// A server that never answers, so pings stay pending
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	pings, err := newPingForwarder(clientmap.DialUDP, server.LocalAddr().(*net.UDPAddr), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pings.Close()
+
+	clients := []net.Addr{}
+	for i := 1; i <= 3; i++ {
+		clients = append(clients, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 19132})
+	}
+
+	// Tokens 1 and 2 from the first client, 3 and 4 from the others
+	assert.Nil(t, pings.forward(buildPing(1), clients[0]))
+	assert.Nil(t, pings.forward(buildPing(2), clients[0]))
+	assert.Nil(t, pings.forward(buildPing(3), clients[1]))
+	assert.Equal(t, 2, pings.sourceCount())
+
+	// The third client pushes out the pings of the least recent one
+	assert.Nil(t, pings.forward(buildPing(4), clients[2]))
+	assert.Equal(t, 2, pings.sourceCount())
+	assert.Len(t, pings.pending, 2)
+
+	pong := func(token uint64) []byte {
+		data := make([]byte, 33)
+		data[0] = proto.UnconnectedPongID
+		binary.BigEndian.PutUint64(data[pingTimeOffset:], token)
+		return data
+	}
+
+	_, _, ok := pings.match(pong(1))
+	assert.False(t, ok)
+
+	client, _, ok := pings.match(pong(3))
+	assert.True(t, ok)
+	assert.Equal(t, clients[1], client)
+	assert.Equal(t, 1, pings.sourceCount())
+
+	// Sources go away with their expired pings
+	assert.Equal(t, 1, pings.expire(time.Now().Add(2*pingTimeout)))
+	assert.Equal(t, 0, pings.sourceCount())
+	assert.Equal(t, 0, pings.order.Len())
+}
+
+// Reports every other client address in IPv4-mapped IPv6 form, as a string
+type mappedAddrConn struct {
+	net.PacketConn
+	reads int
+}
+
+func (conn *mappedAddrConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	read, addr, err := conn.PacketConn.ReadFrom(buffer)
+	if err != nil {
+		return read, addr, err
+	}
+
+	conn.reads++
+	if conn.reads%2 == 0 {
+		udpAddr := addr.(*net.UDPAddr)
+		return read, stringAddr(fmt.Sprintf("[::ffff:%s]:%d", udpAddr.IP, udpAddr.Port)), nil
+	}
+
+	return read, addr, nil
+}
+
+func TestMappedAddrsCollapse(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		server := startFakeServer(t)
+
+		listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyServer := startTestProxy(t, ProxyPrefs{
+			RemoteServer:    server.addr(),
+			PingListenConn:  &mappedAddrConn{listener, 0},
+			KeepMappedAddrs: keep,
+		})
+
+		client, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		for i := 0; i < 2; i++ {
+			_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+			assert.Nil(t, err)
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if keep {
+			waitForConnections(t, proxyServer, 2)
+		} else {
+			deadline := time.Now().Add(2 * time.Second)
+			for proxyServer.Stats().PacketsFromClients < 2 {
+				if time.Now().After(deadline) {
+					t.Fatal("packets were not received")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(t, 1, proxyServer.ConnectionCount())
+		}
+	}
+}
+
+func TestClientKeyIP(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		ClientKey:    ClientKeyIP,
+	})
+
+	// As if a load balancer sent one client's packets from two ports
+	for i := 0; i < 2; i++ {
+		client := dialProxy(t, proxyServer)
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().PacketsFromClients < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("packets were not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+
+	_, err := New(ProxyPrefs{RemoteServer: server.addr(), ClientKey: "port"})
+	assert.NotNil(t, err)
+}
+
+// Waits for the proxy to have the given number of connections
+func waitForConnections(t testing.TB, proxyServer *ProxyServer, count int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().Connections != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, have %d", count, proxyServer.Stats().Connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminConnections(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	recorder := httptest.NewRecorder()
+	proxyServer.handleConnections(recorder, httptest.NewRequest("GET", "/connections", nil))
+
+	var connections []clientmap.ConnStats
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &connections))
+	assert.Len(t, connections, 1)
+	assert.Equal(t, client.LocalAddr().String(), connections[0].Client)
+	assert.Equal(t, server.addr(), connections[0].Server)
+	assert.Equal(t, server.addr(), proxyServer.RemoteAddr().String())
+	assert.Equal(t, uint64(4), connections[0].BytesFromClient)
+
+	// The fake server never answers, so the connection looks half-open
+	assert.False(t, connections[0].LastClientPacket.IsZero())
+	assert.True(t, connections[0].LastServerPacket.IsZero())
+}
+
+func TestResetStats(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	stats := proxyServer.Stats()
+	assert.Equal(t, uint64(1), stats.PacketsFromClients)
+	assert.Equal(t, uint64(4), stats.BytesFromClients)
+
+	recorder := httptest.NewRecorder()
+	proxyServer.handleResetStats(recorder, httptest.NewRequest("GET", "/stats/reset", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	// Other hosts can't reset without the admin token
+	recorder = httptest.NewRecorder()
+	proxyServer.handleResetStats(recorder, httptest.NewRequest("POST", "/stats/reset", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, uint64(1), proxyServer.Stats().PacketsFromClients)
+
+	recorder = httptest.NewRecorder()
+	proxyServer.handleResetStats(recorder, localRequest("POST", "/stats/reset"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	stats = proxyServer.Stats()
+	assert.Equal(t, uint64(0), stats.PacketsFromClients)
+	assert.Equal(t, uint64(0), stats.BytesFromClients)
+	assert.Equal(t, 1, stats.Connections)
+}
+
+func TestConnectionDurations(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, []uint64{0, 0, 0, 0, 0}, proxyServer.Stats().ConnectionDurations)
+
+	proxyServer.clientMap.Delete(client.LocalAddr())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().ConnectionDurations[0] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection duration was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := proxyServer.Stats()
+	assert.Equal(t, []uint64{1, 0, 0, 0, 0}, stats.ConnectionDurations)
+	assert.True(t, stats.ConnectionDurationSeconds > 0 && stats.ConnectionDurationSeconds < 10)
+}
+
+func TestNewRefusesLoop(t *testing.T) {
+	for _, prefs := range []ProxyPrefs{
+		// The server is phantom's own bind address
+		{BindAddress: "127.0.0.1", BindPort: 19200, RemoteServer: "127.0.0.1:19200"},
+		{BindAddress: "0.0.0.0", BindPort: 19200, RemoteServer: "127.0.0.1:19200"},
+		{BindPort: 19200, RemoteServer: "localhost:19200"},
+		// The server is phantom's own ping listener
+		{RemoteServer: "127.0.0.1:19132"},
+		{RemoteServer: "127.0.0.1:19150", PingPorts: []uint16{19150}},
+		{RemoteServer: "127.0.0.1:19150", PingBindAddrs: []string{"127.0.0.1:19150"}},
+		// The ping server or a routed server is phantom itself
+		{BindPort: 19200, RemoteServer: "127.0.0.1:19140", PingBackend: "127.0.0.1:19132"},
+		{BindPort: 19200, RemoteServer: "127.0.0.1:19140", StaticRoutes: map[string]string{"10.0.0.0/8": "127.0.0.1:19200"}},
+	} {
+		_, err := New(prefs)
+		if assert.NotNil(t, err, "%+v", prefs) {
+			assert.Contains(t, err.Error(), "loop")
+		}
+	}
+
+	// Another port on the same host is fine, as is the same port elsewhere
+	for _, prefs := range []ProxyPrefs{
+		{BindAddress: "127.0.0.1", BindPort: 19200, RemoteServer: "127.0.0.1:19201"},
+		{BindAddress: "127.0.0.1", BindPort: 19200, RemoteServer: "192.0.2.1:19200"},
+		{BindAddress: "127.0.0.1", BindPort: 19200, RemoteServer: "127.0.0.1:19132", PingPorts: []uint16{19150}},
+	} {
+		proxyServer, err := New(prefs)
+		if assert.Nil(t, err, "%+v", prefs) {
+			proxyServer.Close()
+		}
+	}
+}
+
+func TestStartPortInUse(t *testing.T) {
+	server := startFakeServer(t)
+
+	// Without SO_REUSEPORT, so phantom can't share the port
+	taken, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		BindPort:     uint16(port),
+		RemoteServer: server.addr(),
+		NumWorkers:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	err = proxyServer.Start()
+
+	var bindErr *BindError
+	if assert.True(t, errors.As(err, &bindErr)) {
+		assert.Equal(t, port, bindErr.Port)
+	}
+
+	// The ping connections started before the failure are closed too
+	select {
+	case <-proxyServer.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Done() was not closed after Start failed")
+	}
+	assert.False(t, proxyServer.IsRunning())
+}
+
+func TestUnchangedPongIsForwarded(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		RemoteServer: "127.0.0.1:19140",
+		RemovePorts:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	// Backend already advertises phantom's server ID and no ports
+	packet := proto.UnconnectedReply{
+		PingTime: []byte{0, 0, 0, 0, 0, 0, 0, 1},
+		ID:       []byte{0, 0, 0, 0, 0, 0, 0, 2},
+		Magic:    proto.Magic,
+		Pong: proto.Pong{
+			Edition:         "MCPE",
+			MOTD:            "Backend",
+			ProtocolVersion: "390",
+			Version:         "1.14.60",
+			Players:         "0",
+			MaxPlayers:      "10",
+			ServerID:        fmt.Sprintf("%d", proxyServer.serverID),
+			GameType:        "Creative",
+			NintendoLimited: "1",
+		},
+	}
+	data := packet.Build()
+	dataBytes := data.Bytes()
+
+	reply := proxyServer.handleServerPacket(dataBytes, client)
+	assert.Equal(t, dataBytes, reply)
+	assert.True(t, &dataBytes[0] == &reply[0], "pong should be forwarded without rebuilding")
+
+	// Any change still rebuilds the pong
+	packet.Pong.Port4 = "19132"
+	data = packet.Build()
+	dataBytes = data.Bytes()
+
+	reply = proxyServer.handleServerPacket(dataBytes, client)
+	assert.False(t, &dataBytes[0] == &reply[0])
+}
+
+func TestRewritePongPorts(t *testing.T) {
+	tests := []struct {
+		name          string
+		serverPort    string
+		removePorts   bool
+		preservePorts bool
+		wantPort      string
+	}{
+		{"server ports rewritten", "19132", false, false, "50123"},
+		{"server ports removed", "19132", true, false, ""},
+		{"server ports preserved", "19132", false, true, "19132"},
+		{"server ports removed over preserved", "19132", true, true, ""},
+		{"no server ports filled in", "", false, false, "50123"},
+		{"no server ports removed", "", true, false, ""},
+		{"no server ports preserved", "", false, true, ""},
+		{"no server ports removed over preserved", "", true, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxyServer, err := New(ProxyPrefs{
+				BindAddress:   "127.0.0.1",
+				BindPort:      50123,
+				RemoteServer:  "127.0.0.1:19140",
+				RemovePorts:   test.removePorts,
+				PreservePorts: test.preservePorts,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxyServer.Close()
+
+			client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+			pong := proxyServer.rewritePong(proto.Pong{
+				Edition: "MCPE",
+				MOTD:    "Backend",
+				Port4:   test.serverPort,
+				Port6:   test.serverPort,
+			}, client)
+
+			assert.Equal(t, test.wantPort, pong.Port4)
+			assert.Equal(t, test.wantPort, pong.Port6)
+
+			// The server ID is rewritten either way
+			assert.Equal(t, fmt.Sprintf("%d", proxyServer.serverID), pong.ServerID)
+		})
+	}
+}
+
+func TestEffectivePrefs(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   "localhost:" + strings.Split(server.addr(), ":")[1],
+		AllowedClients: []string{"127.0.0.1"},
+	})
+
+	prefs := proxyServer.EffectivePrefs()
+	assert.Equal(t, "127.0.0.1", prefs.BindAddress)
+	assert.Equal(t, proxyServer.BoundPort(), prefs.BindPort)
+	assert.Equal(t, server.addr(), prefs.RemoteServer)
+	assert.Equal(t, server.addr(), prefs.PingBackend)
+	assert.Equal(t, time.Minute, prefs.BackendIdleTimeout)
+	assert.Equal(t, float64(defaultPingAmplificationFactor), prefs.PingAmplificationFactor)
+	assert.Equal(t, ClientKeyAddr, prefs.ClientKey)
+	assert.Equal(t, fmt.Sprintf("%d", proxyServer.BoundPort()), prefs.Label)
+
+	// The copy is the caller's to change
+	prefs.AllowedClients[0] = "0.0.0.0/0"
+	assert.Equal(t, "127.0.0.1", proxyServer.prefs.AllowedClients[0])
+}
+
+func TestServerIDFunc(t *testing.T) {
+	server := startFakeServer(t)
+
+	var calls int64
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:           server.addr(),
+		ServerIDRotateInterval: 50 * time.Millisecond,
+		ServerIDFunc: func() int64 {
+			return 1000 + atomic.AddInt64(&calls, 1)
+		},
+	})
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	pong := proxyServer.rewritePong(proto.Pong{Edition: "MCPE", MOTD: "Backend"}, client)
+	assert.Equal(t, "1001", pong.ServerID)
+
+	// Rotation asks for a new ID too
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&proxyServer.serverID) == 1001 {
+		if time.Now().After(deadline) {
+			t.Fatal("server ID was not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pong = proxyServer.rewritePong(proto.Pong{Edition: "MCPE", MOTD: "Backend"}, client)
+	assert.Equal(t, fmt.Sprintf("%d", atomic.LoadInt64(&proxyServer.serverID)), pong.ServerID)
+	assert.True(t, atomic.LoadInt64(&proxyServer.serverID) > 1001)
+}
+
+func TestRotateServerID(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:           server.addr(),
+		ServerIDRotateInterval: 100 * time.Millisecond,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+	firstID := readPong(t, client).Pong.ServerID
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Pongs advertise a new ID after the interval
+	deadline := time.Now().Add(2 * time.Second)
+	for pingTime := byte(2); ; pingTime++ {
+		if time.Now().After(deadline) {
+			t.Fatal("advertised server ID was not rotated")
+		}
+
+		_, err = client.Write(buildPing(pingTime))
+		assert.Nil(t, err)
+		if readPong(t, client).Pong.ServerID != firstID {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The existing session still reaches the server over its connection
+	sources := server.sourceCount()
+	packets := server.packetCount()
+
+	_, err = client.Write([]byte{0x84, 0, 0, 0})
+	assert.Nil(t, err)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for server.packetCount() == packets {
+		if time.Now().After(deadline) {
+			t.Fatal("packet from existing session was not forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, sources, server.sourceCount())
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+}
+
+func TestOversizedMOTD(t *testing.T) {
+	for _, obfuscate := range []bool{false, true} {
+		proxyServer, err := New(ProxyPrefs{
+			BindAddress:   "127.0.0.1",
+			RemoteServer:  "127.0.0.1:19140",
+			PongOverrides: proto.PongOverrides{}.MOTD(strings.Repeat("§aé", 1000)),
+			ObfuscateMOTD: obfuscate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxyServer.Close()
+
+		client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+		reply := proto.OfflineReply
+
+		data := proxyServer.buildPong(reply, client)
+		assert.True(t, len(data) <= maxMTU, "pong is %d bytes", len(data))
+
+		parsed, err := proto.ReadUnconnectedReply(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		motd := parsed.Pong.MOTD
+		assert.True(t, utf8.ValidString(motd))
+		assert.True(t, len(motd) > 1000)
+		if obfuscate {
+			assert.True(t, strings.HasSuffix(motd, proxyServer.clientToken(client)))
+		} else {
+			assert.True(t, strings.HasPrefix(strings.Repeat("§aé", 1000), motd))
+		}
+
+		// The rest of the pong survives
+		assert.Equal(t, reply.Pong.Version, parsed.Pong.Version)
+	}
+}
+
+func TestTruncateMOTD(t *testing.T) {
+	assert.Equal(t, "short", truncateMOTD("short", 10))
+	assert.Equal(t, "ab", truncateMOTD("abcd", 2))
+
+	// Doesn't split é (2 bytes) or leave a dangling § (2 bytes)
+	assert.Equal(t, "a", truncateMOTD("aé", 2))
+	assert.Equal(t, "a", truncateMOTD("a§b", 3))
+	assert.Equal(t, "a§b", truncateMOTD("a§bc", 4))
+}
+
+func TestMaxPlayersOverride(t *testing.T) {
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:        "127.0.0.1",
+		RemoteServer:       "127.0.0.1:19140",
+		MaxPlayersOverride: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Close()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	backend := proto.Pong{
+		Edition:         "MCPE",
+		MOTD:            "Backend",
+		ProtocolVersion: "390",
+		Version:         "1.14.60",
+		Players:         "7",
+		MaxPlayers:      "100000",
+		GameType:        "Survival",
+	}
+
+	pong := proxyServer.rewritePong(backend, client)
+	assert.Equal(t, "20", pong.MaxPlayers)
+
+	// Everything else is rewritten as usual
+	pong.MaxPlayers = backend.MaxPlayers
+	proxyServer.prefs.MaxPlayersOverride = 0
+	assert.Equal(t, proxyServer.rewritePong(backend, client), pong)
+	assert.Equal(t, "7", pong.Players)
+}
+
+func TestOfflinePongEchoesPingTime(t *testing.T) {
+	// Nothing listens here, so the server is soon detected as offline
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: closed.LocalAddr().String()})
+	client := dialProxy(t, proxyServer)
+
+	buffer := make([]byte, maxMTU)
+	for pingTime := byte(1); pingTime < 50; pingTime++ {
+		_, err := client.Write(buildPing(pingTime))
+		assert.Nil(t, err)
+
+		_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		read, err := client.Read(buffer)
+		if err != nil {
+			continue
+		}
+
+		pong, err := proto.ReadUnconnectedReply(buffer[:read])
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, pingTime}, pong.PingTime)
+		return
+	}
+
+	t.Fatal("no offline pong received")
+}
+
+func TestPongCacheTTL(t *testing.T) {
+	reply := proto.OfflineReply
+	reply.Pong.MOTD = "Cached MOTD"
+	pong := reply.Build()
+
+	server := startFakeServerWithPong(t, pong.Bytes())
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		PongCacheTTL: 500 * time.Millisecond,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "Cached MOTD", readPong(t, client).Pong.MOTD)
+
+	// The server stops answering, so the cached pong stands in for it
+	server.conn.Close()
+	proxyServer.markServerOffline()
+
+	_, err = client.Write(buildPing(2))
+	assert.Nil(t, err)
+
+	cached := readPong(t, client)
+	assert.Equal(t, "Cached MOTD", cached.Pong.MOTD)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, cached.PingTime)
+
+	// Once it's older than the TTL, the offline pong is sent instead
+	time.Sleep(600 * time.Millisecond)
+	proxyServer.markServerOffline()
+
+	_, err = client.Write(buildPing(3))
+	assert.Nil(t, err)
+
+	offline := readPong(t, client)
+	assert.Equal(t, proto.OfflineReply.Pong.MOTD, offline.Pong.MOTD)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 3}, offline.PingTime)
+}
+
+func TestStartWithProvidedListeners(t *testing.T) {
+	server := startFakeServer(t)
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pingListener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   server.addr(),
+		ListenConn:     listener,
+		PingListenConn: pingListener,
+	})
+
+	assert.Equal(t, uint16(listener.LocalAddr().(*net.UDPAddr).Port), proxyServer.BoundPort())
+
+	// Pongs come back from the proxy listener, like replies to broadcasts do
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.WriteTo(buildPing(7), pingListener.LocalAddr())
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 7}, pong.PingTime)
+}
+
+func TestPingAmplificationFactor(t *testing.T) {
+	server := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:            server.addr(),
+		PingAmplificationFactor: 1,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+
+	// The pong is larger than the ping, so it's dropped
+	_ = client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = client.Read(make([]byte, maxMTU))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), proxyServer.Stats().DroppedPackets)
+
+	// Without the limit, the pong is sent
+	proxyServer = startTestProxy(t, ProxyPrefs{
+		RemoteServer:            server.addr(),
+		PingAmplificationFactor: -1,
+	})
+
+	client = dialProxy(t, proxyServer)
+	_, err = client.Write(buildPing(2))
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, pong.PingTime)
+}
+
+func TestPingAmplificationAllowsLongMOTD(t *testing.T) {
+	reply := proto.OfflineReply
+	reply.Pong.MOTD = "§l§6Survival§r §7| §aEconomy §7| §bJobs §7| §dCustom Enchants §7| §eWeekly Events"
+	reply.Pong.SubMOTD = "§7Join our Discord at discord.example.com for rewards, §aevents §7and §bannouncements§r " +
+		"§7| §6Vote daily at vote.example.com §7| §cNew season starts this Friday!"
+	pong := reply.Build()
+
+	server := startFakeServerWithPong(t, pong.Bytes())
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+
+	// Over 10 times the size of the ping, but sent by default
+	assert.True(t, pong.Len() > 10*len(buildPing(1)))
+	assert.Equal(t, reply.Pong.MOTD, readPong(t, client).Pong.MOTD)
+	assert.Equal(t, uint64(0), proxyServer.Stats().DroppedPackets)
+}
+
+func TestPingAmplificationDropsOversizedPong(t *testing.T) {
+	reply := proto.OfflineReply
+	reply.Pong.MOTD = strings.Repeat("§aWelcome ", 100)
+	pong := reply.Build()
+
+	server := startFakeServerWithPong(t, pong.Bytes())
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+
+	// The client hasn't connected, so the default limit drops the pong
+	assert.True(t, pong.Len() > defaultPingAmplificationFactor*len(buildPing(1)))
+	_ = client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = client.Read(make([]byte, maxMTU))
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), proxyServer.Stats().DroppedPackets)
+}
+
+func TestPingBindAddrs(t *testing.T) {
+	server := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:  server.addr(),
+		PingBindAddrs: []string{"127.0.0.1:0"},
+	})
+
+	assert.Nil(t, proxyServer.pingServer)
+	assert.Len(t, proxyServer.pingServers, 1)
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.WriteTo(buildPing(9), proxyServer.pingServers[0].LocalAddr())
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 9}, pong.PingTime)
+}
+
+func TestPingPorts(t *testing.T) {
+	server := startFakeServer(t)
+
+	// Find two free ports to listen for pings on
+	var ports []uint16
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+		conn.Close()
+	}
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		PingPorts:    ports,
+	})
+
+	assert.Nil(t, proxyServer.pingServer)
+	assert.Len(t, proxyServer.pingServers, 2)
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i, port := range ports {
+		_, err = client.WriteTo(buildPing(byte(i+1)), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+		assert.Nil(t, err)
+
+		pong := readPong(t, client)
+		assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, byte(i + 1)}, pong.PingTime)
+		assert.Equal(t, fmt.Sprintf("%d", proxyServer.serverID), pong.Pong.ServerID)
+	}
+
+	_, err = New(ProxyPrefs{RemoteServer: server.addr(), PingPorts: []uint16{0}})
+	assert.NotNil(t, err)
+}
+
+func TestParsePingBindAddrs(t *testing.T) {
+	addrs, err := parsePingBindAddrs([]string{"192.168.1.10", " ::1 ", "10.0.0.1:20000"}, nil)
+	assert.Nil(t, err)
+	if assert.Len(t, addrs, 3) {
+		assert.Equal(t, "192.168.1.10:19132", addrs[0].String())
+		assert.Equal(t, "[::1]:19133", addrs[1].String())
+		assert.Equal(t, "10.0.0.1:20000", addrs[2].String())
+	}
+
+	_, err = parsePingBindAddrs([]string{":19132"}, nil)
+	assert.NotNil(t, err)
+
+	// Addresses without a port listen on each ping port
+	addrs, err = parsePingBindAddrs([]string{"192.168.1.10", "10.0.0.1:20000"}, []uint16{19132, 19200})
+	assert.Nil(t, err)
+	if assert.Len(t, addrs, 3) {
+		assert.Equal(t, "192.168.1.10:19132", addrs[0].String())
+		assert.Equal(t, "192.168.1.10:19200", addrs[1].String())
+		assert.Equal(t, "10.0.0.1:20000", addrs[2].String())
+	}
+}
+
+func TestBackendSelector(t *testing.T) {
+	defaultServer := startFakeServer(t)
+	selectedServer := startFakeServer(t)
+
+	selected, err := net.ResolveUDPAddr("udp", selectedServer.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refuse int32
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: defaultServer.addr(),
+		BackendSelector: func(client net.Addr) *net.UDPAddr {
+			if atomic.LoadInt32(&refuse) == 1 {
+				return nil
+			}
+
+			return selected
+		},
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, selectedServer.addr(), proxyServer.clientMap.Snapshot()[0].Server)
+
+	// A refused client gets no connection
+	atomic.StoreInt32(&refuse, 1)
+
+	refused := dialProxy(t, proxyServer)
+	_, err = refused.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, proxyServer.Stats().Connections)
+	assert.Equal(t, 0, defaultServer.sourceCount())
+}
+
+func TestTruncatedPacketsCounted(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+
+	packet := make([]byte, maxMTU+100)
+	packet[0] = proto.OpenConnectionRequest1ID
+	_, err := client.Write(packet)
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, uint64(1), proxyServer.Stats().TruncatedPackets)
+}
+
+func TestBackendIdleTimeout(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:       server.addr(),
+		IdleTimeout:        time.Minute,
+		BackendIdleTimeout: 200 * time.Millisecond,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	// The fake server never answers, so the connection closes long before the
+	// client would be evicted
+	waitForConnections(t, proxyServer, 0)
+}
+
+func TestBackendIdleTimeoutDefaultsToIdleTimeout(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		IdleTimeout:  200 * time.Millisecond,
+	})
+	assert.Equal(t, 200*time.Millisecond, proxyServer.backendIdleTimeout())
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	// The server's silence closes the connection after IdleTimeout, before the
+	// next idle sweep would
+	waitForConnections(t, proxyServer, 0)
+}
+
+// closeRecorder is a backend connection that records when it is closed
+type closeRecorder struct {
+	net.Conn
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func (conn closeRecorder) Close() error {
+	conn.once.Do(func() { close(conn.closed) })
+	return conn.Conn.Close()
+}
+
+func TestSweepIdleClosesBackend(t *testing.T) {
+	server := startFakeServer(t)
+
+	dialed := make(chan closeRecorder, 4)
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		conn, err := net.DialUDP("udp", nil, remote)
+		if err != nil {
+			return nil, err
+		}
+
+		recorder := closeRecorder{conn, make(chan struct{}), &sync.Once{}}
+		dialed <- recorder
+		return recorder, nil
+	}
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   server.addr(),
+		IdleTimeout:    time.Hour,
+		BackendNetwork: dial,
+	})
+
+	// The ping connection
+	<-dialed
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+	backend := <-dialed
+
+	// Nothing is evicted until the clock passes IdleTimeout, however long the
+	// periodic sweep takes to come around
+	clock := time.Now()
+	assert.Equal(t, 0, proxyServer.clientMap.SweepIdle(clock))
+
+	clock = clock.Add(time.Hour + time.Second)
+	assert.Equal(t, 1, proxyServer.clientMap.SweepIdle(clock))
+
+	select {
+	case <-backend.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+
+	// The connection's reader records its duration once it has returned
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().ConnectionDurations[0] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server reader did not exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBanCheckerDropsNewClients(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		BanChecker:   func(ip net.IP) bool { return true },
+	})
+
+	client := dialProxy(t, proxyServer)
+	for i := 0; i < 2; i++ {
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Dropped while the ban service is asked, and then as banned
+	assert.Equal(t, 0, proxyServer.Stats().Connections)
+	assert.Equal(t, uint64(2), proxyServer.Stats().DroppedPackets)
+}
+
+func TestSlowBanCheckerDoesNotBlockReads(t *testing.T) {
+	release := make(chan struct{})
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		BanChecker: func(ip net.IP) bool {
+			<-release
+			return false
+		},
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	// Pings are still answered while the ban service hasn't replied
+	_, err = client.Write(buildPing(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, readPong(t, client))
+	assert.Equal(t, 0, proxyServer.Stats().Connections)
+
+	// Once allowed, the client's resent request gets through
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+}
+
+func TestDropUnknownPackets(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:       server.addr(),
+		DropUnknownPackets: true,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().UnknownPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("unknown packet was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, uint64(1), proxyServer.Stats().DroppedPackets)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
+
+func TestDropReflectedPongs(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	// A pong sent back to phantom, as if it were forwarding to itself
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(append([]byte{proto.UnconnectedPongID}, make([]byte, 40)...))
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().ReflectedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pong from client was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := proxyServer.Stats()
+	assert.Equal(t, uint64(1), stats.DroppedPackets)
+	assert.Equal(t, uint64(0), stats.UnknownPackets)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
+
+func TestDropMessageIDs(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   server.addr(),
+		DropMessageIDs: []byte{0x84},
+	})
+
+	// A listed ID is counted and dropped instead of forwarded
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{0x84, 0, 0, 0})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("listed message ID was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+	assert.Equal(t, 0, server.sourceCount())
+
+	// Other IDs are forwarded
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline = time.Now().Add(2 * time.Second)
+	for server.sourceCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("unlisted message ID was not forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), proxyServer.Stats().DroppedPackets)
+	assert.Equal(t, 1, proxyServer.ConnectionCount())
+}
+
+func TestBackendDialFailures(t *testing.T) {
+	// Pings are still dialed at startup
+	failing := abool.New()
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: "127.0.0.1:19140",
+		BackendNetwork: func(remote *net.UDPAddr) (net.Conn, error) {
+			if failing.IsSet() {
+				return nil, errors.New("no free ports")
+			}
+
+			return clientmap.DialUDP(remote)
+		},
+	})
+	failing.Set()
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().BackendDialFailures == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed dial was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, uint64(backendDialRetries), proxyServer.Stats().BackendDialRetries)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
+
+func TestRequireHandshake(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:     server.addr(),
+		RequireHandshake: true,
+	})
+
+	// Game traffic can't open a connection
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{0x84, 0, 0, 0})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet without a handshake was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	// Pings are still answered, and handshakes let through
+	_, err = client.Write(buildPing(1))
+	assert.Nil(t, err)
+	readPong(t, client)
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Exempt IDs open connections without a handshake
+	exempt := startTestProxy(t, ProxyPrefs{
+		RemoteServer:       server.addr(),
+		RequireHandshake:   true,
+		HandshakeExemptIDs: []byte{0x84},
+	})
+
+	_, err = dialProxy(t, exempt).Write([]byte{0x84, 0, 0, 0})
+	assert.Nil(t, err)
+	waitForConnections(t, exempt, 1)
+	assert.Equal(t, []byte{0x84}, exempt.EffectivePrefs().HandshakeExemptIDs)
+}
+
+func TestForwardEmptyPackets(t *testing.T) {
+	server := startFakeServer(t)
+
+	// Dropped by default
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{})
+	assert.Nil(t, err)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, uint64(1), proxyServer.Stats().PacketsFromClients)
+
+	// Forwarded, opening a connection, and not mistaken for unknown packets
+	proxyServer = startTestProxy(t, ProxyPrefs{
+		RemoteServer:        server.addr(),
+		ForwardEmptyPackets: true,
+		DropUnknownPackets:  true,
+	})
+
+	client = dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.sourceCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("empty packet was not forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := proxyServer.Stats()
+	assert.Equal(t, uint64(1), stats.PacketsFromClients)
+	assert.Equal(t, uint64(0), stats.UnknownPackets)
+	assert.Equal(t, uint64(0), stats.DroppedPackets)
+}
+
+func TestSendFullResponse(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:     server.addr(),
+		MaxConnections:   1,
+		SendFullResponse: true,
+	})
+
+	first := dialProxy(t, proxyServer)
+	_, err := first.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	second := dialProxy(t, proxyServer)
+	_, err = second.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	buffer := make([]byte, maxMTU)
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	read, err := second.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, proto.BuildNoFreeIncomingConnections(proxyServer.serverID), buffer[:read])
+
+	// Other packets from refused clients go unanswered
+	_, err = second.Write([]byte{0x84, 1, 2, 3})
+	assert.Nil(t, err)
+
+	_ = second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = second.Read(buffer)
+	assert.NotNil(t, err)
+}
+
+func TestPingBackend(t *testing.T) {
+	gameServer := startFakeServer(t)
+	pingServer := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: gameServer.addr(),
+		PingBackend:  pingServer.addr(),
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(3))
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 3}, pong.PingTime)
+	assert.Equal(t, 1, pingServer.sourceCount())
+	assert.Equal(t, 0, gameServer.sourceCount())
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	proxyServer.Range(func(info clientmap.ConnInfo) bool {
+		assert.Equal(t, gameServer.addr(), info.Server.String())
+		return true
+	})
+
+	_, err = New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		RemoteServer: gameServer.addr(),
+		PingBackend:  "not a server",
+	})
+	assert.NotNil(t, err)
+}
+
+// A connection from a network other than the OS, as far as phantom can tell
+type tunnelConn struct {
+	net.Conn
+}
+
+func TestBackendNetwork(t *testing.T) {
+	server := startFakeServer(t)
+
+	var dials int32
+	dial := func(remote *net.UDPAddr) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+
+		conn, err := net.DialUDP("udp", nil, remote)
+		if err != nil {
+			return nil, err
+		}
+
+		return tunnelConn{conn}, nil
+	}
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:        server.addr(),
+		BackendNetwork:      dial,
+		CheckBackendAtStart: true,
+		BatchWrites:         true,
+	})
+
+	// The startup check and the ping connection
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(buildPing(3))
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 3}, pong.PingTime)
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+
+	_, err = New(ProxyPrefs{
+		BindAddress:        "127.0.0.1",
+		RemoteServer:       server.addr(),
+		BackendNetwork:     dial,
+		UnconnectedBackend: true,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestBindRetries(t *testing.T) {
+	server := startFakeServer(t)
+
+	newProxy := func(retries int) (*ProxyServer, net.PacketConn) {
+		proxyServer, err := New(ProxyPrefs{
+			BindAddress:  "127.0.0.1",
+			RemoteServer: server.addr(),
+			IdleTimeout:  time.Minute,
+			NumWorkers:   1,
+			BindRetries:  retries,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Take the random port before the proxy can bind it, the way another
+		// phantom would, which a SO_REUSEPORT bind alone doesn't notice
+		taken, err := reuse.ListenPacket("udp4", proxyServer.bindAddress.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { taken.Close() })
+
+		return proxyServer, taken
+	}
+
+	// Without retries, binding fails
+	proxyServer, taken := newProxy(-1)
+	err := proxyServer.Start()
+	proxyServer.Close()
+
+	var bindErr *BindError
+	if assert.True(t, errors.As(err, &bindErr)) {
+		assert.Equal(t, taken.LocalAddr().(*net.UDPAddr).Port, bindErr.Port)
+	}
+
+	// With retries, another random port is used
+	proxyServer, taken = newProxy(0)
+	go proxyServer.Start()
+	t.Cleanup(func() {
+		proxyServer.Close()
+		<-proxyServer.Done()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !proxyServer.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NotEqual(t, uint16(taken.LocalAddr().(*net.UDPAddr).Port), proxyServer.BoundPort())
+}
+
+func TestIPv6Only(t *testing.T) {
+	server, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	proxyServer, err := New(ProxyPrefs{
+		BindAddress:      "0.0.0.0",
+		RemoteServer:     server.LocalAddr().String(),
+		IdleTimeout:      time.Minute,
+		NumWorkers:       1,
+		UseEphemeralPort: true,
+		IPv6Only:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go proxyServer.Start()
+	t.Cleanup(func() {
+		proxyServer.Close()
+		<-proxyServer.Done()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !proxyServer.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing is bound to IPv4
+	assert.Nil(t, proxyServer.pingServer)
+	assert.Nil(t, proxyServer.server.LocalAddr().(*net.UDPAddr).IP.To4())
+
+	client, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: int(proxyServer.BoundPort())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	waitForConnections(t, proxyServer, 1)
+}
+
+func TestIPv6OnlyBindAddress(t *testing.T) {
+	_, err := New(ProxyPrefs{
+		BindAddress:  "127.0.0.1",
+		RemoteServer: "[::1]:19132",
+		IPv6Only:     true,
+	})
+	assert.NotNil(t, err)
+
+	for _, bindAddress := range []string{"::1", "[::1]"} {
+		proxyServer, err := New(ProxyPrefs{
+			BindAddress:  bindAddress,
+			BindPort:     19200,
+			RemoteServer: "[::1]:19132",
+			IPv6Only:     true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyServer.Close()
+
+		assert.Equal(t, "[::1]:19200", proxyServer.bindAddress.String())
+	}
+}
+
+func TestReadWorkers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("read workers need SO_REUSEPORT load balancing")
+	}
+
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		ReadWorkers:  4,
+	})
+	assert.Len(t, proxyServer.readServers, 3)
+
+	for _, readServer := range proxyServer.readServers {
+		assert.Equal(t, proxyServer.server.LocalAddr().String(), readServer.LocalAddr().String())
+	}
+
+	// Clients are served whichever socket the kernel gives them to
+	for i := 0; i < 20; i++ {
+		client := dialProxy(t, proxyServer)
+		_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+		assert.Nil(t, err)
+	}
+	waitForConnections(t, proxyServer, 20)
+}
+
+// Measures how fast the proxy takes in packets from many clients, reporting
+// the share of packets it received before falling behind. Compare
+// -bench 'ReadWorkers/1$' with 'ReadWorkers/4$' on a host with several cores.
+func BenchmarkReadWorkers(b *testing.B) {
+	for _, readWorkers := range []int{1, 4} {
+		readWorkers := readWorkers
+		b.Run(fmt.Sprintf("%d", readWorkers), func(b *testing.B) {
+			benchmarkReadWorkers(b, readWorkers)
+		})
+	}
+}
+
+func benchmarkReadWorkers(b *testing.B, readWorkers int) {
+	// Logging every packet would be measured instead of reading them
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+
+	server := startFakeServer(b)
+	proxyServer := startTestProxy(b, ProxyPrefs{
+		RemoteServer:            server.addr(),
+		ReadWorkers:             readWorkers,
+		ListenerReadBufferBytes: 8 << 20,
+	})
+
+	clients := make([]*net.UDPConn, 32)
+	for i := range clients {
+		clients[i] = dialProxy(b, proxyServer)
+		if _, err := clients[i].Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	waitForConnections(b, proxyServer, len(clients))
+
+	packet := make([]byte, 512)
+	packet[0] = 0x84
+	start := proxyServer.Stats().PacketsFromClients
+
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client := clients[int(atomic.AddInt32(&next, 1))%len(clients)]
+		for pb.Next() {
+			client.Write(packet)
+		}
+	})
+
+	// Wait for the proxy to catch up with what it was sent, or to stop
+	// receiving what it dropped
+	received := uint64(0)
+	for received < uint64(b.N) {
+		time.Sleep(10 * time.Millisecond)
+
+		current := proxyServer.Stats().PacketsFromClients - start
+		if current == received {
+			break
+		}
+		received = current
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(received)/float64(b.N), "received/op")
+}
+
+func TestListenerErrorsAreReported(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	// Make the listener's reads fail until the deadline is lifted
+	_ = proxyServer.server.SetReadDeadline(time.Now().Add(-time.Second))
+
+	select {
+	case err := <-proxyServer.Errors():
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), "unexpected error: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("read error was not reported")
+	}
+
+	// The listener keeps serving clients afterwards
+	_ = proxyServer.server.SetReadDeadline(time.Time{})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+}
+
+func TestSampleTrace(t *testing.T) {
+	sample := func(prefs ProxyPrefs, n int) []bool {
+		prefs.RemoteServer = "127.0.0.1:19140"
+		proxyServer, err := New(prefs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples := make([]bool, n)
+		for i := range samples {
+			samples[i] = proxyServer.sampleTrace()
+		}
+
+		return samples
+	}
+
+	count := func(samples []bool) int {
+		traced := 0
+		for _, sampled := range samples {
+			if sampled {
+				traced++
+			}
+		}
+
+		return traced
+	}
+
+	// Rates of 0 and 1 trace every packet
+	assert.Equal(t, 100, count(sample(ProxyPrefs{}, 100)))
+	assert.Equal(t, 100, count(sample(ProxyPrefs{TraceSampleRate: 1}, 100)))
+
+	// Sampling follows the seeded source
+	seeded := ProxyPrefs{TraceSampleRate: 0.5, FaultSeed: 42}
+	samples := sample(seeded, 1000)
+	assert.Equal(t, samples, sample(seeded, 1000))
+	assert.InDelta(t, 500, count(samples), 100)
+
+	// Nothing is sampled without trace logging
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	assert.Equal(t, 0, count(sample(ProxyPrefs{}, 100)))
+}
+
+// A connection whose reads always fail
+type brokenConn struct {
+	net.Conn
+	reads int32
+}
+
+func (conn *brokenConn) Read(b []byte) (int, error) {
+	atomic.AddInt32(&conn.reads, 1)
+	return 0, errors.New("broken")
+}
+
+func (conn *brokenConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19140}
+}
+
+func TestPongReaderStopsOnError(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	conn := &brokenConn{}
+	stopped := make(chan struct{})
+	go func() {
+		proxyServer.processPongsFromServer(conn)
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pong reader kept reading a broken connection")
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conn.reads))
+	assert.EqualError(t, <-proxyServer.Errors(), "broken")
+}
+
+func TestSetMaintenance(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:    server.addr(),
+		MaintenanceMOTD: "Back soon",
+	})
+
+	client := dialProxy(t, proxyServer)
+	proxyServer.SetMaintenance(true)
+	assert.True(t, proxyServer.Stats().Maintenance)
+
+	// Pings are still answered, with the maintenance MOTD
+	_, err := client.Write(buildPing(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "Back soon", readPong(t, client).Pong.MOTD)
+
+	// New connections are refused
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection request during maintenance was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+
+	// Turned off at runtime, the server's MOTD is back and clients connect
+	proxyServer.SetMaintenance(false)
+	assert.False(t, proxyServer.Stats().Maintenance)
+
+	_, err = client.Write(buildPing(2))
+	assert.Nil(t, err)
+	assert.NotEqual(t, "Back soon", readPong(t, client).Pong.MOTD)
+
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+}
+
+func TestAddedLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+
+	// A server that echoes every packet, noting when it arrived
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	arrived := make(chan time.Time, 1)
+	go func() {
+		buffer := make([]byte, maxMTU)
+		for {
+			read, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			arrived <- time.Now()
+			conn.WriteTo(buffer[:read], addr)
+		}
+	}()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: conn.LocalAddr().String(),
+		AddedLatency: latency,
+	})
+
+	client := dialProxy(t, proxyServer)
+	sent := time.Now()
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	// Delayed on the way to the server...
+	select {
+	case at := <-arrived:
+		assert.True(t, at.Sub(sent) >= latency, "reached the server after %v", at.Sub(sent))
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet did not reach the server")
+	}
+
+	// ...and again on the way back
+	buffer := make([]byte, maxMTU)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	read, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte{proto.OpenConnectionRequest1ID, 1, 2, 3}, buffer[:read])
+	assert.True(t, time.Since(sent) >= 2*latency, "round trip took %v", time.Since(sent))
+}
+
+func TestPreferIPv6Backend(t *testing.T) {
+	server, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	}
+	defer server.Close()
+
+	received := make(chan struct{}, 1)
+	go func() {
+		buffer := make([]byte, maxMTU)
+		if _, _, err := server.ReadFrom(buffer); err == nil {
+			received <- struct{}{}
+		}
+	}()
+
+	// A host with both an IPv4 and an IPv6 address, where only the IPv6 one
+	// has a server
+	port := server.LocalAddr().(*net.UDPAddr).Port
+	defaultResolve := resolveUDPAddr
+	resolveUDPAddr = func(network, address string) (*net.UDPAddr, error) {
+		if network == "udp6" {
+			return &net.UDPAddr{IP: net.IPv6loopback, Port: port}, nil
+		}
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: port}, nil
+	}
+	defer func() { resolveUDPAddr = defaultResolve }()
+
+	address := fmt.Sprintf("dualstack.test:%d", port)
+
+	ipv4Proxy, err := New(ProxyPrefs{BindAddress: "127.0.0.1", RemoteServer: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, ipv4Proxy.RemoteAddr().IP.To4())
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:      address,
+		PreferIPv6Backend: true,
+	})
+	assert.Equal(t, net.IPv6loopback, proxyServer.RemoteAddr().IP)
+
+	// Clients are connected to the IPv6 server
+	client := dialProxy(t, proxyServer)
+	_, err = client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet did not reach the IPv6 server")
+	}
+}
+
+// A connection that only writes the first 4 bytes of each packet
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (conn shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) > 4 {
+		b = b[:4]
+	}
+
+	return conn.Conn.Write(b)
+}
+
+func TestShortWritesCounted(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		BackendNetwork: func(remote *net.UDPAddr) (net.Conn, error) {
+			conn, err := clientmap.DialUDP(remote)
+			if err != nil {
+				return nil, err
+			}
+
+			return shortWriteConn{conn}, nil
+		},
+	})
+
+	// Written whole
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+	assert.Equal(t, uint64(0), proxyServer.Stats().ShortWrites)
+
+	// Only partly written
+	_, err = client.Write([]byte{0x84, 1, 2, 3, 4, 5, 6, 7})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().ShortWrites == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("short write was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, uint64(1), proxyServer.Stats().ShortWrites)
+}
+
+func TestPingOpenConnectionsAnswered(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{RemoteServer: server.addr()})
+
+	// Unconnected Ping Open Connections (0x02) is handled like any other ping
+	ping := buildPing(1)
+	ping[0] = proto.UnconnectedPingOpenConnectionsID
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write(ping)
+	assert.Nil(t, err)
+
+	pong := readPong(t, client)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, pong.PingTime)
+	assert.Equal(t, 0, proxyServer.ConnectionCount())
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jhead/phantom/internal/clientmap"
+	"github.com/rs/zerolog/log"
+)
+
+// How long reverse DNS names of clients are cached
+const ptrCacheTTL = 5 * time.Minute
+
+// How long to wait for a reverse DNS lookup
+const ptrLookupTimeout = 5 * time.Second
+
+// Returns a cache of the reverse DNS names of client IPs, so that
+// reconnecting clients don't cause a lookup every time. Names are "" for IPs
+// without one, and failed lookups are cached too.
+func newPTRCache(lookup func(ctx context.Context, addr string) ([]string, error)) *ttlCache {
+	return newTTLCache(func(key string) interface{} {
+		ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+		defer cancel()
+
+		names, err := lookup(ctx, key)
+		if err != nil {
+			log.Debug().Msgf("Reverse DNS lookup of %s failed: %v", key, err)
+			return ""
+		}
+
+		if len(names) == 0 {
+			return ""
+		}
+
+		return strings.TrimSuffix(names[0], ".")
+	}, ptrCacheTTL)
+}
+
+// Looks up the reverse DNS name of a new client in the background, then logs
+// it and records it on the connection
+func (proxy *ProxyServer) resolveClientName(serverConn *clientmap.ServerConn, client net.Addr) {
+	if proxy.ptrs == nil {
+		return
+	}
+
+	ip := addrIP(client)
+	if ip == nil {
+		return
+	}
+
+	go func() {
+		if name := proxy.ptrs.load(ip.String()).(string); name != "" {
+			log.Info().Msgf("Client %s is %s", client.String(), name)
+			serverConn.SetClientName(name)
+		}
+	}()
+}
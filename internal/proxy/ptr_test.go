@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPTRCache(t *testing.T) {
+	lookups := 0
+	cache := newPTRCache(func(ctx context.Context, addr string) ([]string, error) {
+		lookups++
+		if addr == "10.0.0.1" {
+			return []string{"player.example.com."}, nil
+		}
+
+		return nil, errors.New("no such host")
+	})
+
+	assert.Equal(t, "player.example.com", cache.load("10.0.0.1"))
+	assert.Equal(t, "player.example.com", cache.load("10.0.0.1"))
+	assert.Equal(t, "", cache.load("10.0.0.2"))
+	assert.Equal(t, "", cache.load("10.0.0.2"))
+	assert.Equal(t, 2, lookups)
+
+	// Expired names are looked up again
+	cache.expire(time.Now().Add(2 * ptrCacheTTL))
+	assert.Equal(t, "player.example.com", cache.load("10.0.0.1"))
+	assert.Equal(t, 3, lookups)
+}
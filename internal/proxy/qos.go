@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Marks packets sent on the listener with the DSCP value, in the IPv4 ToS
+// byte and the IPv6 traffic class. A dual-stack listener gets both, so only
+// a failure for the listener's own family is worth a warning.
+func setDSCP(conn *net.UDPConn, dscp int) {
+	// DSCP is the upper six bits, the rest is left for ECN
+	tos := dscp << 2
+
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	isIPv4 := addr != nil && addr.IP.To4() != nil
+	isIPv6 := addr != nil && !isIPv4
+
+	if err := ipv4.NewConn(conn).SetTOS(tos); err != nil {
+		if isIPv4 {
+			log.Warn().Msgf("Failed to set DSCP %d on %s: %v", dscp, conn.LocalAddr(), err)
+		} else {
+			log.Debug().Msgf("Failed to set IPv4 DSCP %d on %s: %v", dscp, conn.LocalAddr(), err)
+		}
+	}
+
+	if isIPv6 {
+		if err := ipv6.NewConn(conn).SetTrafficClass(tos); err != nil {
+			log.Warn().Msgf("Failed to set IPv6 DSCP %d on %s: %v", dscp, conn.LocalAddr(), err)
+		}
+	}
+
+	log.Info().Msgf("Marking packets to clients with DSCP %d", dscp)
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
+)
+
+func TestClientDSCP(t *testing.T) {
+	server := startFakeServer(t)
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer: server.addr(),
+		ClientDSCP:   46,
+	})
+
+	tos, err := ipv4.NewConn(proxyServer.server).TOS()
+	if err != nil {
+		t.Skipf("Can't read ToS on this platform: %v", err)
+	}
+	assert.Equal(t, 46<<2, tos)
+
+	_, err = New(ProxyPrefs{RemoteServer: server.addr(), ClientDSCP: 64})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Resolves server addresses, replaced in tests with a fake resolver
+var resolveUDPAddr = net.ResolveUDPAddr
+
+// Resolves a server address, choosing an IPv6 address over an IPv4 one when
+// the host has both and preferIPv6 is set
+func resolveServerAddress(address string, preferIPv6 bool) (*net.UDPAddr, error) {
+	resolved, err := lookupServerAddress(address, preferIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	family := "IPv4"
+	if resolved.IP.To4() == nil {
+		family = "IPv6"
+	}
+
+	log.Info().Msgf("Resolved server %s to %s address %s", address, family, resolved)
+	return resolved, nil
+}
+
+// Resolves a server address like resolveServerAddress, without logging
+func lookupServerAddress(address string, preferIPv6 bool) (*net.UDPAddr, error) {
+	if preferIPv6 {
+		if resolved, err := resolveUDPAddr("udp6", address); err == nil {
+			return resolved, nil
+		}
+	}
+
+	return resolveUDPAddr("udp", address)
+}
+
+// Returns the addresses phantom listens on for clients and pings, with an
+// unspecified IP for those that listen on all addresses
+func listenAddrs(prefs ProxyPrefs, bindAddress *net.UDPAddr, pingBindAddrs []*net.UDPAddr) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{bindAddress}
+	if prefs.ListenConn != nil {
+		addrs[0], _ = prefs.ListenConn.LocalAddr().(*net.UDPAddr)
+	}
+
+	if prefs.PingListenConn != nil {
+		if addr, ok := prefs.PingListenConn.LocalAddr().(*net.UDPAddr); ok {
+			addrs = append(addrs, addr)
+		}
+
+		return addrs
+	}
+
+	if len(pingBindAddrs) > 0 {
+		return append(addrs, pingBindAddrs...)
+	}
+
+	ports := prefs.PingPorts
+	if len(ports) == 0 {
+		if !prefs.IPv6Only {
+			ports = append(ports, 19132)
+		}
+		if prefs.EnableIPv6 {
+			ports = append(ports, 19133)
+		}
+	}
+
+	for _, port := range ports {
+		addrs = append(addrs, &net.UDPAddr{IP: net.IPv6unspecified, Port: int(port)})
+	}
+
+	return addrs
+}
+
+// Returns an error if sending to the server would reach one of phantom's own
+// listeners, which would loop packets through phantom over and over
+func checkLoop(server *net.UDPAddr, listeners []*net.UDPAddr) error {
+	for _, listener := range listeners {
+		if listener == nil || listener.Port != server.Port {
+			continue
+		}
+
+		if listener.IP.Equal(server.IP) || (listener.IP.IsUnspecified() || listener.IP == nil) && isLocalIP(server.IP) {
+			return fmt.Errorf("%s is phantom's own listener %s, which would loop packets back to phantom", server, listener)
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the IP is one of this host's own
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
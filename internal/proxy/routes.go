@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// staticRoutes pins clients in given networks to given servers, most specific
+// network first
+type staticRoutes []staticRoute
+
+type staticRoute struct {
+	network *net.IPNet
+	backend *net.UDPAddr
+}
+
+// Parses a map of client IP addresses or CIDR ranges to server addresses,
+// resolving the servers once, here
+func parseStaticRoutes(routes map[string]string, preferIPv6 bool) (staticRoutes, error) {
+	parsed := make(staticRoutes, 0, len(routes))
+
+	for clients, backend := range routes {
+		networks, err := parseIPList([]string{clients})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(networks) == 0 {
+			return nil, fmt.Errorf("No clients given for server %s", backend)
+		}
+
+		remote, err := resolveServerAddress(backend, preferIPv6)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid server for %s: %s", clients, err)
+		}
+
+		parsed = append(parsed, staticRoute{networks[0], remote})
+	}
+
+	// Map order is random, so sort for overlapping networks to resolve the
+	// same way every time
+	sort.Slice(parsed, func(i, j int) bool {
+		onesI, _ := parsed[i].network.Mask.Size()
+		onesJ, _ := parsed[j].network.Mask.Size()
+		if onesI != onesJ {
+			return onesI > onesJ
+		}
+
+		return parsed[i].network.String() < parsed[j].network.String()
+	})
+
+	return parsed, nil
+}
+
+// Returns the server the client is pinned to, or nil if it isn't pinned
+func (routes staticRoutes) route(client net.Addr) *net.UDPAddr {
+	ip := addrIP(client)
+	if ip == nil {
+		return nil
+	}
+
+	for _, route := range routes {
+		if route.network.Contains(ip) {
+			return route.backend
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	routes, err := parseStaticRoutes(map[string]string{
+		"10.0.0.0/8":    "127.0.0.1:20000",
+		"10.1.2.3":      "127.0.0.1:20001",
+		"2001:db8::/32": "[::1]:20002",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "127.0.0.1:20001", routes.route(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}).String())
+	assert.Equal(t, "127.0.0.1:20001", routes.route(&net.UDPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1}).String())
+	assert.Equal(t, "127.0.0.1:20000", routes.route(&net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 1}).String())
+	assert.Equal(t, "[::1]:20002", routes.route(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}).String())
+	assert.Nil(t, routes.route(&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}))
+
+	_, err = parseStaticRoutes(map[string]string{"not an ip": "127.0.0.1:20000"}, false)
+	assert.NotNil(t, err)
+
+	_, err = parseStaticRoutes(map[string]string{"10.0.0.0/8": "127.0.0.1"}, false)
+	assert.NotNil(t, err)
+}
+
+func TestStaticRoutesMustBeAllowedBackends(t *testing.T) {
+	_, err := New(ProxyPrefs{
+		BindAddress:     "127.0.0.1",
+		RemoteServer:    "127.0.0.1:19140",
+		AllowedBackends: []string{"127.0.0.1:19140"},
+		StaticRoutes:    map[string]string{"10.0.0.0/8": "127.0.0.1:20000"},
+	})
+	assert.NotNil(t, err)
+}
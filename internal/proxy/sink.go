@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"time"
+)
+
+// MetricsSink receives the metrics of a proxy, for sending them to monitoring
+// systems phantom doesn't support itself, such as OpenTelemetry. Names are
+// those of the Prometheus metrics served on /metrics, such as
+// phantom_connections. Counters and gauges are reported every
+// StatsdInterval, and connection durations in seconds as connections close,
+// so methods must be safe for concurrent use. NewStatsdSink and
+// NewPrometheusSink are provided implementations.
+type MetricsSink interface {
+	// Adds the increase of a counter since it was last reported
+	IncCounter(name string, delta float64)
+	SetGauge(name string, value float64)
+	ObserveHistogram(name string, value float64)
+}
+
+// Reports the metrics to the sink: gauges as they are and counters as the
+// increase since the previous stats. A counter that went down was reset, so
+// all of its current value is new.
+func publishMetrics(sink MetricsSink, stats Stats, previous Stats) {
+	for _, metric := range metrics {
+		value := metric.value(stats)
+
+		if metric.metricType == "gauge" {
+			sink.SetGauge(metric.name, value)
+			continue
+		}
+
+		if last := metric.value(previous); value >= last {
+			value -= last
+		}
+
+		sink.IncCounter(metric.name, value)
+	}
+}
+
+// Reports to the sink every StatsdInterval until the ProxyServer has been
+// closed, calling flush, if set, after each report
+func (proxy *ProxyServer) metricsLoop(sink MetricsSink, flush func()) {
+	interval := proxy.prefs.StatsdInterval
+	if interval <= 0 {
+		interval = defaultStatsdInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous := proxy.Stats()
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+		}
+
+		stats := proxy.Stats()
+		publishMetrics(sink, stats, previous)
+		if flush != nil {
+			flush()
+		}
+		previous = stats
+	}
+}
+
+// Reports how long a closed connection lasted to the Metrics sink, if any
+func (proxy *ProxyServer) observeConnection(duration time.Duration) {
+	if proxy.prefs.Metrics != nil {
+		proxy.prefs.Metrics.ObserveHistogram("phantom_connection_duration_seconds", duration.Seconds())
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.IncCounter("phantom_bytes_from_clients_total", 10)
+	sink.IncCounter("phantom_bytes_from_clients_total", 5)
+	sink.SetGauge("phantom_connections", 3)
+	sink.ObserveHistogram("phantom_connection_duration_seconds", 5)
+	sink.ObserveHistogram("phantom_connection_duration_seconds", 90)
+
+	var output bytes.Buffer
+	assert.Nil(t, sink.write(&output))
+
+	text := output.String()
+	assert.Contains(t, text, "# TYPE phantom_bytes_from_clients_total counter\nphantom_bytes_from_clients_total 15\n")
+	assert.Contains(t, text, "# TYPE phantom_connections gauge\nphantom_connections 3\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{le="10"} 1`+"\n")
+	assert.Contains(t, text, `phantom_connection_duration_seconds_bucket{le="600"} 2`+"\n")
+	assert.Contains(t, text, "phantom_connection_duration_seconds_sum 95\n")
+	assert.Contains(t, text, "phantom_connection_duration_seconds_count 2\n")
+}
+
+func TestMetricsSink(t *testing.T) {
+	server := startFakeServer(t)
+	sink := NewPrometheusSink()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   server.addr(),
+		Metrics:        sink,
+		StatsdInterval: 50 * time.Millisecond,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Durations are reported as connections close
+	proxyServer.closeConnectionsTo(proxyServer.RemoteAddr())
+
+	expected := []string{
+		"phantom_packets_from_clients_total 1\n",
+		"phantom_connections 0\n",
+		"phantom_connection_duration_seconds_count 1\n",
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var output bytes.Buffer
+		assert.Nil(t, sink.write(&output))
+
+		missing := ""
+		for _, line := range expected {
+			if !strings.Contains(output.String(), line) {
+				missing = line
+			}
+		}
+
+		if missing == "" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %q was not reported: %s", missing, output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	var output bytes.Buffer
+	sink := NewStatsdSink(&output)
+	sink.IncCounter("phantom_dropped_packets_total", 2)
+	sink.SetGauge("phantom_connections", 3)
+	sink.ObserveHistogram("phantom_connection_duration_seconds", 1.5)
+
+	assert.Equal(t, "phantom.dropped_packets:2|c\nphantom.connections:3|g\nphantom.connection_duration_seconds:1.5|h\n", output.String())
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Returns the size of the socket's receive buffer as applied by the OS, which
+// may differ from the size requested with SetReadBuffer.
+func readBufferSize(conn syscall.Conn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, sockErr
+}
+
+// Reports whether an error was caused by an address already being in use
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
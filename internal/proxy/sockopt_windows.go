@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// Returns the size of the socket's receive buffer as applied by the OS, which
+// may differ from the size requested with SetReadBuffer.
+func readBufferSize(conn syscall.Conn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int32
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		length := int32(unsafe.Sizeof(size))
+		sockErr = syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, (*byte)(unsafe.Pointer(&size)), &length)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(size), sockErr
+}
+
+// WSAEADDRINUSE, which the syscall package does not define
+const errAddrInUse = syscall.Errno(10048)
+
+// Reports whether an error was caused by an address already being in use
+func isAddrInUse(err error) bool {
+	return errors.Is(err, errAddrInUse)
+}
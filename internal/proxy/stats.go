@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Stats is a snapshot of the state of a ProxyServer
+type Stats struct {
+	// Number of clients with an open connection to the server
+	Connections int `json:"connections"`
+	// Whether maintenance mode is on
+	Maintenance bool `json:"maintenance"`
+	// Whether the circuit breaker is refusing new connections, see
+	// BreakerThreshold
+	BreakerOpen bool `json:"breaker_open"`
+	// Number of clients with pings awaiting a pong, see MaxPingSources
+	PingSources int `json:"ping_sources"`
+	// Health of RemoteServer and each of the FallbackServers, see
+	// HealthCheckInterval
+	Backends []BackendStatus `json:"backends"`
+	// Current traffic in bytes per second, smoothed over roughly the last
+	// half minute and updated every few seconds
+	ClientToServerBps float64 `json:"client_to_server_bps"`
+	ServerToClientBps float64 `json:"server_to_client_bps"`
+
+	// Cumulative counters since the proxy started or ResetStats() was last
+	// called. They are not monotonic across a reset.
+	PacketsFromClients uint64 `json:"packets_from_clients"`
+	BytesFromClients   uint64 `json:"bytes_from_clients"`
+	PacketsFromServer  uint64 `json:"packets_from_server"`
+	BytesFromServer    uint64 `json:"bytes_from_server"`
+	DroppedPackets     uint64 `json:"dropped_packets"`
+	// Packets only partly written to the server, also counted as dropped
+	ShortWrites uint64 `json:"short_writes"`
+	// Packets that filled the read buffer, so were likely truncated because
+	// they were larger than the MTU
+	TruncatedPackets uint64 `json:"truncated_packets"`
+	// Packets from clients that don't look like RakNet, such as from port
+	// scanners
+	UnknownPackets uint64 `json:"unknown_packets"`
+	// Unconnected Pongs from clients, which only servers send, also counted
+	// as dropped
+	ReflectedPackets uint64 `json:"reflected_packets"`
+	// Failed attempts to open a connection to the server that were retried,
+	// and connections that still couldn't be opened after the retries
+	BackendDialRetries  uint64 `json:"backend_dial_retries"`
+	BackendDialFailures uint64 `json:"backend_dial_failures"`
+	// Copies of packets that couldn't be sent to MirrorAddr. These are not
+	// counted as dropped, since the packets themselves were forwarded.
+	MirrorFailures uint64 `json:"mirror_failures"`
+	// Number of closed connections that lasted less than each of
+	// connectionDurationBounds (10s, 1m, 10m and 1h), and last, the number
+	// that lasted longer. Many short connections suggest scanners or bots
+	// rather than players.
+	ConnectionDurations []uint64 `json:"connection_durations"`
+	// Total duration of the closed connections
+	ConnectionDurationSeconds float64 `json:"connection_duration_seconds"`
+}
+
+// Upper bounds in seconds of the buckets connection durations are counted in
+var connectionDurationBounds = []float64{10, 60, 600, 3600}
+
+// counters holds the cumulative traffic counters, accessed atomically
+type counters struct {
+	packetsFromClients uint64
+	bytesFromClients   uint64
+	packetsFromServer  uint64
+	bytesFromServer    uint64
+	droppedPackets     uint64
+	shortWrites        uint64
+	truncatedPackets   uint64
+	unknownPackets     uint64
+	reflectedPackets   uint64
+	dialRetries        uint64
+	dialFailures       uint64
+	mirrorFailures     uint64
+	// Total duration of closed connections in nanoseconds, and how many fell
+	// in each bucket of connectionDurationBounds, with the last for the rest
+	connectionNanos     uint64
+	connectionDurations [5]uint64
+}
+
+func (c *counters) fromClient(bytes int) {
+	atomic.AddUint64(&c.packetsFromClients, 1)
+	atomic.AddUint64(&c.bytesFromClients, uint64(bytes))
+}
+
+func (c *counters) fromServer(bytes int) {
+	atomic.AddUint64(&c.packetsFromServer, 1)
+	atomic.AddUint64(&c.bytesFromServer, uint64(bytes))
+}
+
+func (c *counters) dropped() {
+	atomic.AddUint64(&c.droppedPackets, 1)
+}
+
+func (c *counters) truncated() {
+	atomic.AddUint64(&c.truncatedPackets, 1)
+}
+
+func (c *counters) unknown() {
+	atomic.AddUint64(&c.unknownPackets, 1)
+}
+
+// Counts a pong from a client and returns how many there have been
+func (c *counters) reflected() uint64 {
+	return atomic.AddUint64(&c.reflectedPackets, 1)
+}
+
+func (c *counters) dialRetried() {
+	atomic.AddUint64(&c.dialRetries, 1)
+}
+
+func (c *counters) dialFailed() {
+	atomic.AddUint64(&c.dialFailures, 1)
+}
+
+func (c *counters) mirrorFailed() {
+	atomic.AddUint64(&c.mirrorFailures, 1)
+}
+
+func (c *counters) connectionClosed(duration time.Duration) {
+	bucket := len(connectionDurationBounds)
+	for i, bound := range connectionDurationBounds {
+		if duration.Seconds() < bound {
+			bucket = i
+			break
+		}
+	}
+
+	atomic.AddUint64(&c.connectionDurations[bucket], 1)
+	atomic.AddUint64(&c.connectionNanos, uint64(duration))
+}
+
+func (c *counters) shortWrite() {
+	atomic.AddUint64(&c.shortWrites, 1)
+	c.dropped()
+}
+
+// Returns the current set of counters
+func (proxy *ProxyServer) counters() *counters {
+	return proxy.currentCounters.Load().(*counters)
+}
+
+// Stats returns a snapshot of the current state of the proxy
+func (proxy *ProxyServer) Stats() Stats {
+	c := proxy.counters()
+
+	pingSources := 0
+	if proxy.pings != nil {
+		pingSources = proxy.pings.sourceCount()
+	}
+
+	durations := make([]uint64, len(c.connectionDurations))
+	for i := range durations {
+		durations[i] = atomic.LoadUint64(&c.connectionDurations[i])
+	}
+
+	clientToServer, serverToClient := proxy.throughput.rates()
+
+	return Stats{
+		Connections:               proxy.clientMap.Len(),
+		Maintenance:               proxy.maintenance.IsSet(),
+		BreakerOpen:               proxy.breaker.isOpen(),
+		PingSources:               pingSources,
+		Backends:                  proxy.backends.statuses(),
+		ClientToServerBps:         clientToServer,
+		ServerToClientBps:         serverToClient,
+		PacketsFromClients:        atomic.LoadUint64(&c.packetsFromClients),
+		BytesFromClients:          atomic.LoadUint64(&c.bytesFromClients),
+		PacketsFromServer:         atomic.LoadUint64(&c.packetsFromServer),
+		BytesFromServer:           atomic.LoadUint64(&c.bytesFromServer),
+		DroppedPackets:            atomic.LoadUint64(&c.droppedPackets),
+		ShortWrites:               atomic.LoadUint64(&c.shortWrites),
+		TruncatedPackets:          atomic.LoadUint64(&c.truncatedPackets),
+		UnknownPackets:            atomic.LoadUint64(&c.unknownPackets),
+		ReflectedPackets:          atomic.LoadUint64(&c.reflectedPackets),
+		BackendDialRetries:        atomic.LoadUint64(&c.dialRetries),
+		BackendDialFailures:       atomic.LoadUint64(&c.dialFailures),
+		MirrorFailures:            atomic.LoadUint64(&c.mirrorFailures),
+		ConnectionDurations:       durations,
+		ConnectionDurationSeconds: time.Duration(atomic.LoadUint64(&c.connectionNanos)).Seconds(),
+	}
+}
+
+// ResetStats zeroes the cumulative packet, byte and drop counters in one step,
+// leaving gauges such as the number of connections intact. Counters are
+// therefore not monotonic across a reset.
+func (proxy *ProxyServer) ResetStats() {
+	proxy.currentCounters.Store(&counters{})
+	log.Info().Msgf("Stats reset")
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often stats are pushed to StatsD when StatsdInterval is not set
+const defaultStatsdInterval = 10 * time.Second
+
+// statsdSink writes metrics as StatsD lines, named like phantom.connections
+type statsdSink struct {
+	w io.Writer
+}
+
+// NewStatsdSink returns a MetricsSink writing each metric as a StatsD line to
+// w, such as a UDP connection to a StatsD server. It is safe for concurrent
+// use if w is.
+func NewStatsdSink(w io.Writer) MetricsSink {
+	return statsdSink{w}
+}
+
+func (sink statsdSink) IncCounter(name string, delta float64) {
+	sink.write(name, delta, "c")
+}
+
+func (sink statsdSink) SetGauge(name string, value float64) {
+	sink.write(name, value, "g")
+}
+
+func (sink statsdSink) ObserveHistogram(name string, value float64) {
+	sink.write(name, value, "h")
+}
+
+func (sink statsdSink) write(name string, value float64, metricType string) {
+	name = "phantom." + strings.TrimSuffix(strings.TrimPrefix(name, "phantom_"), "_total")
+	if _, err := fmt.Fprintf(sink.w, "%s:%v|%s\n", name, value, metricType); err != nil {
+		log.Debug().Msgf("Failed to send stats to StatsD: %v", err)
+	}
+}
+
+// Formats the metrics as StatsD lines, see publishMetrics
+func statsdLines(stats Stats, previous Stats) []byte {
+	var lines bytes.Buffer
+	publishMetrics(NewStatsdSink(&lines), stats, previous)
+	return lines.Bytes()
+}
+
+// Pushes stats to the StatsD server over UDP every StatsdInterval, all in one
+// packet, until the ProxyServer has been closed
+func (proxy *ProxyServer) statsdLoop(conn net.Conn) {
+	defer conn.Close()
+
+	var lines bytes.Buffer
+	proxy.metricsLoop(NewStatsdSink(&lines), func() {
+		if _, err := conn.Write(lines.Bytes()); err != nil {
+			log.Debug().Msgf("Failed to send stats to StatsD: %v", err)
+		}
+		lines.Reset()
+	})
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdLines(t *testing.T) {
+	previous := Stats{Connections: 3, BytesFromClients: 100, DroppedPackets: 5}
+	stats := Stats{Connections: 2, BytesFromClients: 150, DroppedPackets: 2}
+
+	lines := strings.Split(strings.TrimSuffix(string(statsdLines(stats, previous)), "\n"), "\n")
+
+	assert.Len(t, lines, len(metrics))
+	assert.Contains(t, lines, "phantom.connections:2|g")
+	assert.Contains(t, lines, "phantom.bytes_from_clients:50|c")
+	assert.Contains(t, lines, "phantom.packets_from_server:0|c")
+
+	// The counter was reset since the previous stats
+	assert.Contains(t, lines, "phantom.dropped_packets:2|c")
+}
+
+func TestStatsd(t *testing.T) {
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   "127.0.0.1:19140",
+		StatsdAddr:     statsd.LocalAddr().String(),
+		StatsdInterval: 50 * time.Millisecond,
+	})
+	proxyServer.counters().fromClient(42)
+
+	statsd.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, 4096)
+	for {
+		read, _, err := statsd.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first push may have happened before the bytes were counted
+		if strings.Contains(string(buffer[:read]), "phantom.bytes_from_clients:42|c\n") {
+			break
+		}
+	}
+}
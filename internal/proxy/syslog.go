@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Messages are logged with the daemon facility
+const syslogFacility = 3
+
+// Syslog severity of each zerolog level
+var syslogSeverities = map[zerolog.Level]int{
+	zerolog.TraceLevel: 7,
+	zerolog.DebugLevel: 7,
+	zerolog.InfoLevel:  6,
+	zerolog.WarnLevel:  4,
+	zerolog.ErrorLevel: 3,
+	zerolog.FatalLevel: 2,
+	zerolog.PanicLevel: 0,
+	zerolog.NoLevel:    5,
+}
+
+// SyslogWriter sends log lines to a syslog server over UDP as RFC 5424
+// messages. Use it as a zerolog output, and Close it once done logging.
+type SyslogWriter struct {
+	conn     net.Conn
+	hostname string
+	pid      int
+}
+
+func NewSyslogWriter(address string) (*SyslogWriter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogWriter{
+		conn,
+		hostname,
+		os.Getpid(),
+	}, nil
+}
+
+func (writer *SyslogWriter) Write(p []byte) (int, error) {
+	return writer.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (writer *SyslogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	severity, ok := syslogSeverities[level]
+	if !ok {
+		severity = syslogSeverities[zerolog.NoLevel]
+	}
+
+	message := fmt.Sprintf(
+		"<%d>1 %s %s phantom %d - - %s",
+		syslogFacility*8+severity,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		writer.hostname,
+		writer.pid,
+		bytes.TrimRight(p, "\n"),
+	)
+
+	if _, err := writer.conn.Write([]byte(message)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Closes the connection to the syslog server
+func (writer *SyslogWriter) Close() error {
+	return writer.conn.Close()
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	writer, err := NewSyslogWriter(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	logger := zerolog.New(writer).Level(zerolog.InfoLevel)
+	logger.Debug().Msg("hidden")
+	logger.Warn().Msg("hello")
+
+	buffer := make([]byte, 1024)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	read, err := server.Read(buffer)
+	assert.Nil(t, err)
+
+	pattern := regexp.MustCompile(`^<28>1 \S+ \S+ phantom \d+ - - \{"level":"warn","message":"hello"\}$`)
+	assert.Regexp(t, pattern, string(buffer[:read]))
+}
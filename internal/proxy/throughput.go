@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Weight of the newest sample in the throughput averages. Sampled every
+// idleCheckInterval, this follows roughly the last half minute of traffic.
+const throughputSmoothing = 0.2
+
+// throughput keeps exponentially weighted moving averages of the bytes per
+// second in each direction, sampled from the counters by the housekeeping
+// loop so that the packet path only pays for the counters
+type throughput struct {
+	clientToServer float64
+	serverToClient float64
+	// Counters and their byte totals as of the last sample
+	counters    *counters
+	fromClients uint64
+	fromServer  uint64
+	last        time.Time
+	mutex       *sync.Mutex
+}
+
+func newThroughput(c *counters, now time.Time) *throughput {
+	return &throughput{
+		0,
+		0,
+		c,
+		0,
+		0,
+		now,
+		&sync.Mutex{},
+	}
+}
+
+// Folds the bytes counted since the last sample into the averages
+func (t *throughput) sample(c *counters, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	fromClients := atomic.LoadUint64(&c.bytesFromClients)
+	fromServer := atomic.LoadUint64(&c.bytesFromServer)
+
+	// After ResetStats the totals start over, so there is nothing to compare
+	// the new counters with until the next sample
+	if elapsed := now.Sub(t.last).Seconds(); c == t.counters && elapsed > 0 {
+		clientToServer := float64(fromClients-t.fromClients) / elapsed
+		serverToClient := float64(fromServer-t.fromServer) / elapsed
+
+		t.clientToServer += throughputSmoothing * (clientToServer - t.clientToServer)
+		t.serverToClient += throughputSmoothing * (serverToClient - t.serverToClient)
+	}
+
+	t.counters = c
+	t.fromClients = fromClients
+	t.fromServer = fromServer
+	t.last = now
+}
+
+// Returns the averages from clients to the server and back, in bytes per second
+func (t *throughput) rates() (float64, float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.clientToServer, t.serverToClient
+}
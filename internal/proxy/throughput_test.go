@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughput(t *testing.T) {
+	c := &counters{}
+	now := time.Now()
+	rates := newThroughput(c, now)
+
+	// 10000 bytes from clients and 50000 from the server in 5s
+	c.fromClient(10000)
+	c.fromServer(50000)
+	now = now.Add(5 * time.Second)
+	rates.sample(c, now)
+
+	clientToServer, serverToClient := rates.rates()
+	assert.InDelta(t, 400, clientToServer, 0.001)
+	assert.InDelta(t, 2000, serverToClient, 0.001)
+
+	// Averages decay once traffic stops
+	now = now.Add(5 * time.Second)
+	rates.sample(c, now)
+
+	clientToServer, _ = rates.rates()
+	assert.InDelta(t, 320, clientToServer, 0.001)
+
+	// New counters after a reset are only compared from the next sample
+	reset := &counters{}
+	reset.fromClient(1000)
+	now = now.Add(5 * time.Second)
+	rates.sample(reset, now)
+
+	clientToServer, _ = rates.rates()
+	assert.InDelta(t, 320, clientToServer, 0.001)
+
+	reset.fromClient(5000)
+	now = now.Add(5 * time.Second)
+	rates.sample(reset, now)
+
+	clientToServer, _ = rates.rates()
+	assert.InDelta(t, 456, clientToServer, 0.001)
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Most answers a ttlCache keeps, so that clients flooding it from spoofed
+// IPs can't grow it without bound
+const maxTTLCacheEntries = 65536
+
+// Most lookups a ttlCache runs in the background at once
+const maxPendingLookups = 256
+
+// ttlCache remembers the answers of a slow lookup, such as a ban service or
+// reverse DNS, for each key for a while. Lookups run without holding the
+// lock. Once full, expired answers make room for new ones, or else arbitrary
+// ones do.
+type ttlCache struct {
+	lookup  func(key string) interface{}
+	ttl     time.Duration
+	entries map[string]ttlEntry
+	// Keys being looked up in the background by peek
+	pending map[string]bool
+	mutex   *sync.Mutex
+}
+
+type ttlEntry struct {
+	value  interface{}
+	stored time.Time
+}
+
+func newTTLCache(lookup func(key string) interface{}, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		lookup,
+		ttl,
+		make(map[string]ttlEntry),
+		make(map[string]bool),
+		&sync.Mutex{},
+	}
+}
+
+// Returns the answer for the key, looking it up if there is no recent one
+func (cache *ttlCache) load(key string) interface{} {
+	if value, ok := cache.cached(key, time.Now()); ok {
+		return value
+	}
+
+	value := cache.lookup(key)
+	cache.store(key, value, time.Now())
+
+	return value
+}
+
+// Returns the recent answer for the key, if there is one. Otherwise it is
+// looked up in the background, unless it already is or too many lookups are
+// running, so that the caller never waits for it.
+func (cache *ttlCache) peek(key string) (interface{}, bool) {
+	now := time.Now()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if entry, ok := cache.entries[key]; ok && now.Sub(entry.stored) < cache.ttl {
+		return entry.value, true
+	}
+
+	if cache.pending[key] || len(cache.pending) >= maxPendingLookups {
+		return nil, false
+	}
+
+	cache.pending[key] = true
+	go func() {
+		value := cache.lookup(key)
+		cache.store(key, value, time.Now())
+	}()
+
+	return nil, false
+}
+
+// Returns the answer for the key if it is recent
+func (cache *ttlCache) cached(key string, now time.Time) (interface{}, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok || now.Sub(entry.stored) >= cache.ttl {
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// Records the answer for the key, making room for it if the cache is full
+func (cache *ttlCache) store(key string, value interface{}, now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.pending, key)
+
+	if _, ok := cache.entries[key]; !ok && len(cache.entries) >= maxTTLCacheEntries {
+		cache.expireLocked(now)
+
+		for other := range cache.entries {
+			if len(cache.entries) < maxTTLCacheEntries {
+				break
+			}
+
+			delete(cache.entries, other)
+		}
+	}
+
+	cache.entries[key] = ttlEntry{value, now}
+}
+
+// Forgets answers older than the TTL
+func (cache *ttlCache) expire(now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.expireLocked(now)
+}
+
+// Forgets answers older than the TTL. Must be called with the mutex held.
+func (cache *ttlCache) expireLocked(now time.Time) {
+	for key, entry := range cache.entries {
+		if now.Sub(entry.stored) >= cache.ttl {
+			delete(cache.entries, key)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCachePeek(t *testing.T) {
+	release := make(chan struct{})
+	calls := make(chan string, 2)
+	cache := newTTLCache(func(key string) interface{} {
+		calls <- key
+		<-release
+		return key + "!"
+	}, time.Minute)
+
+	// Misses start one background lookup without waiting for it
+	_, ok := cache.peek("a")
+	assert.False(t, ok)
+	_, ok = cache.peek("a")
+	assert.False(t, ok)
+	assert.Equal(t, "a", <-calls)
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if value, ok := cache.peek("a"); ok {
+			assert.Equal(t, "a!", value)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lookup was not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Len(t, calls, 0)
+}
+
+func TestTTLCacheIsBounded(t *testing.T) {
+	cache := newTTLCache(func(key string) interface{} { return key }, time.Minute)
+
+	for i := 0; i < maxTTLCacheEntries+10; i++ {
+		cache.load(strconv.Itoa(i))
+	}
+
+	assert.Len(t, cache.entries, maxTTLCacheEntries)
+	_, ok := cache.cached(strconv.Itoa(maxTTLCacheEntries+9), time.Now())
+	assert.True(t, ok)
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Caps how many IPs the usage tracker holds at once
+const maxUsageEntries = 65536
+
+// usageTracker totals the bytes each client IP has sent and received, across
+// all of its connections. Each IP's total covers one window, starting with its
+// first byte, and starts over once the window has passed. The quota is checked
+// against the same total, so it allows UsageQuotaBytes per window.
+type usageTracker struct {
+	window  time.Duration
+	entries map[string]*usageEntry
+	mutex   *sync.Mutex
+}
+
+type usageEntry struct {
+	bytes uint64
+	start time.Time
+}
+
+func newUsageTracker(window time.Duration) *usageTracker {
+	return &usageTracker{
+		window,
+		make(map[string]*usageEntry),
+		&sync.Mutex{},
+	}
+}
+
+func (usage *usageTracker) ended(entry *usageEntry, now time.Time) bool {
+	return now.Sub(entry.start) >= usage.window
+}
+
+func (usage *usageTracker) add(ip net.IP, bytes int, now time.Time) {
+	key := ip.String()
+
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	entry, ok := usage.entries[key]
+	if !ok {
+		// Make room by forgetting ended windows first, then arbitrary IPs
+		if len(usage.entries) >= maxUsageEntries {
+			usage.expireLocked(now)
+		}
+		for k := range usage.entries {
+			if len(usage.entries) < maxUsageEntries {
+				break
+			}
+			delete(usage.entries, k)
+		}
+
+		entry = &usageEntry{0, now}
+		usage.entries[key] = entry
+	} else if usage.ended(entry, now) {
+		entry.bytes = 0
+		entry.start = now
+	}
+
+	entry.bytes += uint64(bytes)
+}
+
+func (usage *usageTracker) get(ip net.IP, now time.Time) uint64 {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	entry, ok := usage.entries[ip.String()]
+	if !ok || usage.ended(entry, now) {
+		return 0
+	}
+
+	return entry.bytes
+}
+
+// Returns the totals of every IP
+func (usage *usageTracker) snapshot(now time.Time) map[string]uint64 {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	usage.expireLocked(now)
+
+	snapshot := make(map[string]uint64, len(usage.entries))
+	for key, entry := range usage.entries {
+		snapshot[key] = entry.bytes
+	}
+
+	return snapshot
+}
+
+// Forgets IPs whose window has ended
+func (usage *usageTracker) expire(now time.Time) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	usage.expireLocked(now)
+}
+
+func (usage *usageTracker) expireLocked(now time.Time) {
+	for key, entry := range usage.entries {
+		if usage.ended(entry, now) {
+			delete(usage.entries, key)
+		}
+	}
+}
+
+// Usage returns the bytes sent and received by each connected client IP in its
+// current UsageWindow. Nil if UsageWindow is not set.
+func (proxy *ProxyServer) Usage() map[string]uint64 {
+	if proxy.usage == nil {
+		return nil
+	}
+
+	return proxy.usage.snapshot(time.Now())
+}
+
+// Adds bytes sent or received by a connected client to its IP's usage
+func (proxy *ProxyServer) recordUsage(client net.Addr, bytes int) {
+	if proxy.usage == nil {
+		return
+	}
+
+	if ip := addrIP(client); ip != nil {
+		proxy.usage.add(ip, bytes, time.Now())
+	}
+}
+
+// Returns whether the client's IP has used more than UsageQuotaBytes in its
+// current window
+func (proxy *ProxyServer) overQuota(client net.Addr) bool {
+	if proxy.usage == nil || proxy.prefs.UsageQuotaBytes == 0 {
+		return false
+	}
+
+	ip := addrIP(client)
+	return ip != nil && proxy.usage.get(ip, time.Now()) > proxy.prefs.UsageQuotaBytes
+}
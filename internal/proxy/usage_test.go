@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhead/phantom/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageTrackerWindow(t *testing.T) {
+	usage := newUsageTracker(time.Minute)
+	now := time.Now()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	usage.add(ip, 1000, now)
+	usage.add(ip, 1000, now.Add(30*time.Second))
+	assert.Equal(t, uint64(2000), usage.get(ip, now.Add(59*time.Second)))
+	assert.Equal(t, uint64(0), usage.get(net.IPv4(10, 0, 0, 2), now))
+
+	// The total starts over once the window has passed
+	assert.Equal(t, uint64(0), usage.get(ip, now.Add(time.Minute)))
+	usage.add(ip, 500, now.Add(time.Minute))
+	assert.Equal(t, uint64(500), usage.get(ip, now.Add(time.Minute)))
+
+	// IPs whose window has ended are forgotten
+	usage.expire(now.Add(time.Hour))
+	assert.Len(t, usage.entries, 0)
+	assert.Len(t, usage.snapshot(now.Add(time.Hour)), 0)
+}
+
+func TestUsageTrackerIsBounded(t *testing.T) {
+	usage := newUsageTracker(time.Minute)
+	now := time.Now()
+
+	for i := 0; i < maxUsageEntries+10; i++ {
+		usage.add(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), 1, now)
+	}
+
+	assert.Len(t, usage.entries, maxUsageEntries)
+}
+
+func TestUsageOnlyCountsConnectedClients(t *testing.T) {
+	server := startFakeServer(t)
+	proxyServer := startTestProxy(t, ProxyPrefs{
+		RemoteServer:   server.addr(),
+		UsageWindow:    time.Minute,
+		MaxConnections: 1,
+	})
+
+	client := dialProxy(t, proxyServer)
+	_, err := client.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+	waitForConnections(t, proxyServer, 1)
+
+	// Turned away because the proxy is full, so it has no usage
+	other := dialProxy(t, proxyServer)
+	_, err = other.Write([]byte{proto.OpenConnectionRequest1ID, 1, 2, 3})
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxyServer.Stats().DroppedPackets == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet from second client was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, map[string]uint64{"127.0.0.1": 4}, proxyServer.Usage())
+}